@@ -0,0 +1,37 @@
+// +build darwin freebsd linux netbsd openbsd
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ConfigDir returns the directory Packer keeps its configuration in: the
+// home directory on Unix-like systems.
+func ConfigDir() (string, error) {
+	// First prefer the HOME environmental variable
+	if home := os.Getenv("HOME"); home != "" {
+		log.Printf("Detected home directory from env var: %s", home)
+		return home, nil
+	}
+
+	// If that fails, try the shell
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", "eval echo ~$USER")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	result := strings.TrimSpace(stdout.String())
+	if result == "" {
+		return "", errors.New("blank output")
+	}
+
+	return result, nil
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -169,7 +170,7 @@ func (c *comm) Upload(path string, input io.Reader) error {
 		return scpUploadFile(target_file, input, w, stdoutR)
 	}
 
-	return c.scpSession("scp -vt "+target_dir, scpFunc)
+	return c.scpSession("scp -vt "+quotePath(target_dir), scpFunc)
 }
 
 func (c *comm) UploadDir(dst string, src string, excl []string) error {
@@ -199,7 +200,7 @@ func (c *comm) UploadDir(dst string, src string, excl []string) error {
 		}
 	}
 
-	return c.scpSession("scp -rvt "+dst, scpFunc)
+	return c.scpSession("scp -rvt "+quotePath(dst), scpFunc)
 }
 
 func (c *comm) Download(string, io.Writer) error {
@@ -447,3 +448,9 @@ func scpUploadDir(root string, fs []os.FileInfo, w io.Writer, r *bufio.Reader) e
 
 	return nil
 }
+
+// quotePath quotes a remote path as a single word for the shell that runs
+// the scp command, so that paths with spaces or quotes can be uploaded to.
+func quotePath(path string) string {
+	return "'" + strings.Replace(path, "'", `'"'"'`, -1) + "'"
+}
@@ -44,7 +44,8 @@ const defaultConfig = `
 		"file": "packer-provisioner-file",
 		"shell": "packer-provisioner-shell",
 		"salt-masterless": "packer-provisioner-salt-masterless",
-    "puppet": "packer-provisioner-puppet"
+    "puppet": "packer-provisioner-puppet",
+    "puppet-server": "packer-provisioner-puppet-server"
 	}
 }
 `
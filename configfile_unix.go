@@ -3,13 +3,8 @@
 package main
 
 import (
-	"bytes"
-	"errors"
-	"log"
-	"os"
-	"os/exec"
+	"github.com/mitchellh/packer/common"
 	"path/filepath"
-	"strings"
 )
 
 func configFile() (string, error) {
@@ -22,24 +17,5 @@ func configFile() (string, error) {
 }
 
 func configDir() (string, error) {
-	// First prefer the HOME environmental variable
-	if home := os.Getenv("HOME"); home != "" {
-		log.Printf("Detected home directory from env var: %s", home)
-		return home, nil
-	}
-
-	// If that fails, try the shell
-	var stdout bytes.Buffer
-	cmd := exec.Command("sh", "-c", "eval echo ~$USER")
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-
-	result := strings.TrimSpace(stdout.String())
-	if result == "" {
-		return "", errors.New("blank output")
-	}
-
-	return result, nil
+	return common.ConfigDir()
 }
@@ -0,0 +1,19 @@
+// This package implements a provisioner for Packer that provisions the
+// remote machine with the Puppet agent against a Puppet server. It shares
+// the install, upload and execution of the puppet provisioner, but has
+// the settings of the agent rather than those of puppet apply.
+package puppetserver
+
+import (
+	"github.com/mitchellh/packer/provisioner/puppet"
+)
+
+// Provisioner runs the Puppet agent against puppet_server, which is
+// required.
+type Provisioner struct {
+	puppet.Provisioner
+}
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	return p.Provisioner.PrepareAgent(raws...)
+}
@@ -0,0 +1,57 @@
+package puppetserver
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/provisioner/puppet"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func init() {
+	// Don't depend on the site-wide defaults of the machine running the
+	// tests
+	f, err := ioutil.TempFile("", "packer-puppet-defaults")
+	if err != nil {
+		panic(err)
+	}
+	f.WriteString("{}")
+	f.Close()
+
+	os.Setenv(puppet.DefaultsFileEnvVar, f.Name())
+}
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"puppet_server": "puppet.example.com",
+	}
+}
+
+func TestProvisioner_Impl(t *testing.T) {
+	var raw interface{}
+	raw = &Provisioner{}
+	if _, ok := raw.(packer.Provisioner); !ok {
+		t.Fatalf("must be a Provisioner")
+	}
+}
+
+func TestProvisionerPrepare_puppetServer(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{}); err == nil {
+		t.Fatal("should have error")
+	}
+
+	p = Provisioner{}
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerPrepare_masterlessSettings(t *testing.T) {
+	config := testConfig()
+	config["manifest_path"] = "manifests"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
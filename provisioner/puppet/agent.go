@@ -0,0 +1,366 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrivateStagingDir is the directory within the remote staging directory
+// that files holding secrets are uploaded to, before being moved into
+// place.
+const PrivateStagingDir = "private"
+
+// agentExitStatusReasons describes the failure exit statuses of
+// puppet agent --detailed-exitcodes.
+var agentExitStatusReasons = map[int]string{
+	1: "the run failed, the agent couldn't connect to puppet_server or get its catalog",
+	4: "some resources failed",
+	6: "some resources changed and some failed",
+}
+
+// ServerSettingsVersion is the version of Puppet from which the port of
+// puppet_server is the serverport setting rather than the deprecated
+// masterport, and puppet ssl bootstrap honors maxwaitforcert.
+const ServerSettingsVersion = "7"
+
+// modernAgent returns whether the Puppet on the remote machine is at least
+// ServerSettingsVersion. The version is only checked once per build.
+func (p *Provisioner) modernAgent(comm packer.Communicator) (bool, error) {
+	if p.agentVersion == nil {
+		version, err := p.puppetVersion(comm)
+		if err != nil {
+			return false, fmt.Errorf("Error checking the Puppet version: %s", err)
+		}
+
+		p.agentVersion, err = parseVersion(version)
+		if err != nil {
+			return false, fmt.Errorf("Error checking the Puppet version: %s", err)
+		}
+	}
+
+	minimum, _ := parseVersion(ServerSettingsVersion)
+	return compareVersions(p.agentVersion, minimum) >= 0, nil
+}
+
+// serverPortSetting returns the name of the Puppet setting of the port of
+// puppet_server for the Puppet on the remote machine.
+func (p *Provisioner) serverPortSetting(comm packer.Communicator) (string, error) {
+	modern, err := p.modernAgent(comm)
+	if err != nil {
+		return "", err
+	}
+
+	if modern {
+		return "serverport", nil
+	}
+
+	return "masterport", nil
+}
+
+// configureAgent points the agent at puppet_server in puppet.conf, so
+// that the agent of the image keeps using the server the image was built
+// from.
+func (p *Provisioner) configureAgent(comm packer.Communicator) error {
+	if err := p.setPuppetSetting("agent", "server", p.config.PuppetServer, comm); err != nil {
+		return err
+	}
+
+	if p.config.PuppetServerPort != 0 {
+		setting, err := p.serverPortSetting(comm)
+		if err != nil {
+			return err
+		}
+
+		port := strconv.Itoa(p.config.PuppetServerPort)
+		if err := p.setPuppetSetting("agent", setting, port, comm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// certname returns the configured certname, or else the certname of the
+// Puppet configuration of the remote machine.
+func (p *Provisioner) certname(comm packer.Communicator) (string, error) {
+	if p.config.Certname != "" {
+		return p.config.Certname, nil
+	}
+
+	return p.puppetSetting("agent", "certname", comm)
+}
+
+// uploadLocalFile uploads a local file to a remote path.
+func (p *Provisioner) uploadLocalFile(localPath string, remotePath string, comm packer.Communicator) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return p.upload(remotePath, f, comm)
+}
+
+// uploadPrivateFile uploads a file holding secrets into PrivateStagingDir,
+// which only the connecting user can access, makes it readable by that
+// user only, and returns its remote path. Cleanup removes the directory,
+// so that nothing is left behind if the file isn't moved into place.
+func (p *Provisioner) uploadPrivateFile(name string, r io.ReadSeeker, comm packer.Communicator) (string, error) {
+	dir := p.config.guest.Join(p.config.StagingDir, PrivateStagingDir)
+	if err := p.createRemoteDirectory(p.hostPath(dir), comm); err != nil {
+		return "", err
+	}
+
+	if err := p.executeCommand(p.config.guest.ChmodCommand("700", p.hostPath(dir)), comm, 0); err != nil {
+		return "", err
+	}
+
+	staged := p.config.guest.Join(dir, name)
+	if err := p.upload(p.hostPath(staged), r, comm); err != nil {
+		return "", err
+	}
+
+	if err := p.executeCommand(p.config.guest.ChmodCommand("600", p.hostPath(staged)), comm, 0); err != nil {
+		return "", err
+	}
+
+	return staged, nil
+}
+
+// sslFile is a file installed into the ssldir of the agent: the local
+// file, its name in the staging directory, its path relative to the
+// ssldir, its mode, and whether it is private, in which case it is
+// uploaded with uploadPrivateFile and moved into place.
+type sslFile struct {
+	local   string
+	staged  string
+	path    string
+	mode    string
+	private bool
+}
+
+// prepareSSLDir prepares the ssldir of the agent, set to ssl_directory if
+// configured, and installs the CA certificate of ca_cert_path and the
+// pre-issued certificate and private key of client_cert_path and
+// client_private_key_path into it. The agent then trusts the server
+// without downloading its CA certificate, and doesn't have to get its
+// certificate signed during the build. The files are owned by root, with
+// the modes Puppet gives them, and the private key is never readable by
+// other users of the remote machine.
+func (p *Provisioner) prepareSSLDir(comm packer.Communicator) error {
+	if p.config.SSLDir != "" {
+		if err := p.setPuppetSetting("main", "ssldir", p.config.SSLDir, comm); err != nil {
+			return err
+		}
+	}
+
+	ssldir, err := p.puppetSetting("agent", "ssldir", comm)
+	if err != nil {
+		return err
+	}
+
+	var files []sslFile
+	if p.config.CACertPath != "" {
+		files = append(files, sslFile{p.config.CACertPath, "ca-cert.pem", "certs/ca.pem", "644", false})
+	}
+
+	if p.config.ClientCertPath != "" {
+		certname, err := p.certname(comm)
+		if err != nil {
+			return err
+		}
+
+		files = append(files,
+			sslFile{p.config.ClientCertPath, "client-cert.pem", "certs/" + certname + ".pem", "644", false},
+			sslFile{p.config.ClientPrivateKeyPath, "client-key.pem", "private_keys/" + certname + ".pem", "640", true})
+	}
+
+	root := p.hostPath(ssldir)
+	certs := p.config.guest.Join(root, "certs")
+	privateKeys := p.config.guest.Join(root, "private_keys")
+	commands := []string{
+		p.config.guest.MkdirCommand(certs),
+		p.config.guest.MkdirCommand(privateKeys),
+		p.config.guest.ChmodCommand("771", root),
+		p.config.guest.ChmodCommand("755", certs),
+		p.config.guest.ChmodCommand("750", privateKeys),
+	}
+
+	for _, f := range files {
+		remotePath := p.config.guest.Join(root, f.path)
+		if f.private {
+			local, err := os.Open(f.local)
+			if err != nil {
+				return err
+			}
+
+			staged, err := p.uploadPrivateFile(f.staged, local, comm)
+			local.Close()
+			if err != nil {
+				return err
+			}
+
+			commands = append(commands, p.config.guest.MoveCommand(p.hostPath(staged), remotePath))
+		} else {
+			staged := p.config.guest.Join(p.config.StagingDir, f.staged)
+			if err := p.uploadLocalFile(f.local, p.hostPath(staged), comm); err != nil {
+				return err
+			}
+
+			commands = append(commands, p.config.guest.CopyCommand(p.hostPath(staged), remotePath))
+		}
+
+		commands = append(commands,
+			p.config.guest.ChownCommand("0:0", remotePath),
+			p.config.guest.ChmodCommand(f.mode, remotePath))
+	}
+
+	for _, command := range commands {
+		command, err := p.elevateWith(p.config.RunSudo, "", command)
+		if err != nil {
+			return err
+		}
+
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChallengePasswordOID is the OID of the challenge password attribute of
+// certificate requests.
+const ChallengePasswordOID = "1.2.840.113549.1.9.7"
+
+// writeCSRAttributes writes challenge_password into the csr_attributes.yaml
+// of the agent, readable by root only, so that the certificate request of
+// the agent carries it. The file is removed by removeCSRAttributes once
+// the certificate is signed.
+func (p *Provisioner) writeCSRAttributes(comm packer.Communicator) error {
+	csrAttributes, err := p.puppetSetting("agent", "csr_attributes", comm)
+	if err != nil {
+		return err
+	}
+
+	attributes := fmt.Sprintf("---\ncustom_attributes:\n  %s: %s\n",
+		ChallengePasswordOID, yamlString(p.config.ChallengePassword))
+	staged, err := p.uploadPrivateFile("csr_attributes.yaml", strings.NewReader(attributes), comm)
+	if err != nil {
+		return err
+	}
+
+	remotePath := p.hostPath(csrAttributes)
+	for _, command := range []string{
+		p.config.guest.MkdirCommand(path.Dir(remotePath)),
+		p.config.guest.MoveCommand(p.hostPath(staged), remotePath),
+		p.config.guest.ChownCommand("0:0", remotePath),
+		p.config.guest.ChmodCommand("640", remotePath),
+	} {
+		command, err := p.elevateWith(p.config.RunSudo, "", command)
+		if err != nil {
+			return err
+		}
+
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitForCert gets the certificate of the agent with puppet ssl
+// bootstrap, which checks every waitforcert seconds for the CA to sign
+// it, and fails if it isn't signed within cert_wait_timeout. Puppet 7 and
+// later give up by themselves with maxwaitforcert; older versions keep
+// bootstrapping on the remote machine after the build gave up on them.
+func (p *Provisioner) waitForCert(comm packer.Communicator) error {
+	modern, err := p.modernAgent(comm)
+	if err != nil {
+		return err
+	}
+
+	quote := p.config.guest.ArgQuote
+	args := []string{"ssl", "bootstrap", fmt.Sprintf("--waitforcert=%d", p.config.WaitForCert)}
+	if modern {
+		args = append(args, fmt.Sprintf("--maxwaitforcert=%d", int(p.config.certWaitTimeout.Seconds())))
+	}
+
+	if p.config.Certname != "" {
+		args = append(args, "--certname="+quote(p.config.Certname))
+	}
+
+	args = append(args, "--server="+quote(p.config.PuppetServer))
+	if p.config.PuppetServerPort != 0 {
+		setting, err := p.serverPortSetting(comm)
+		if err != nil {
+			return err
+		}
+
+		args = append(args, fmt.Sprintf("--%s=%d", setting, p.config.PuppetServerPort))
+	}
+
+	command := p.config.guest.ExecutablePath(p.config.PuppetBinDir, "puppet") + " " + strings.Join(args, " ")
+	command, err = p.elevateWith(p.config.RunSudo, p.config.RunAsUser, p.inRoot(command))
+	if err != nil {
+		return err
+	}
+
+	// Leave maxwaitforcert a check to time out before the build does.
+	timeout := p.config.certWaitTimeout + time.Duration(p.config.WaitForCert)*time.Second
+	status, err := p.runCommand(command, comm, timeout)
+	if _, ok := err.(commandTimeoutError); ok {
+		return fmt.Errorf("The certificate of the agent was never signed within %s", p.config.certWaitTimeout)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error getting the certificate of the agent: %s", err)
+	}
+
+	if status != 0 {
+		return fmt.Errorf("puppet ssl bootstrap exited with non-zero exit status: %d", status)
+	}
+
+	return nil
+}
+
+// removeCSRAttributes removes the csr_attributes.yaml written by
+// writeCSRAttributes, which isn't needed once the certificate of the agent
+// is signed, so that the challenge password doesn't stay on the machine.
+func (p *Provisioner) removeCSRAttributes(comm packer.Communicator) error {
+	csrAttributes, err := p.puppetSetting("agent", "csr_attributes", comm)
+	if err != nil {
+		return err
+	}
+
+	return p.removeRemoteDirectory(p.hostPath(csrAttributes), comm)
+}
+
+// cleanSSLDir removes the ssldir of the agent, and the csr_attributes.yaml
+// of challenge_password, which are unique to the build.
+func (p *Provisioner) cleanSSLDir(comm packer.Communicator) error {
+	settings := []string{"ssldir"}
+	if p.config.ChallengePassword != "" {
+		settings = append(settings, "csr_attributes")
+	}
+
+	for _, setting := range settings {
+		path, err := p.puppetSetting("agent", setting, comm)
+		if err != nil {
+			return err
+		}
+
+		if err := p.removeRemoteDirectory(p.hostPath(path), comm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
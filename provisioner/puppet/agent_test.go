@@ -0,0 +1,489 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAgentConfig returns the configuration of an agent mode run, without
+// the modules and manifests of testConfig.
+func testAgentConfig(t *testing.T) map[string]interface{} {
+	config := testConfig(t)
+	cleanupConfig(config)
+	delete(config, "module_path")
+	delete(config, "manifest_path")
+	config["puppet_server"] = "puppet.example.com"
+	config["staging_directory"] = "/tmp/staging"
+	return config
+}
+
+func TestProvisionerPrepare_puppetServer(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["puppet_server"] = "puppet.example.com"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testAgentConfig(t)
+	config["puppet_server_port"] = 70000
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	delete(config, "puppet_server")
+	config["puppet_server_port"] = 8140
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerRun_agent(t *testing.T) {
+	config := testAgentConfig(t)
+	config["puppet_server_port"] = 8141
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(agentCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(comm.uploads) > 0 || len(comm.uploadDirs) > 0 {
+		t.Fatalf("bad: %#v %#v", comm.uploads, comm.uploadDirs)
+	}
+
+	expected := []string{
+		"sudo -E puppet config set server puppet.example.com --section agent",
+		"sudo -E puppet --version",
+		"sudo -E puppet config set serverport 8141 --section agent",
+	}
+	configured := comm.commands[len(comm.commands)-3:]
+	for i := range expected {
+		if configured[i] != expected[i] {
+			t.Fatalf("bad: %#v", configured)
+		}
+	}
+
+	if err := p.Run(testUi(), comm, stage); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	run := comm.commands[len(comm.commands)-1]
+	if !strings.HasSuffix(run, " puppet agent --onetime --no-daemonize --detailed-exitcodes --verbose --server=puppet.example.com --serverport=8141") {
+		t.Fatalf("bad: %s", run)
+	}
+}
+
+func TestProvisionerRun_agentMasterport(t *testing.T) {
+	config := testAgentConfig(t)
+	config["puppet_server_port"] = 8141
+	config["waitforcert"] = 30
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &agentCommunicator{puppetVersion: "6.28.0"}
+	if err := p.Run(testUi(), comm, &Stage{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bootstrap := "sudo -E puppet ssl bootstrap --waitforcert=30 --server=puppet.example.com --masterport=8141"
+	found := false
+	for _, c := range comm.commands {
+		found = found || c == bootstrap
+	}
+	if !found {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	run := comm.commands[len(comm.commands)-1]
+	if !strings.HasSuffix(run, " --server=puppet.example.com --masterport=8141 --waitforcert=30") {
+		t.Fatalf("bad: %s", run)
+	}
+}
+
+func TestProvisionerRun_agentExitStatus(t *testing.T) {
+	config := testAgentConfig(t)
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for status, reason := range map[int]string{
+		1: "couldn't connect",
+		4: "some resources failed",
+		6: "some resources changed and some failed",
+	} {
+		comm := new(recordingCommunicator)
+		comm.StartExitStatus = status
+		err := p.Run(testUi(), comm, &Stage{})
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Fatalf("bad for %d: %v", status, err)
+		}
+	}
+
+	for _, status := range []int{0, 2} {
+		comm := new(recordingCommunicator)
+		comm.StartExitStatus = status
+		if err := p.Run(testUi(), comm, &Stage{}); err != nil {
+			t.Fatalf("bad for %d: %s", status, err)
+		}
+	}
+}
+
+func TestProvisionerRun_agentEnvironment(t *testing.T) {
+	config := testAgentConfig(t)
+	config["environment"] = "staging"
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.Run(testUi(), comm, &Stage{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	run := comm.commands[len(comm.commands)-1]
+	if !strings.HasSuffix(run, " puppet agent --onetime --no-daemonize --detailed-exitcodes --verbose --server=puppet.example.com --environment=staging") {
+		t.Fatalf("bad: %s", run)
+	}
+}
+
+// agentCommunicator is a recordingCommunicator answering puppet config
+// print with the settings of an agent, puppet --version with
+// puppetVersion, 7.24.0 by default, and puppet ssl bootstrap with
+// bootstrapExitStatus.
+type agentCommunicator struct {
+	recordingCommunicator
+	puppetVersion       string
+	bootstrapExitStatus int
+}
+
+func (c *agentCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.StartStdout = ""
+	switch {
+	case strings.Contains(rc.Command, "config print ssldir"):
+		c.StartStdout = "/etc/puppetlabs/puppet/ssl\n"
+	case strings.Contains(rc.Command, "config print certname"):
+		c.StartStdout = "build.example.com\n"
+	case strings.Contains(rc.Command, "config print csr_attributes"):
+		c.StartStdout = "/etc/puppetlabs/puppet/csr_attributes.yaml\n"
+	case strings.Contains(rc.Command, "config print confdir"):
+		c.StartStdout = "/etc/puppetlabs/puppet\n"
+	case strings.Contains(rc.Command, "config print route_file"):
+		c.StartStdout = "/etc/puppetlabs/puppet/routes.yaml\n"
+	case strings.HasSuffix(rc.Command, "puppet --version"):
+		c.StartStdout = "7.24.0\n"
+		if c.puppetVersion != "" {
+			c.StartStdout = c.puppetVersion + "\n"
+		}
+	}
+
+	c.StartExitStatus = 0
+	if strings.Contains(rc.Command, "ssl bootstrap") {
+		c.StartExitStatus = c.bootstrapExitStatus
+	}
+
+	return c.recordingCommunicator.Start(rc)
+}
+
+func TestProvisionerStage_clientCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer-puppet-ssl")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(cert, []byte("CERT"), 0644)
+	ioutil.WriteFile(key, []byte("KEY"), 0600)
+
+	config := testAgentConfig(t)
+	config["client_cert_path"] = cert
+	var p Provisioner
+	if err := p.PrepareAgent(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["client_private_key_path"] = key
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(agentCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.uploadData["/tmp/staging/client-cert.pem"] != "CERT" ||
+		comm.uploadData["/tmp/staging/private/client-key.pem"] != "KEY" {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	privateKey := "/etc/puppetlabs/puppet/ssl/private_keys/build.example.com.pem"
+	expected := []string{
+		"chmod 700 /tmp/staging/private",
+		"chmod 600 /tmp/staging/private/client-key.pem",
+		"sudo -E chmod 750 /etc/puppetlabs/puppet/ssl/private_keys",
+		"sudo -E mv -f /tmp/staging/private/client-key.pem " + privateKey,
+		"sudo -E chown 0:0 " + privateKey,
+		"sudo -E chmod 640 " + privateKey,
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+
+	// The staged key is removed even though the staging directory is kept.
+	p.config.CleanStagingDir = false
+	comm = new(agentCommunicator)
+	if err := p.Cleanup(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	found := false
+	for _, c := range comm.commands {
+		found = found || c == "sudo -E rm -rf /tmp/staging/private"
+	}
+	if !found {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+}
+
+func TestProvisionerStage_caCert(t *testing.T) {
+	ca, err := ioutil.TempFile("", "packer-puppet-ca")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(ca.Name())
+	ca.WriteString("CA")
+	ca.Close()
+
+	config := testAgentConfig(t)
+	config["ca_cert_path"] = ca.Name()
+	config["ssl_directory"] = "/var/lib/puppet/ssl"
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(agentCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.uploadData["/tmp/staging/ca-cert.pem"] != "CA" {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	expected := []string{
+		"sudo -E puppet config set ssldir /var/lib/puppet/ssl --section main",
+		"sudo -E chmod 771 /etc/puppetlabs/puppet/ssl",
+		"sudo -E cp -p /tmp/staging/ca-cert.pem /etc/puppetlabs/puppet/ssl/certs/ca.pem",
+		"sudo -E chmod 644 /etc/puppetlabs/puppet/ssl/certs/ca.pem",
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+}
+
+func TestProvisionerRun_certname(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["certname"] = "web01.example.com"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.Run(testUi(), comm, &Stage{ModulePath: "/tmp/modules", Manifest: "/tmp/site.pp"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if run := comm.commands[len(comm.commands)-1]; !strings.Contains(run, "puppet apply --verbose --certname=web01.example.com ") {
+		t.Fatalf("bad: %s", run)
+	}
+
+	config = testAgentConfig(t)
+	config["certname"] = "web01.example.com"
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.Run(testUi(), comm, &Stage{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if run := comm.commands[len(comm.commands)-1]; !strings.Contains(run, "puppet agent --onetime --no-daemonize --detailed-exitcodes --verbose --certname=web01.example.com ") {
+		t.Fatalf("bad: %s", run)
+	}
+}
+
+func TestProvisionerRun_nodeNameValue(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["certname"] = "build.example.com"
+	config["node_name_value"] = "webserver.prod.example.com"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.Run(testUi(), comm, &Stage{ModulePath: "/tmp/modules", Manifest: "/tmp/site.pp"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "puppet apply --verbose --certname=build.example.com --node_name_value=webserver.prod.example.com "
+	if run := comm.commands[len(comm.commands)-1]; !strings.Contains(run, expected) {
+		t.Fatalf("bad: %s", run)
+	}
+
+	if lookup := p.hieraLookupCommand("ntp::servers", &Stage{}, ""); !strings.Contains(lookup, "--node=webserver.prod.example.com ") {
+		t.Fatalf("bad: %s", lookup)
+	}
+}
+
+func TestProvisionerRun_waitForCert(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["waitforcert"] = 30
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testAgentConfig(t)
+	config["waitforcert"] = 30
+	config["cert_wait_timeout"] = "5m"
+	config["challenge_password"] = "s3cret"
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(agentCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "---\ncustom_attributes:\n  1.2.840.113549.1.9.7: \"s3cret\"\n"
+	if comm.uploadData["/tmp/staging/private/csr_attributes.yaml"] != expected {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	found := false
+	for _, c := range comm.commands {
+		found = found || c == "sudo -E mv -f /tmp/staging/private/csr_attributes.yaml /etc/puppetlabs/puppet/csr_attributes.yaml"
+	}
+	if !found {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	comm.commands = nil
+	if err := p.Run(testUi(), comm, stage); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The challenge password is removed once the certificate is signed.
+	expectedCommands := []string{
+		"sudo -E puppet ssl bootstrap --waitforcert=30 --maxwaitforcert=300 --server=puppet.example.com",
+		"sudo -E rm -rf /etc/puppetlabs/puppet/csr_attributes.yaml",
+	}
+	var commands []string
+	for _, c := range comm.commands {
+		if !strings.Contains(c, "config print") && !strings.HasSuffix(c, "--version") {
+			commands = append(commands, c)
+		}
+	}
+	if len(commands) != 3 || commands[0] != expectedCommands[0] || commands[1] != expectedCommands[1] {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	if run := comm.commands[len(comm.commands)-1]; !strings.HasSuffix(run, " --waitforcert=30") {
+		t.Fatalf("bad: %s", run)
+	}
+
+	comm.bootstrapExitStatus = 1
+	err = p.Run(testUi(), comm, stage)
+	if err == nil || !strings.Contains(err.Error(), "exit status: 1") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestProvisionerCleanup_sslDir(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["clean_ssl_dir"] = true
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testAgentConfig(t)
+	config["challenge_password"] = "s3cret"
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !p.config.CleanSSLDir {
+		t.Fatal("should clean the ssldir in agent mode")
+	}
+
+	comm := new(agentCommunicator)
+	if err := p.Cleanup(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		"sudo -E rm -rf /etc/puppetlabs/puppet/ssl",
+		"sudo -E rm -rf /etc/puppetlabs/puppet/csr_attributes.yaml",
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+}
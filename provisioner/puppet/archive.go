@@ -0,0 +1,258 @@
+package puppet
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Supported values of compression.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// archiveCompressions are the supported compressions of the uploaded
+// archives, with the suffix of the archives, the option given to tar to
+// extract them and the command checking that the remote machine can.
+var archiveCompressions = map[string]struct{ suffix, tarOption, check string }{
+	CompressionGzip: {".tar.gz", "-z ", prerequisites["tar"].Check},
+	CompressionZstd: {".tar.zst", "--zstd ", "sh -c 'command -v tar && command -v zstd'"},
+	CompressionNone: {".tar", "", "command -v tar"},
+}
+
+// compressor returns a writer compressing what is written to it into w
+// with the given compression. Closing it flushes the compressed data.
+func compressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+
+		return &commandWriter{stdin, cmd}, nil
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return gzip.NewWriter(w), nil
+	}
+}
+
+// commandWriter writes to the standard input of a command, which it
+// waits for when closed.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *commandWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	return c.cmd.Wait()
+}
+
+// nopWriteCloser is a writer whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// writeArchive writes the contents of localDir, but for the ignored
+// paths, to w as a tar archive with the given compression.
+func (p *Provisioner) writeArchive(localDir string, compression string, w io.Writer) error {
+	cw, err := compressor(compression, w)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(cw)
+
+	err = p.walkLocalDirectory(localDir, func(path string, relPath string, f os.FileInfo) (err error) {
+		if relPath == "." {
+			return nil
+		}
+
+		var link string
+		if f.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(f, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(relPath)
+		if f.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if f.IsDir() || link != "" {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
+
+// canExtractArchives checks once per run whether tar and gzip are
+// available on the remote machine, installing them first if
+// install_prerequisites is set. Without them, a warning is shown and the
+// files are uploaded one by one instead. It also picks the compression
+// of the archives, falling back from zstd to gzip if the remote machine
+// can't decompress zstd.
+func (p *Provisioner) canExtractArchives(comm packer.Communicator) (bool, error) {
+	if p.archiveChecked {
+		return p.archiveSupported, nil
+	}
+
+	if p.config.ApplyRoot == "" {
+		if err := p.ensurePrerequisite(p.ui, "tar", comm); err != nil {
+			return false, err
+		}
+	}
+
+	status, err := p.remoteCommandStatus(p.config.guest.ArchiveCheck, comm)
+	if err != nil {
+		return false, fmt.Errorf("Error checking for tar: %s", err)
+	}
+
+	p.archiveChecked = true
+	p.archiveSupported = status == 0
+	p.archiveCompression = CompressionGzip
+	if !p.archiveSupported {
+		p.ui.Error("Warning: tar or gzip isn't available on the remote machine, " +
+			"uploading files one by one instead of as an archive")
+		return false, nil
+	}
+
+	if p.config.Compression != CompressionGzip {
+		status, err := p.remoteCommandStatus(archiveCompressions[p.config.Compression].check, comm)
+		if err != nil {
+			return false, fmt.Errorf("Error checking for %s: %s", p.config.Compression, err)
+		}
+
+		if status == 0 {
+			p.archiveCompression = p.config.Compression
+		} else {
+			p.ui.Error(fmt.Sprintf("Warning: the remote machine can't extract %s archives, "+
+				"using %s instead", p.config.Compression, CompressionGzip))
+		}
+	}
+
+	return true, nil
+}
+
+// uploadArchive uploads the contents of localDir into remoteDir as a
+// single gzipped tar archive, which is extracted on the remote machine.
+func (p *Provisioner) uploadArchive(localDir string, remoteDir string, comm packer.Communicator) error {
+	if p.config.StreamArchive {
+		return p.streamArchive(localDir, remoteDir, comm)
+	}
+
+	archive, err := ioutil.TempFile(p.config.LocalTempDir, "packer-puppet")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	compression := archiveCompressions[p.archiveCompression]
+	log.Printf("Archiving directory %s with %s compression", localDir, p.archiveCompression)
+	if err := p.writeArchive(localDir, p.archiveCompression, archive); err != nil {
+		return fmt.Errorf("Error archiving %s: %s", localDir, err)
+	}
+
+	remoteArchive := remoteDir + compression.suffix
+	log.Printf("Uploading archive of %s to %s", localDir, remoteArchive)
+	if err := p.upload(remoteArchive, archive, comm); err != nil {
+		return fmt.Errorf("Error uploading archive: %s", err)
+	}
+
+	command := p.config.guest.ExtractCommand(remoteArchive, remoteDir, compression.tarOption)
+	if err := p.executeCommand(command, comm, 0); err != nil {
+		return fmt.Errorf("Error extracting archive: %s", err)
+	}
+
+	return nil
+}
+
+// streamArchive writes the contents of localDir as an archive straight to
+// the standard input of tar on the remote machine, which extracts it
+// into remoteDir.
+func (p *Provisioner) streamArchive(localDir string, remoteDir string, comm packer.Communicator) error {
+	r, w := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := p.writeArchive(localDir, p.archiveCompression, w)
+		w.CloseWithError(err)
+		written <- err
+	}()
+
+	var stdin io.Reader = r
+	if p.config.uploadLimiter != nil {
+		stdin = &throttledReader{r, p.config.uploadLimiter}
+	}
+
+	log.Printf("Streaming archive of %s to %s", localDir, remoteDir)
+	command := p.config.guest.StreamExtractCommand(remoteDir, archiveCompressions[p.archiveCompression].tarOption)
+	status, err := p.runCommandWithInput(command, stdin, comm, 0)
+
+	// Unblock the archive if the command stopped reading it early
+	r.Close()
+	if archiveErr := <-written; archiveErr != nil && archiveErr != io.ErrClosedPipe {
+		return fmt.Errorf("Error archiving %s: %s", localDir, archiveErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		return fmt.Errorf("Error extracting archive: Command exited with non-zero exit status: %d", status)
+	}
+
+	return nil
+}
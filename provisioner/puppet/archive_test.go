@@ -0,0 +1,280 @@
+package puppet
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/mitchellh/packer/packer"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWriteArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer-puppet-archive")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "ntp", "manifests"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "ntp", "manifests", "init.pp"), []byte("class ntp {}"), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p Provisioner
+	var buf bytes.Buffer
+	if err := p.writeArchive(dir, CompressionGzip, &buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	names := make([]string, 0)
+	contents := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		names = append(names, header.Name)
+		data, _ := ioutil.ReadAll(tr)
+		contents[header.Name] = string(data)
+	}
+
+	sort.Strings(names)
+	expected := []string{"ntp/", "ntp/manifests/", "ntp/manifests/init.pp"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("bad: %#v", names)
+	}
+
+	if contents["ntp/manifests/init.pp"] != "class ntp {}" {
+		t.Fatalf("bad: %#v", contents)
+	}
+}
+
+func TestProvisionerStage_uploadArchive(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_archive"] = true
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.HasSuffix(comm.UploadPath, ".tar.gz") {
+		t.Fatalf("bad: %s", comm.UploadPath)
+	}
+
+	archive := comm.UploadPath
+	dir := strings.TrimSuffix(archive, ".tar.gz")
+	expected := "sh -c 'mkdir -p \"$2\" && tar -z -xpf \"$1\" -C \"$2\" && rm -f \"$1\"' sh " + archive + " " + dir
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	config["guest_os_type"] = "windows"
+	config["skip_install"] = true
+	config["stream_archive"] = true
+	var w Provisioner
+	if err := w.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	delete(config, "stream_archive")
+	w = Provisioner{}
+	if err := w.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerStage_uploadArchiveCompression(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_archive"] = true
+	config["compression"] = "bzip2"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["compression"] = CompressionNone
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.HasSuffix(comm.UploadPath, ".tar") {
+		t.Fatalf("bad: %s", comm.UploadPath)
+	}
+
+	if !strings.Contains(comm.StartCmd.Command, " && tar -xpf ") {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerStage_uploadArchiveFallback(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_archive"] = true
+	config["staging_directory"] = "/tmp/staging"
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(tarlessCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if strings.HasSuffix(comm.UploadPath, ".tar.gz") {
+		t.Fatalf("should not upload an archive: %s", comm.UploadPath)
+	}
+
+	if comm.UploadDirDst != "/tmp/staging/manifests" {
+		t.Fatalf("should upload the files: %s", comm.UploadDirDst)
+	}
+}
+
+// tarlessCommunicator is a MockCommunicator for a remote machine without
+// tar, on which checking for it fails.
+type tarlessCommunicator struct {
+	packer.MockCommunicator
+}
+
+func (c *tarlessCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.StartExitStatus = 0
+	if strings.Contains(rc.Command, "command -v tar") {
+		c.StartExitStatus = 1
+	}
+
+	return c.MockCommunicator.Start(rc)
+}
+
+func TestProvisionerStage_streamArchive(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["stream_archive"] = true
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["upload_archive"] = true
+	config["staging_directory"] = "/tmp/staging"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.UploadCalled {
+		t.Fatalf("should not upload the archive: %s", comm.UploadPath)
+	}
+
+	expected := "sh -c 'mkdir -p \"$1\" && tar -z -xpf - -C \"$1\"' sh /tmp/staging/manifests"
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	gz, err := gzip.NewReader(strings.NewReader(comm.StartStdin))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	header, err := tar.NewReader(gz).Next()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if header.Name != DefaultManifestFile {
+		t.Fatalf("bad: %s", header.Name)
+	}
+}
+
+func TestProvisionerStage_localTempDir(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_archive"] = true
+	config["local_temp_dir"] = "/nonexistent/packer-puppet"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	tempDir, err := ioutil.TempDir("", "packer-puppet-temp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config["local_temp_dir"] = tempDir
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(tempFileCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(comm.files) == 0 {
+		t.Fatal("should upload archives")
+	}
+
+	for _, name := range comm.files {
+		if filepath.Dir(name) != tempDir {
+			t.Fatalf("bad: %s", name)
+		}
+	}
+}
+
+// tempFileCommunicator is a MockCommunicator that records the names of
+// the local files uploaded.
+type tempFileCommunicator struct {
+	packer.MockCommunicator
+	files []string
+}
+
+func (c *tempFileCommunicator) Upload(path string, r io.Reader) error {
+	if f, ok := r.(*os.File); ok {
+		c.files = append(c.files, f.Name())
+	}
+
+	return c.MockCommunicator.Upload(path, r)
+}
@@ -0,0 +1,61 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"strings"
+	"time"
+)
+
+// audit records a command executed on the remote machine so that it can
+// be written to the audit log at the end of the run.
+func (p *Provisioner) audit(command string) {
+	if p.config.AuditLog == "" {
+		return
+	}
+
+	entry := fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), p.redact(command))
+	p.auditEntries = append(p.auditEntries, entry)
+}
+
+// redact masks every secret known to the provisioner within s.
+func (p *Provisioner) redact(s string) string {
+	for _, secret := range p.config.secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, "<sensitive>", -1)
+		}
+	}
+
+	return s
+}
+
+// writeAuditLog appends the recorded commands to the audit log on the
+// remote machine. The entries are uploaded next to the staging directory,
+// which may already be cleaned up, then appended with elevated
+// privileges, so that nothing but the command is given to the elevated
+// command. Both paths are within apply_root, if one is configured.
+func (p *Provisioner) writeAuditLog(comm packer.Communicator) error {
+	if len(p.auditEntries) == 0 {
+		return nil
+	}
+
+	entries := strings.Join(p.auditEntries, "\n") + "\n"
+	staged := p.hostPath(p.config.StagingDir + "-audit.log")
+	auditLog := p.hostPath(p.config.AuditLog)
+	if err := p.upload(staged, strings.NewReader(entries), comm); err != nil {
+		return err
+	}
+
+	command, err := p.elevateWith(p.config.RunSudo, "",
+		"sh -c "+shellQuote("cat "+shellQuote(staged)+" >> "+shellQuote(auditLog)))
+	if err != nil {
+		return err
+	}
+
+	appendErr := p.executeCommand(command, comm, 0)
+	if err := p.executeCommand(p.config.guest.RemoveDirCommand(staged), comm, 0); err != nil && appendErr == nil {
+		appendErr = err
+	}
+
+	return appendErr
+}
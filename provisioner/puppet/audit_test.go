@@ -0,0 +1,126 @@
+package puppet
+
+import (
+	"bytes"
+	"github.com/mitchellh/packer/packer"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerAudit_disabled(t *testing.T) {
+	var p Provisioner
+	p.audit("puppet apply")
+
+	if len(p.auditEntries) != 0 {
+		t.Fatalf("bad: %#v", p.auditEntries)
+	}
+}
+
+func TestProvisionerWriteAuditLog(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["audit_log"] = "/var/log/packer-puppet-audit.log"
+	config["staging_directory"] = "/tmp/staging"
+	config["sudo_password"] = "hunter2"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.ui = testUi()
+
+	p.audit("echo hunter2 | sudo -S true")
+	p.audit("puppet apply")
+
+	comm := new(recordingCommunicator)
+	if err := p.writeAuditLog(comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		"sudo -S -p '' -E sh -c 'cat /tmp/staging-audit.log >> /var/log/packer-puppet-audit.log'",
+		"rm -rf /tmp/staging-audit.log",
+	}
+	if len(comm.commands) != 2 || comm.commands[0] != expected[0] || comm.commands[1] != expected[1] {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	lines := strings.Split(strings.TrimSpace(comm.uploadData["/tmp/staging-audit.log"]), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("bad: %#v", lines)
+	}
+
+	if strings.Contains(lines[0], "hunter2") || !strings.HasSuffix(lines[0], "echo <sensitive> | sudo -S true") {
+		t.Fatalf("bad: %s", lines[0])
+	}
+
+	if !strings.HasSuffix(lines[1], " puppet apply") {
+		t.Fatalf("bad: %s", lines[1])
+	}
+}
+
+func TestProvisionerWriteAuditLog_applyRoot(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["audit_log"] = "/var/log/packer-puppet-audit.log"
+	config["staging_directory"] = "/tmp/staging"
+	config["apply_root"] = "/mnt/image"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.ui = testUi()
+
+	p.audit("puppet apply")
+
+	comm := new(recordingCommunicator)
+	if err := p.writeAuditLog(comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "sudo -E sh -c 'cat /mnt/image/tmp/staging-audit.log >> /mnt/image/var/log/packer-puppet-audit.log'"
+	if len(comm.commands) != 2 || comm.commands[0] != expected {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	if _, ok := comm.uploadData["/mnt/image/tmp/staging-audit.log"]; !ok {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+}
+
+func TestProvisionerPrepare_auditLogWindows(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["audit_log"] = "C:/packer-puppet-audit.log"
+	config["guest_os_type"] = "windows"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerRun_sensitiveValues(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["sensitive_values"] = []string{"hunter2"}
+	config["execute_command"] = "echo token=hunter2"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "token=hunter2\n"
+	ui := testUi()
+	if err := p.Run(ui, comm, &Stage{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	output := ui.Writer.(*bytes.Buffer).String()
+	if strings.Contains(output, "hunter2") || !strings.Contains(output, "token=<sensitive>") {
+		t.Fatalf("bad: %s", output)
+	}
+}
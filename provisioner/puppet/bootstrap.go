@@ -0,0 +1,66 @@
+package puppet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// BootstrapScriptFile is the name of the bootstrap script in the
+// remote staging directory.
+const BootstrapScriptFile = "puppet-bootstrap.sh"
+
+// fetchBootstrapScript downloads the bootstrap script and verifies that
+// its SHA256 checksum is the expected one.
+func fetchBootstrapScript(url string, checksum string) ([]byte, error) {
+	log.Printf("Downloading bootstrap script: %s", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad response downloading %s: %s", url, resp.Status)
+	}
+
+	script, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(script)
+	if actual := hex.EncodeToString(sum[:]); actual != strings.ToLower(checksum) {
+		return nil, fmt.Errorf("Checksum of %s is %s, expected %s", url, actual, checksum)
+	}
+
+	return script, nil
+}
+
+// uploadBootstrapScript downloads and verifies the bootstrap script, and
+// uploads it to the staging directory. It returns its remote path.
+func (p *Provisioner) uploadBootstrapScript(ui packer.Ui, comm packer.Communicator) (string, error) {
+	ui.Message(fmt.Sprintf("Downloading bootstrap script: %s", p.config.BootstrapScriptURL))
+	script, err := fetchBootstrapScript(p.config.BootstrapScriptURL, p.config.BootstrapScriptSHA256)
+	if err != nil {
+		return "", err
+	}
+
+	err = p.createRemoteDirectory(p.hostPath(p.config.StagingDir), comm)
+	if err != nil {
+		return "", err
+	}
+
+	remotePath := p.config.guest.Join(p.config.StagingDir, BootstrapScriptFile)
+	if err := p.upload(p.hostPath(remotePath), bytes.NewReader(script), comm); err != nil {
+		return "", err
+	}
+
+	return remotePath, nil
+}
@@ -0,0 +1,68 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testBootstrapScript = "#!/bin/sh\necho installing\n"
+
+// SHA256 checksum of testBootstrapScript
+const testBootstrapScriptSHA256 = "0ce619c6c940c7c71a56a15360c8f4d662b6358bd35c47bbf3b70d2b3714d3f7"
+
+func TestProvisionerInstall_script(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testBootstrapScript)
+	}))
+	defer server.Close()
+
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["install_method"] = []string{"script"}
+	config["bootstrap_script_url"] = server.URL + "/install.sh"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["bootstrap_script_sha256"] = testBootstrapScriptSHA256
+	config["bootstrap_script_args"] = []string{"-v", "8.4.0"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if err := p.Install(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	remotePath := RemoteStagingPath + "/" + BootstrapScriptFile
+	if comm.UploadPath != remotePath || comm.UploadData != testBootstrapScript {
+		t.Fatalf("bad: %s %s", comm.UploadPath, comm.UploadData)
+	}
+
+	if comm.StartCmd.Command != "sudo -E sh "+remotePath+" -v 8.4.0" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	// A script that doesn't match the checksum is never run
+	config["bootstrap_script_sha256"] = "0000000000000000000000000000000000000000000000000000000000000000"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm = new(packer.MockCommunicator)
+	if err := p.Install(testUi(), comm); err == nil {
+		t.Fatal("should have error")
+	}
+
+	if comm.UploadCalled {
+		t.Fatal("should not upload the script")
+	}
+}
@@ -0,0 +1,107 @@
+package puppet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ModulesBundleDir is the name of the directory of the staging directory
+// the bundle of modules_url is extracted into.
+const ModulesBundleDir = "modules-bundle"
+
+// bundleCompression returns the compression of the tarball at the given
+// URL, from its extension.
+func bundleCompression(rawURL string) string {
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".tar.zst") || strings.HasSuffix(path, ".tzst"):
+		return CompressionZstd
+	case strings.HasSuffix(path, ".tar"):
+		return CompressionNone
+	default:
+		return CompressionGzip
+	}
+}
+
+// downloadModulesBundle downloads the tarball at url, which may be an
+// object store URL, into w, failing unless its SHA256 checksum is the
+// expected one.
+func downloadModulesBundle(url string, checksum string, w io.Writer) error {
+	log.Printf("Downloading modules bundle: %s", url)
+	req, err := objectRequest(url)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bad response downloading %s: %s", url, resp.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), resp.Body); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != strings.ToLower(checksum) {
+		return fmt.Errorf("Checksum of %s is %s, expected %s", url, actual, checksum)
+	}
+
+	return nil
+}
+
+// stageModulesBundle downloads and verifies the tarball of modules_url,
+// uploads it and extracts it into the remote directory dir.
+func (p *Provisioner) stageModulesBundle(ui packer.Ui, dir string, comm packer.Communicator) error {
+	if p.config.ApplyRoot == "" {
+		if err := p.ensurePrerequisite(ui, "tar", comm); err != nil {
+			return err
+		}
+	}
+
+	bundle, err := ioutil.TempFile(p.config.LocalTempDir, "packer-puppet-modules")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundle.Name())
+	defer bundle.Close()
+
+	if err := downloadModulesBundle(p.config.ModulesURL, p.config.ModulesSHA256, bundle); err != nil {
+		return err
+	}
+
+	if _, err := bundle.Seek(0, 0); err != nil {
+		return err
+	}
+
+	compression := archiveCompressions[bundleCompression(p.config.ModulesURL)]
+	remoteBundle := p.hostPath(dir) + compression.suffix
+	if err := p.upload(remoteBundle, bundle, comm); err != nil {
+		return fmt.Errorf("Error uploading modules bundle: %s", err)
+	}
+
+	command := p.config.guest.ExtractCommand(remoteBundle, p.hostPath(dir), compression.tarOption)
+	if err := p.executeCommand(command, comm, 0); err != nil {
+		return fmt.Errorf("Error extracting modules bundle: %s", err)
+	}
+
+	return nil
+}
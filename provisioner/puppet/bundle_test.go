@@ -0,0 +1,93 @@
+package puppet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBundleCompression(t *testing.T) {
+	cases := map[string]string{
+		"https://ci.example.com/modules.tar.gz":          CompressionGzip,
+		"https://ci.example.com/modules.tgz?token=abc":   CompressionGzip,
+		"https://ci.example.com/modules.tar.zst":         CompressionZstd,
+		"https://ci.example.com/modules.tar?version=1.2": CompressionNone,
+	}
+
+	for url, expected := range cases {
+		if actual := bundleCompression(url); actual != expected {
+			t.Fatalf("%s: %s", url, actual)
+		}
+	}
+}
+
+func TestProvisionerStage_modulesURL(t *testing.T) {
+	const bundle = "not really a tarball"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, bundle)
+	}))
+	defer server.Close()
+
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["modules_url"] = server.URL + "/modules.tar.gz"
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	sum := sha256.Sum256([]byte(bundle))
+	config["modules_sha256"] = hex.EncodeToString(sum[:])
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if stage.ModulePath != "/tmp/staging/modules-0:/tmp/staging/"+ModulesBundleDir {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	remoteBundle := "/tmp/staging/" + ModulesBundleDir + ".tar.gz"
+	found := false
+	for _, path := range comm.uploads {
+		found = found || path == remoteBundle
+	}
+	if !found {
+		t.Fatalf("bad: %#v", comm.uploads)
+	}
+
+	extract := "tar -z -xpf \"$1\" -C \"$2\" && rm -f \"$1\"' sh " + remoteBundle
+	if !strings.Contains(strings.Join(comm.commands, "\n"), extract) {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	// A bundle that doesn't match the checksum is never uploaded
+	config["modules_sha256"] = strings.Repeat("0", 64)
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm = new(recordingCommunicator)
+	if _, err := p.Stage(testUi(), comm); err == nil {
+		t.Fatal("should have error")
+	}
+
+	for _, path := range comm.uploads {
+		if path == remoteBundle {
+			t.Fatal("should not upload the bundle")
+		}
+	}
+}
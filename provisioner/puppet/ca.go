@@ -0,0 +1,119 @@
+package puppet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultPuppetServerPort is the port of puppet_server when
+// puppet_server_port isn't set.
+const DefaultPuppetServerPort = 8140
+
+// caAPIURL returns the base URL of the CA API of puppet_server.
+func (p *Provisioner) caAPIURL() string {
+	if p.config.CAAPIURL != "" {
+		return strings.TrimRight(p.config.CAAPIURL, "/")
+	}
+
+	port := p.config.PuppetServerPort
+	if port == 0 {
+		port = DefaultPuppetServerPort
+	}
+
+	return fmt.Sprintf("https://%s:%d", p.config.PuppetServer, port)
+}
+
+// httpClient returns an HTTP client trusting the CA certificate of
+// caCertPath, or else the CA certificates of the build machine, and
+// authenticating with the given client certificate and private key, if
+// any. Requests go through the proxy of the HTTPS_PROXY and NO_PROXY
+// environment variables, if any.
+func (p *Provisioner) httpClient(caCertPath string, certPath string, keyPath string) (*http.Client, error) {
+	tlsConfig := new(tls.Config)
+	if caCertPath != "" {
+		pem, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", caCertPath)
+		}
+	}
+
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}, nil
+}
+
+// caAPIRequest sends a request to the certificate_status endpoint of the
+// given certname, failing unless the CA API answers with no content.
+func (p *Provisioner) caAPIRequest(client *http.Client, method string, certname string, body string) error {
+	endpoint := p.caAPIURL() + "/puppet-ca/v1/certificate_status/" + url.PathEscape(certname)
+	log.Printf("CA API request: %s %s", method, endpoint)
+	req, err := http.NewRequest(method, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if p.config.CAAPIToken != "" {
+		req.Header.Set("X-Authentication", p.config.CAAPIToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Bad response to %s %s: %s: %s",
+			method, endpoint, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// cleanNodeCertificate revokes the certificate of the agent with the CA
+// API of puppet_server, then removes it from the CA, so that build
+// machines don't pile up in the CA once the image is built.
+func (p *Provisioner) cleanNodeCertificate(comm packer.Communicator) error {
+	certname, err := p.certname(comm)
+	if err != nil {
+		return err
+	}
+
+	client, err := p.httpClient(p.config.CACertPath, p.config.CAAPICertPath, p.config.CAAPIKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := p.caAPIRequest(client, "PUT", certname, `{"desired_state":"revoked"}`); err != nil {
+		return err
+	}
+
+	return p.caAPIRequest(client, "DELETE", certname, "")
+}
@@ -0,0 +1,101 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProvisionerPrepare_cleanNodeCertificate(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["clean_node_certificate"] = true
+	config["ca_api_token"] = "t0ken"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testAgentConfig(t)
+	config["clean_node_certificate"] = true
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["ca_api_token"] = "t0ken"
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.caAPIURL() != "https://puppet.example.com:8140" {
+		t.Fatalf("bad: %s", p.caAPIURL())
+	}
+}
+
+func TestProvisionerCleanup_nodeCertificate(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Authentication") != "t0ken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := testAgentConfig(t)
+	config["clean_node_certificate"] = true
+	config["ca_api_url"] = server.URL
+	config["ca_api_token"] = "t0ken"
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.Cleanup(testUi(), new(agentCommunicator)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		`PUT /puppet-ca/v1/certificate_status/build.example.com {"desired_state":"revoked"}`,
+		"DELETE /puppet-ca/v1/certificate_status/build.example.com ",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("bad: %#v", requests)
+	}
+
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Fatalf("bad: %#v", requests)
+		}
+	}
+
+	config["ca_api_token"] = "wrong"
+	p = Provisioner{}
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.Cleanup(testUi(), new(agentCommunicator)); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerHTTPClient_proxy(t *testing.T) {
+	var p Provisioner
+	client, err := p.httpClient("", "", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if client.Transport.(*http.Transport).Proxy == nil {
+		t.Fatal("should use the proxy of the environment")
+	}
+}
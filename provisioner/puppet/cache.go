@@ -0,0 +1,139 @@
+package puppet
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CacheScriptSuffix is appended to the remote path of a directory to
+// name the script populating it from the remote cache.
+const CacheScriptSuffix = ".cache.sh"
+
+// uploadCached uploads the contents of localDir into remoteDir through
+// the content-addressed remote_cache_directory. Only the files whose
+// contents aren't cached yet are uploaded, into the cache, and a single
+// script then copies them from the cache into remoteDir.
+func (p *Provisioner) uploadCached(localDir string, remoteDir string, comm packer.Communicator) error {
+	cacheDir := p.hostPath(p.config.RemoteCacheDir)
+	if err := p.createRemoteDirectory(cacheDir, comm); err != nil {
+		return err
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "set -e\nmkdir -p %s\n", shellQuote(remoteDir))
+
+	sums := make(map[string]string)
+	copies := make([]string, 0)
+	links := make([]string, 0)
+	err := p.walkLocalDirectory(localDir, func(path string, relPath string, f os.FileInfo) error {
+		if relPath == "." {
+			return nil
+		}
+
+		remotePath := p.config.guest.Join(remoteDir, relPath)
+		if f.IsDir() {
+			fmt.Fprintf(&script, "mkdir -p %s\n", shellQuote(remotePath))
+			return nil
+		}
+
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			links = append(links, p.config.guest.SymlinkCommand(target, remotePath))
+			return nil
+		}
+
+		sum, err := checksumFile(path)
+		if err != nil {
+			return err
+		}
+
+		sums[sum] = path
+		copies = append(copies, fmt.Sprintf("cp %s %s",
+			shellQuote(p.config.guest.Join(cacheDir, sum)), shellQuote(remotePath)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	missing, err := p.missingFromCache(cacheDir, sums, comm)
+	if err != nil {
+		return fmt.Errorf("Error checking the remote cache: %s", err)
+	}
+
+	log.Printf("Uploading %d of %d files of %s missing from the remote cache",
+		len(missing), len(sums), localDir)
+
+	// Files are uploaded under a temporary name and only moved into place
+	// by the script, so that an interrupted upload doesn't leave a file
+	// with the wrong contents in the cache.
+	uploads := make([]fileUpload, 0, len(missing))
+	for _, sum := range missing {
+		cached := p.config.guest.Join(cacheDir, sum)
+		uploads = append(uploads, fileUpload{sums[sum], cached + ".part"})
+		fmt.Fprintf(&script, "mv -f %s %s\n", shellQuote(cached+".part"), shellQuote(cached))
+	}
+
+	if err := p.uploadConcurrently(uploads, comm); err != nil {
+		return err
+	}
+
+	for _, line := range append(copies, links...) {
+		script.WriteString(line + "\n")
+	}
+
+	scriptPath := remoteDir + CacheScriptSuffix
+	if err := p.upload(scriptPath, bytes.NewReader(script.Bytes()), comm); err != nil {
+		return fmt.Errorf("Error uploading cache script: %s", err)
+	}
+
+	command := fmt.Sprintf("sh -c 'sh \"$1\" && rm -f \"$1\"' sh %s", shellQuote(scriptPath))
+	if err := p.executeCommand(command, comm, 0); err != nil {
+		return fmt.Errorf("Error copying files from the remote cache: %s", err)
+	}
+
+	return nil
+}
+
+// missingFromCache returns the checksums, among those given, of the
+// contents missing from the remote cache directory, sorted.
+func (p *Provisioner) missingFromCache(cacheDir string, sums map[string]string, comm packer.Communicator) ([]string, error) {
+	if len(sums) == 0 {
+		return nil, nil
+	}
+
+	all := make([]string, 0, len(sums))
+	for sum := range sums {
+		all = append(all, sum)
+	}
+	sort.Strings(all)
+
+	command := fmt.Sprintf("sh -c 'cd \"$1\" && shift && for h; do [ -f \"$h\" ] || echo \"$h\"; done' sh %s %s",
+		shellQuote(cacheDir), strings.Join(all, " "))
+	output, status, err := p.remoteCommandOutput(command, comm)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != 0 {
+		return nil, fmt.Errorf("Command exited with non-zero exit status: %d", status)
+	}
+
+	missing := make([]string, 0)
+	for _, sum := range strings.Fields(output) {
+		if _, ok := sums[sum]; ok {
+			missing = append(missing, sum)
+		}
+	}
+
+	return missing, nil
+}
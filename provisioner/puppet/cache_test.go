@@ -0,0 +1,61 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerUploadCached(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	localDir := config["module_path"].(string)
+	for name, contents := range map[string]string{"a.pp": "class a {}", "b.pp": "class b {}"} {
+		if err := ioutil.WriteFile(filepath.Join(localDir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	config["remote_cache_directory"] = "/var/cache/puppet"
+	config["incremental_upload"] = true
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	delete(config, "incremental_upload")
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sumA, _ := checksumFile(filepath.Join(localDir, "a.pp"))
+	sumB, _ := checksumFile(filepath.Join(localDir, "b.pp"))
+
+	// Only the contents of a.pp are missing from the cache
+	p.ui = testUi()
+	comm := new(recordingCommunicator)
+	comm.StartStdout = sumA + "\n"
+	if err := p.uploadContents(localDir, "/tmp/staging/modules", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{"/var/cache/puppet/" + sumA + ".part", "/tmp/staging/modules" + CacheScriptSuffix}
+	if !reflect.DeepEqual(comm.uploads, expected) {
+		t.Fatalf("bad: %#v", comm.uploads)
+	}
+
+	script := comm.uploadData["/tmp/staging/modules"+CacheScriptSuffix]
+	for _, line := range []string{
+		"mv -f /var/cache/puppet/" + sumA + ".part /var/cache/puppet/" + sumA,
+		"cp /var/cache/puppet/" + sumA + " /tmp/staging/modules/a.pp",
+		"cp /var/cache/puppet/" + sumB + " /tmp/staging/modules/b.pp",
+	} {
+		if !strings.Contains(script, line+"\n") {
+			t.Fatalf("bad: %s", script)
+		}
+	}
+}
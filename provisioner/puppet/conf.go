@@ -0,0 +1,48 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"strings"
+)
+
+// setPuppetSetting sets a setting of a section of puppet.conf on the
+// remote machine with puppet config set, with elevated privileges.
+func (p *Provisioner) setPuppetSetting(section string, name string, value string, comm packer.Communicator) error {
+	quote := p.config.guest.ArgQuote
+	command := fmt.Sprintf("%s config set %s %s --section %s",
+		p.config.guest.ExecutablePath(p.config.PuppetBinDir, "puppet"), name, quote(value), section)
+	command, err := p.elevateWith(p.config.RunSudo, "", p.inRoot(command))
+	if err != nil {
+		return err
+	}
+
+	return p.executeCommand(command, comm, 0)
+}
+
+// puppetSetting returns the value of a setting of a section of the Puppet
+// configuration on the remote machine, as printed by puppet config print.
+func (p *Provisioner) puppetSetting(section string, name string, comm packer.Communicator) (string, error) {
+	command := fmt.Sprintf("%s config print %s --section %s",
+		p.config.guest.ExecutablePath(p.config.PuppetBinDir, "puppet"), name, section)
+	command, err := p.elevateWith(p.config.RunSudo, "", p.inRoot(command))
+	if err != nil {
+		return "", err
+	}
+
+	output, status, err := p.remoteCommandOutput(command, comm)
+	if err != nil {
+		return "", err
+	}
+
+	if status != 0 {
+		return "", fmt.Errorf("puppet config print %s exited with non-zero exit status: %d", name, status)
+	}
+
+	value := strings.TrimSpace(output)
+	if value == "" {
+		return "", fmt.Errorf("puppet config print %s printed nothing", name)
+	}
+
+	return value, nil
+}
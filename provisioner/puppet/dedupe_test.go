@@ -0,0 +1,58 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerStage_deduplicateUploads(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	vendor, err := ioutil.TempDir("", "packer-puppet-vendor")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(vendor)
+
+	for _, dir := range []string{config["module_path"].(string), vendor} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "stdlib.pp"), []byte("class stdlib {}"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	config["modules_paths"] = []string{vendor}
+	config["staging_directory"] = "/tmp/staging"
+	config["deduplicate_uploads"] = true
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	uploads := make([]string, 0)
+	for _, path := range comm.uploads {
+		if strings.HasPrefix(path, "/tmp/staging/modules-") {
+			uploads = append(uploads, path)
+		}
+	}
+
+	sort.Strings(uploads)
+	if !reflect.DeepEqual(uploads, []string{"/tmp/staging/modules-0/stdlib.pp"}) {
+		t.Fatalf("bad: %#v", comm.uploads)
+	}
+
+	copy := "cp -p /tmp/staging/modules-0/stdlib.pp /tmp/staging/modules-1/stdlib.pp"
+	if !strings.Contains(strings.Join(comm.commands, "\n"), copy) {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+}
@@ -0,0 +1,71 @@
+package puppet
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/packer/common"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// DefaultsFileEnvVar is the environment variable naming the file of
+// site-wide defaults, overriding the default location.
+const DefaultsFileEnvVar = "PACKER_PUPPET_DEFAULTS"
+
+// DefaultsFile is the name of the file of site-wide defaults within the
+// packer.d directory of the configuration directory of Packer:
+// ~/.packer.d on Unix-like systems, and %APPDATA%\packer.d on Windows.
+const DefaultsFile = "puppet-provisioner.json"
+
+// configDir returns the configuration directory of Packer. It is a
+// variable so that tests don't depend on the machine running them.
+var configDir = common.ConfigDir
+
+// defaultsPath returns the path of the file of site-wide defaults, and
+// whether it must exist.
+func defaultsPath() (string, bool) {
+	if path := os.Getenv(DefaultsFileEnvVar); path != "" {
+		return path, true
+	}
+
+	dir, err := configDir()
+	if err != nil || dir == "" {
+		return "", false
+	}
+
+	packerDir := ".packer.d"
+	if runtime.GOOS == "windows" {
+		packerDir = "packer.d"
+	}
+
+	return filepath.Join(dir, packerDir, DefaultsFile), false
+}
+
+// readDefaults reads the site-wide defaults, a JSON object of provisioner
+// settings that the settings of the template are applied on top of. It
+// returns nil if there are none.
+func readDefaults() (map[string]interface{}, error) {
+	path, mustExist := defaultsPath()
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !mustExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	log.Printf("Reading Puppet provisioner defaults from %s", path)
+	var defaults map[string]interface{}
+	if err := json.NewDecoder(f).Decode(&defaults); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+
+	return defaults, nil
+}
@@ -0,0 +1,96 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testConfigDir is the configuration directory of Packer the tests run
+// with, instead of the one of the machine running them.
+var testConfigDir string
+
+func init() {
+	var err error
+	testConfigDir, err = ioutil.TempDir("", "packer-puppet-config")
+	if err != nil {
+		panic(err)
+	}
+
+	os.Setenv(DefaultsFileEnvVar, "")
+	configDir = func() (string, error) { return testConfigDir, nil }
+}
+
+func TestProvisionerPrepare_defaultsFile(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	tf, err := ioutil.TempFile("", "packer-puppet-defaults")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf.Write([]byte(`{"install_method": ["gem"], "staging_directory": "/opt/staging", "puppet_server": "puppet.example.com"}`))
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	os.Setenv(DefaultsFileEnvVar, tf.Name())
+	defer os.Setenv(DefaultsFileEnvVar, "")
+
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(p.config.InstallMethod) != 1 || p.config.InstallMethod[0] != "gem" {
+		t.Fatalf("bad: %#v", p.config.InstallMethod)
+	}
+
+	// The settings of the puppet-server provisioner are ignored
+	if p.config.PuppetServer != "" {
+		t.Fatalf("bad: %s", p.config.PuppetServer)
+	}
+
+	if p.config.StagingDir != "/tmp/staging" {
+		t.Fatalf("bad: %s", p.config.StagingDir)
+	}
+
+	// An explicitly configured file must exist
+	os.Setenv(DefaultsFileEnvVar, tf.Name()+"-missing")
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_defaultsConfigDir(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	packerDir := ".packer.d"
+	if runtime.GOOS == "windows" {
+		packerDir = "packer.d"
+	}
+
+	dir := filepath.Join(testConfigDir, packerDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(filepath.Join(dir, DefaultsFile), []byte(`{"staging_directory": "/opt/staging"}`), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.StagingDir != "/opt/staging" {
+		t.Fatalf("bad: %s", p.config.StagingDir)
+	}
+}
@@ -0,0 +1,83 @@
+package puppet
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"strings"
+)
+
+// detectCommand prints the kernel name of the remote machine, followed
+// by its os-release file, if it has one.
+const detectCommand = "sh -c 'uname -s; cat /etc/os-release 2>/dev/null'"
+
+// osInstallMethods are the install methods of the operating systems
+// recognized by the ID and ID_LIKE fields of os-release.
+var osInstallMethods = map[string]string{
+	"debian":    "apt",
+	"ubuntu":    "apt",
+	"rhel":      "yum",
+	"centos":    "yum",
+	"rocky":     "yum",
+	"almalinux": "yum",
+	"suse":      "zypper",
+	"sles":      "zypper",
+	"opensuse":  "zypper",
+	"alpine":    "apk",
+	"arch":      "pacman",
+}
+
+// detectedInstallMethods returns the install methods to try for the
+// remote machine, given the output of detectCommand, or nil if the
+// operating system isn't recognized. The gem method is the fallback.
+func detectedInstallMethods(output string) []string {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	if !scanner.Scan() {
+		return nil
+	}
+
+	switch strings.TrimSpace(scanner.Text()) {
+	case "Darwin":
+		return []string{"dmg"}
+	case "FreeBSD":
+		return []string{"pkg"}
+	}
+
+	ids := make([]string, 0)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, key := range []string{"ID=", "ID_LIKE="} {
+			if strings.HasPrefix(line, key) {
+				value := strings.Trim(line[len(key):], `"'`)
+				ids = append(ids, strings.Fields(value)...)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if method, ok := osInstallMethods[id]; ok {
+			return []string{method, "gem"}
+		}
+	}
+
+	return nil
+}
+
+// detectInstallMethods probes the remote machine and chooses the install
+// methods suited to its operating system.
+func (p *Provisioner) detectInstallMethods(ui packer.Ui, comm packer.Communicator) error {
+	output, status, err := p.remoteCommandOutput(p.inRoot(detectCommand), comm)
+	if err != nil {
+		return fmt.Errorf("Error detecting the operating system: %s", err)
+	}
+
+	methods := detectedInstallMethods(output)
+	if status != 0 || methods == nil {
+		ui.Message("Couldn't detect the operating system, trying the default install methods")
+		return nil
+	}
+
+	ui.Message(fmt.Sprintf("Detected install methods: %s", strings.Join(methods, ", ")))
+	p.config.InstallMethod = methods
+	return nil
+}
@@ -0,0 +1,65 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"strings"
+	"testing"
+)
+
+func TestDetectedInstallMethods(t *testing.T) {
+	cases := []struct {
+		output   string
+		expected string
+	}{
+		{"Linux\nNAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n", "apt,gem"},
+		{"Linux\nID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\n", "yum,gem"},
+		{"Linux\nID=\"opensuse-leap\"\nID_LIKE=\"suse opensuse\"\n", "zypper,gem"},
+		{"Linux\nID=alpine\n", "apk,gem"},
+		{"Linux\nID=arch\n", "pacman,gem"},
+		{"FreeBSD\n", "pkg"},
+		{"Darwin\n", "dmg"},
+		{"Linux\nID=gentoo\n", ""},
+		{"", ""},
+	}
+
+	for _, tc := range cases {
+		actual := strings.Join(detectedInstallMethods(tc.output), ",")
+		if actual != tc.expected {
+			t.Fatalf("%q: %s", tc.output, actual)
+		}
+	}
+}
+
+func TestProvisionerDetectInstallMethods(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !p.config.detectInstallMethod {
+		t.Fatal("should detect install methods")
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "Linux\nID=debian\n"
+	if err := p.detectInstallMethods(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if strings.Join(p.config.InstallMethod, ",") != "apt,gem" {
+		t.Fatalf("bad: %#v", p.config.InstallMethod)
+	}
+
+	config["install_method"] = []string{"gem"}
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.detectInstallMethod {
+		t.Fatal("should not detect configured install methods")
+	}
+}
@@ -0,0 +1,112 @@
+package puppet
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// ElevatedTaskTemplate is the template of the PowerShell script running
+// a batch file as a scheduled task of elevated_user, with the highest
+// privileges, as WinRM sessions often lack the privileges Puppet needs.
+// The script waits for the task to have run, as a task that hasn't
+// started yet is Ready too, prints its output, removes itself, as it
+// holds elevated_password, and exits with the exit code of the task.
+// 267009 and 267011 are the results of a task that is running and of one
+// that hasn't run yet.
+const ElevatedTaskTemplate = `$name = {{quote .TaskName}}
+$log = {{quote .LogPath}}
+$action = New-ScheduledTaskAction -Execute 'cmd.exe' -Argument ('/C "' + {{quote .BatchPath}} + ' > "' + $log + '" 2>&1"')
+$settings = New-ScheduledTaskSettingsSet -AllowStartIfOnBatteries -DontStopIfGoingOnBatteries -ExecutionTimeLimit ([TimeSpan]::Zero)
+Register-ScheduledTask -TaskName $name -Action $action -Settings $settings -User {{quote .User}} -Password {{quote .Password}} -RunLevel Highest -Force | Out-Null
+Start-ScheduledTask -TaskName $name
+do {
+  Start-Sleep -Seconds 1
+  $task = Get-ScheduledTask -TaskName $name
+  $result = (Get-ScheduledTaskInfo -TaskName $name).LastTaskResult
+} while ($task.State -ne 'Ready' -or $result -eq 267009 -or $result -eq 267011)
+Unregister-ScheduledTask -TaskName $name -Confirm:$false
+if (Test-Path $log) {
+  Get-Content $log
+  Remove-Item -Force $log
+}
+Remove-Item -Force {{quote .BatchPath}}, $PSCommandPath
+exit $result
+`
+
+// elevatedTaskFiles are the names of the script, batch file and log of
+// the elevated task within the staging directory.
+var elevatedTaskFiles = []string{
+	"packer-puppet-elevated.ps1",
+	"packer-puppet-elevated.cmd",
+	"packer-puppet-elevated.log",
+}
+
+// ElevatedTaskData is the data the elevated task template is executed
+// with.
+type ElevatedTaskData struct {
+	TaskName  string
+	BatchPath string
+	LogPath   string
+	User      string
+	Password  string
+}
+
+// elevatedTaskCommand uploads command as a batch file into the staging
+// directory, along with the script running it as a scheduled task of
+// elevated_user, and returns the command running that script.
+func (p *Provisioner) elevatedTaskCommand(command string, comm packer.Communicator) (string, error) {
+	join := p.config.guest.Join
+	data := &ElevatedTaskData{
+		TaskName:  "packer-puppet-" + p.config.buildUUID,
+		BatchPath: join(p.config.StagingDir, elevatedTaskFiles[1]),
+		LogPath:   join(p.config.StagingDir, elevatedTaskFiles[2]),
+		User:      p.config.ElevatedUser,
+		Password:  p.config.ElevatedPassword,
+	}
+
+	t, err := template.New("elevated-task").Funcs(template.FuncMap{"quote": powershellQuote}).Parse(ElevatedTaskTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var script bytes.Buffer
+	if err := t.Execute(&script, data); err != nil {
+		return "", err
+	}
+
+	// Percent signs escaped by cmdEscape are doubled instead in a batch
+	// file, where ^% doesn't escape them.
+	command = strings.Replace(command, "^%", "%%", -1)
+	batch := "@echo off\r\n" + command + "\r\nexit /b %ERRORLEVEL%\r\n"
+	if err := p.upload(p.hostPath(data.BatchPath), strings.NewReader(batch), comm); err != nil {
+		return "", err
+	}
+
+	scriptPath := join(p.config.StagingDir, elevatedTaskFiles[0])
+	if err := p.upload(p.hostPath(scriptPath), bytes.NewReader(script.Bytes()), comm); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("powershell -NoProfile -ExecutionPolicy Bypass -File \"%s\"", scriptPath), nil
+}
+
+// removeElevatedTask removes the files uploaded by elevatedTaskCommand
+// once the command has run. The script removes them itself, but not if
+// it fails before, and it holds elevated_password.
+func (p *Provisioner) removeElevatedTask(comm packer.Communicator) {
+	join := p.config.guest.Join
+	paths := make([]string, 0, len(elevatedTaskFiles))
+	for _, name := range elevatedTaskFiles {
+		paths = append(paths, powershellQuote(p.hostPath(join(p.config.StagingDir, name))))
+	}
+
+	command := fmt.Sprintf("powershell -Command \"Remove-Item -Force -ErrorAction SilentlyContinue -Path %s\"",
+		strings.Join(paths, ", "))
+	if err := p.executeCommand(command, comm, 0); err != nil {
+		log.Printf("Error removing the elevated task files: %s", err)
+	}
+}
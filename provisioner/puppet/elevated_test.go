@@ -0,0 +1,79 @@
+package puppet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProvisionerPrepare_elevatedUser(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["elevated_user"] = "Administrator"
+	config["elevated_password"] = "s3cret"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["guest_os_type"] = "windows"
+	delete(config, "elevated_password")
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["elevated_password"] = "s3cret"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerRun_elevatedUser(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["guest_os_type"] = "windows"
+	config["staging_directory"] = "C:\\staging"
+	config["elevated_user"] = "Administrator"
+	config["elevated_password"] = "it's s3cret"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.Run(testUi(), comm, &Stage{ModulePath: "C:\\staging\\modules", Manifest: "C:\\staging\\site.pp"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	batch := comm.uploadData["C:\\staging\\packer-puppet-elevated.cmd"]
+	if !strings.Contains(batch, "puppet\" apply --verbose ") {
+		t.Fatalf("bad: %q", batch)
+	}
+
+	script := comm.uploadData["C:\\staging\\packer-puppet-elevated.ps1"]
+	for _, expected := range []string{
+		"-User 'Administrator' -Password 'it''s s3cret' -RunLevel Highest",
+		"$name = 'packer-puppet-" + p.config.buildUUID + "'",
+		"exit $result",
+		"$result -eq 267011",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Fatalf("missing %s: %s", expected, script)
+		}
+	}
+
+	expected := "powershell -NoProfile -ExecutionPolicy Bypass -File \"C:\\staging\\packer-puppet-elevated.ps1\""
+	if run := comm.commands[len(comm.commands)-2]; run != expected {
+		t.Fatalf("bad: %s", run)
+	}
+
+	// The script holding the password is removed even if the task fails.
+	removal := comm.commands[len(comm.commands)-1]
+	if !strings.HasPrefix(removal, "powershell -Command \"Remove-Item ") ||
+		!strings.Contains(removal, "'C:\\staging\\packer-puppet-elevated.ps1'") {
+		t.Fatalf("bad: %s", removal)
+	}
+}
@@ -0,0 +1,25 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+)
+
+// DefaultENCPath is the remote path the External Node Classifier of
+// enc_path is installed at. It outlives the staging directory, since
+// puppet.conf refers to it.
+const DefaultENCPath = "/etc/puppetlabs/puppet/enc"
+
+// installENC installs the External Node Classifier of enc_path at its
+// remote path and makes it the node terminus of puppet.conf, so that
+// Puppet classifies the node with it.
+func (p *Provisioner) installENC(comm packer.Communicator) error {
+	if err := p.installScript(p.config.ENCPath, "enc", p.config.RemoteENCPath, comm); err != nil {
+		return err
+	}
+
+	if err := p.setPuppetSetting("main", "node_terminus", "exec", comm); err != nil {
+		return err
+	}
+
+	return p.setPuppetSetting("main", "external_nodes", p.config.RemoteENCPath, comm)
+}
@@ -0,0 +1,52 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProvisionerStage_enc(t *testing.T) {
+	script, err := ioutil.TempFile("", "packer-puppet-enc")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(script.Name())
+	script.WriteString("#!/bin/sh\necho 'classes: [base]'\n")
+	script.Close()
+
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["enc_path"] = script.Name()
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.uploadData["/tmp/staging/enc"] != "#!/bin/sh\necho 'classes: [base]'\n" {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	expected := []string{
+		"sudo -E chmod 755 " + DefaultENCPath,
+		"sudo -E puppet config set node_terminus exec --section main",
+		"sudo -E puppet config set external_nodes " + DefaultENCPath + " --section main",
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+}
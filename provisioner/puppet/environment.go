@@ -0,0 +1,86 @@
+package puppet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// EnvironmentConfFile is the name of the settings file of a directory
+// environment.
+const EnvironmentConfFile = "environment.conf"
+
+// environmentConfSettings are the settings allowed in environment.conf.
+var environmentConfSettings = map[string]bool{
+	"config_version":            true,
+	"environment_timeout":       true,
+	"manifest":                  true,
+	"modulepath":                true,
+	"static_catalogs":           true,
+	"rich_data":                 true,
+	"environment_data_provider": true,
+}
+
+// parseEnvironmentConf parses the settings of an environment.conf file.
+// Comments and blank lines are ignored, and so is a leading [main]
+// section header.
+func parseEnvironmentConf(r io.Reader) (map[string]string, error) {
+	settings := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line == "[main]" {
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: expected 'setting = value'", n)
+		}
+
+		key := strings.TrimSpace(line[:idx])
+		settings[key] = strings.TrimSpace(line[idx+1:])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// readEnvironmentConf reads the environment.conf of a local directory
+// environment, which may not exist.
+func readEnvironmentConf(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, EnvironmentConfFile))
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseEnvironmentConf(f)
+}
+
+// renderEnvironmentConf renders settings in the environment.conf format.
+func renderEnvironmentConf(settings map[string]string) string {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var result string
+	for _, k := range keys {
+		result += fmt.Sprintf("%s = %s\n", k, settings[k])
+	}
+
+	return result
+}
@@ -0,0 +1,186 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvironmentConf(t *testing.T) {
+	conf := `
+# Settings of the production environment
+modulepath = site:modules:$basemodulepath
+config_version = scripts/config_version.sh
+`
+
+	settings, err := parseEnvironmentConf(strings.NewReader(conf))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if settings["modulepath"] != "site:modules:$basemodulepath" {
+		t.Fatalf("bad: %#v", settings)
+	}
+
+	if settings["config_version"] != "scripts/config_version.sh" {
+		t.Fatalf("bad: %#v", settings)
+	}
+
+	if _, err := parseEnvironmentConf(strings.NewReader("modulepath")); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestRenderEnvironmentConf(t *testing.T) {
+	actual := renderEnvironmentConf(map[string]string{
+		"modulepath":     "modules",
+		"config_version": "/bin/true",
+	})
+
+	expected := "config_version = /bin/true\nmodulepath = modules\n"
+	if actual != expected {
+		t.Fatalf("bad: %s", actual)
+	}
+}
+
+func TestProvisionerStageEnvironment(t *testing.T) {
+	env, err := ioutil.TempDir("", "packer-puppet-environment")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(env)
+
+	conf := "modulepath = site:modules\n"
+	if err := ioutil.WriteFile(filepath.Join(env, EnvironmentConfFile), []byte(conf), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := map[string]interface{}{
+		"environment_path":  env,
+		"environment_conf":  map[string]interface{}{"config_version": "/bin/true"},
+		"staging_directory": "/tmp/staging",
+	}
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.environmentConf["modulepath"] != "site:modules" {
+		t.Fatalf("bad: %#v", p.config.environmentConf)
+	}
+
+	comm := new(packer.MockCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if stage.EnvironmentPath != "/tmp/staging/environments" {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	if stage.Manifest != "/tmp/staging/environments/production/manifests" {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	if comm.UploadPath != "/tmp/staging/environments/production/environment.conf" {
+		t.Fatalf("bad: %s", comm.UploadPath)
+	}
+
+	if comm.UploadData != "config_version = /bin/true\nmodulepath = site:modules\n" {
+		t.Fatalf("bad: %s", comm.UploadData)
+	}
+
+	if err := p.Run(testUi(), comm, stage); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "sudo -E env FACTER_packer_build_uuid=" + p.config.buildUUID +
+		" puppet apply --verbose --environmentpath=/tmp/staging/environments " +
+		"--environment=production /tmp/staging/environments/production/manifests"
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerStageEnvironment_configVersion(t *testing.T) {
+	env, err := ioutil.TempDir("", "packer-puppet-environment")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(env)
+
+	conf := "config_version = scripts/config_version.sh\n"
+	if err := ioutil.WriteFile(filepath.Join(env, EnvironmentConfFile), []byte(conf), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := map[string]interface{}{
+		"environment_path":  env,
+		"staging_directory": "/tmp/staging",
+	}
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "abc123\n"
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "sudo -E sh -c 'cd \"$1\" && eval \"$2\"' sh /tmp/staging/environments/production scripts/config_version.sh"
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	if stage.ConfigVersion != "abc123" {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	// A configured version takes precedence over the command
+	config["config_version"] = "v1.2.3"
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm = new(packer.MockCommunicator)
+	stage, err = p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if strings.Contains(comm.StartCmd.Command, "config_version.sh") {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	if stage.ConfigVersion != "" {
+		t.Fatalf("bad: %#v", stage)
+	}
+}
+
+func TestProvisionerPrepare_environmentConflicts(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["environment_path"] = config["module_path"]
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	delete(config, "environment_path")
+	config["environment_conf"] = map[string]interface{}{"modulepath": "modules"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,225 @@
+package puppet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// StructuredFactsFile is the name of the file of structured_facts, in the
+// staging directory and then in facts_directory.
+const StructuredFactsFile = "packer_structured_facts.json"
+
+// FactTypeCommand is the type of the facts whose value is the output of a
+// command run on the machine running Packer.
+const FactTypeCommand = "command"
+
+// factNameRegexp matches the valid names of facts.
+var factNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// parseFacts parses the facter setting into the facts that are given as
+// is and the commands of the facts that are the output of a command.
+func parseFacts(facter map[string]interface{}) (map[string]string, map[string]string, []error) {
+	var errs []error
+	facts := make(map[string]string)
+	commands := make(map[string]string)
+	for name, value := range facter {
+		if !factNameRegexp.MatchString(name) {
+			errs = append(errs, fmt.Errorf("facter: bad fact name '%s'", name))
+			continue
+		}
+
+		spec, ok := value.(map[string]interface{})
+		if !ok {
+			facts[name] = fmt.Sprint(value)
+			continue
+		}
+
+		command, _ := spec["command"].(string)
+		if spec["type"] != FactTypeCommand || command == "" {
+			errs = append(errs, fmt.Errorf(
+				"facter: fact %s must be a value or have type \"%s\" and a command", name, FactTypeCommand))
+			continue
+		}
+
+		commands[name] = command
+	}
+
+	return facts, commands, errs
+}
+
+// localFactOutput runs the command of a fact on the machine running
+// Packer and returns its output, without surrounding whitespace.
+func localFactOutput(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.Printf("Running fact command: %s", command)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// facts returns the facts given to the Puppet run: the build metadata of
+// Packer, so that manifests can branch on the builder for instance, and
+// the facts of the facter setting, running the commands of those that
+// are the output of a command.
+func (p *Provisioner) facts() (map[string]string, error) {
+	facts := map[string]string{"packer_build_uuid": p.config.buildUUID}
+	if p.config.PackerBuildName != "" {
+		facts["packer_build_name"] = p.config.PackerBuildName
+	}
+
+	if p.config.PackerBuilderType != "" {
+		facts["packer_builder_type"] = p.config.PackerBuilderType
+	}
+
+	for name, value := range p.config.facts {
+		facts[name] = value
+	}
+
+	for name, command := range p.config.factCommands {
+		output, err := localFactOutput(command)
+		if err != nil {
+			return nil, fmt.Errorf("Error running the command of fact %s: %s", name, err)
+		}
+
+		facts[name] = output
+		for _, sensitive := range p.config.SensitiveFacts {
+			if sensitive == name {
+				p.config.secrets = append(p.config.secrets, output)
+			}
+		}
+	}
+
+	return facts, nil
+}
+
+// factStrings returns the strings within the value of a structured fact,
+// which are masked when it is one of sensitive_facts.
+func factStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case map[string]interface{}:
+		var strs []string
+		for _, elem := range v {
+			strs = append(strs, factStrings(elem)...)
+		}
+		return strs
+	case []interface{}:
+		var strs []string
+		for _, elem := range v {
+			strs = append(strs, factStrings(elem)...)
+		}
+		return strs
+	}
+
+	return nil
+}
+
+// facterVars renders facts as the FACTER_ environment variables that
+// prefix the Puppet run: an env command on unix guests, and SET commands
+// of cmd on Windows guests. The SET commands are escaped rather than
+// quoted, as cmd has no way to escape a quote within quotes, and end
+// right before the & so that no trailing space ends up in the values.
+func (p *Provisioner) facterVars(facts map[string]string) string {
+	if len(facts) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(facts))
+	for name := range facts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]string, len(names))
+	for i, name := range names {
+		if p.config.guest == guestOSTypes[GuestOSTypeUnix] {
+			vars[i] = fmt.Sprintf("FACTER_%s=%s", name, shellQuote(facts[name]))
+		} else {
+			vars[i] = fmt.Sprintf("SET %s& ", cmdEscape("FACTER_"+name+"="+facts[name]))
+		}
+	}
+
+	if p.config.guest == guestOSTypes[GuestOSTypeUnix] {
+		return fmt.Sprintf("env %s ", strings.Join(vars, " "))
+	}
+
+	return strings.Join(vars, "")
+}
+
+// stageStructuredFacts uploads structured_facts as a JSON file into the
+// staging directory, then copies it into facts_directory with elevated
+// privileges, as it usually lives outside of the reach of the connecting
+// user.
+func (p *Provisioner) stageStructuredFacts(comm packer.Communicator) error {
+	data, err := json.MarshalIndent(p.config.StructuredFacts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	staged := p.config.guest.Join(p.config.StagingDir, StructuredFactsFile)
+	if err := p.upload(p.hostPath(staged), bytes.NewReader(data), comm); err != nil {
+		return err
+	}
+
+	factsDir := p.hostPath(p.config.FactsDir)
+	for _, command := range []string{
+		p.config.guest.MkdirCommand(factsDir),
+		p.config.guest.CopyCommand(p.hostPath(staged), p.config.guest.Join(factsDir, StructuredFactsFile)),
+	} {
+		command, err := p.elevateWith(p.config.RunSudo, "", command)
+		if err != nil {
+			return err
+		}
+
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeStructuredFacts removes the file of structured_facts from
+// facts_directory.
+func (p *Provisioner) removeStructuredFacts(comm packer.Communicator) error {
+	path := p.hostPath(p.config.guest.Join(p.config.FactsDir, StructuredFactsFile))
+	command, err := p.elevateWith(p.config.RunSudo, "", p.config.guest.RemoveDirCommand(path))
+	if err != nil {
+		return err
+	}
+
+	return p.executeCommand(command, comm, 0)
+}
@@ -0,0 +1,212 @@
+package puppet
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewUUID(t *testing.T) {
+	uuid, err := newUUID()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid) {
+		t.Fatalf("bad: %s", uuid)
+	}
+}
+
+func TestProvisionerFacterVars(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["packer_build_name"] = "web"
+	config["packer_builder_type"] = "amazon-ebs"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "env FACTER_packer_build_name=web FACTER_packer_build_uuid=" + p.config.buildUUID +
+		" FACTER_packer_builder_type=amazon-ebs "
+	facts, err := p.facts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if vars := p.facterVars(facts); vars != expected {
+		t.Fatalf("bad: %s", vars)
+	}
+
+	config["guest_os_type"] = GuestOSTypeWindows
+	config["packer_build_name"] = `web & del "C:\x"`
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected = `SET FACTER_packer_build_name=web ^& del ^"C:\x^"& SET FACTER_packer_build_uuid=` + p.config.buildUUID +
+		`& SET FACTER_packer_builder_type=amazon-ebs& `
+	facts, err = p.facts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if vars := p.facterVars(facts); vars != expected {
+		t.Fatalf("bad: %s", vars)
+	}
+}
+
+func TestProvisionerRun_sensitiveFacts(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["facter"] = map[string]interface{}{
+		"role":      "web",
+		"api_token": "hunter2",
+		"revision":  map[string]interface{}{"type": "command", "command": "echo abc123"},
+	}
+	config["structured_facts"] = map[string]interface{}{
+		"db": map[string]interface{}{"users": []interface{}{"admin"}, "password": "s3cret"},
+	}
+	config["sensitive_facts"] = []string{"api_token", "missing"}
+	config["audit_log"] = "/var/log/packer-puppet-audit.log"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["sensitive_facts"] = []string{"api_token", "revision", "db"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.Run(testUi(), comm, &Stage{ModulePath: "/tmp/modules", Manifest: "/tmp/site.pp"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	logged := p.auditEntries[len(p.auditEntries)-1]
+	if strings.Contains(logged, "hunter2") || strings.Contains(logged, "abc123") ||
+		!strings.Contains(logged, "FACTER_api_token=<sensitive> ") ||
+		!strings.Contains(logged, "FACTER_revision=<sensitive> ") ||
+		!strings.Contains(logged, "FACTER_role=web ") {
+		t.Fatalf("bad: %s", logged)
+	}
+
+	if p.redact(`{"password":"s3cret"}`) != `{"password":"<sensitive>"}` {
+		t.Fatal("structured fact should be redacted")
+	}
+}
+
+func TestProvisionerRun_windowsQuoting(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["guest_os_type"] = GuestOSTypeWindows
+	config["skip_install"] = true
+	config["certname"] = "web&calc"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage := &Stage{ModulePath: `C:\staging\modules & more`, Manifest: `C:\staging\site.pp`}
+	if err := p.Run(testUi(), comm, stage); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := ` apply --verbose --certname=^"web^&calc^" --modulepath=^"C:\staging\modules ^& more^" ^"C:\staging\site.pp^"`
+	if run := comm.commands[len(comm.commands)-1]; !strings.HasSuffix(run, expected) {
+		t.Fatalf("bad: %s", run)
+	}
+}
+
+func TestProvisionerFacts_command(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["facter"] = map[string]interface{}{
+		"role":     "web",
+		"revision": map[string]interface{}{"type": "command"},
+	}
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["facter"] = map[string]interface{}{
+		"role":     "web",
+		"revision": map[string]interface{}{"type": "command", "command": "echo abc123"},
+	}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	facts, err := p.facts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if facts["role"] != "web" || facts["revision"] != "abc123" {
+		t.Fatalf("bad: %#v", facts)
+	}
+
+	p.config.factCommands["revision"] = "exit 1"
+	if _, err := p.facts(); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerStage_structuredFacts(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["structured_facts"] = map[string]interface{}{
+		"app": map[string]interface{}{"ports": []interface{}{80, 443}},
+	}
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ran := func(command string) bool {
+		for _, c := range comm.commands {
+			if c == command {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	data := comm.uploadData["/tmp/staging/"+StructuredFactsFile]
+	if !strings.Contains(data, `"ports": [`) {
+		t.Fatalf("bad: %s", data)
+	}
+
+	copied := "sudo -E cp -p /tmp/staging/" + StructuredFactsFile +
+		" /etc/puppetlabs/facter/facts.d/" + StructuredFactsFile
+	if !ran(copied) {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	if err := p.Cleanup(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	removed := "sudo -E rm -rf /etc/puppetlabs/facter/facts.d/" + StructuredFactsFile
+	if !ran(removed) {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+}
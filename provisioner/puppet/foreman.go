@@ -0,0 +1,87 @@
+package puppet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// foremanHostName returns the name the build machine is registered with
+// in Foreman: node_name_value, or else its certname, so that Foreman
+// classifies it as the node the catalog is compiled for.
+func (p *Provisioner) foremanHostName(comm packer.Communicator) (string, error) {
+	if p.config.NodeNameValue != "" {
+		return p.config.NodeNameValue, nil
+	}
+
+	return p.certname(comm)
+}
+
+// foremanRequest sends a request to the hosts API of foreman_url,
+// authenticated with foreman_username and foreman_password, and trusting
+// the CA certificate of foreman_ca_cert_path.
+func (p *Provisioner) foremanRequest(method string, path string, body interface{}) error {
+	client, err := p.httpClient(p.config.ForemanCACertPath, "", "")
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if body != nil {
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	endpoint := strings.TrimRight(p.config.ForemanURL, "/") + path
+	log.Printf("Foreman API request: %s %s", method, endpoint)
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.SetBasicAuth(p.config.ForemanUsername, p.config.ForemanPassword)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Bad response to %s %s: %s: %s",
+			method, endpoint, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// registerForemanHost registers the build machine as an unmanaged host
+// of Foreman, with the attributes of foreman_host_attributes, so that
+// Foreman can classify it as an ENC during the run.
+func (p *Provisioner) registerForemanHost(name string) error {
+	host := map[string]interface{}{"managed": false}
+	for k, v := range p.config.ForemanHostAttributes {
+		host[k] = v
+	}
+	host["name"] = name
+
+	return p.foremanRequest("POST", "/api/hosts", map[string]interface{}{"host": host})
+}
+
+// deleteForemanHost deletes the host of the build machine from Foreman.
+func (p *Provisioner) deleteForemanHost(name string) error {
+	return p.foremanRequest("DELETE", "/api/hosts/"+url.PathEscape(name), nil)
+}
@@ -0,0 +1,138 @@
+package puppet
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestProvisionerPrepare_foreman(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["foreman_username"] = "admin"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["foreman_url"] = "https://foreman.example.com"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["foreman_password"] = "s3cret"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["foreman_ca_cert_path"] = "/i/dont/exist"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerForemanHost_caCert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ca, err := ioutil.TempFile("", "packer-puppet-foreman-ca")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	ca.Close()
+
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["foreman_url"] = server.URL
+	config["foreman_username"] = "admin"
+	config["foreman_password"] = "s3cret"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.registerForemanHost("build.example.com"); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["foreman_ca_cert_path"] = ca.Name()
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.registerForemanHost("build.example.com"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerForemanHost(t *testing.T) {
+	var requests []string
+	var host map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "POST" {
+			var body map[string]map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			host = body["host"]
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	config := testAgentConfig(t)
+	config["node_name_value"] = "webserver.prod.example.com"
+	config["foreman_url"] = server.URL + "/"
+	config["foreman_username"] = "admin"
+	config["foreman_password"] = "s3cret"
+	config["foreman_host_attributes"] = map[string]interface{}{"hostgroup_id": 3}
+	var p Provisioner
+	if err := p.PrepareAgent(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	name, err := p.foremanHostName(new(agentCommunicator))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.registerForemanHost(name); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if host["name"] != "webserver.prod.example.com" || host["managed"] != false || host["hostgroup_id"] != float64(3) {
+		t.Fatalf("bad: %#v", host)
+	}
+
+	if err := p.deleteForemanHost(name); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{"POST /api/hosts", "DELETE /api/hosts/webserver.prod.example.com"}
+	if len(requests) != len(expected) || requests[0] != expected[0] || requests[1] != expected[1] {
+		t.Fatalf("bad: %#v", requests)
+	}
+
+	p.config.ForemanPassword = "wrong"
+	if err := p.deleteForemanHost(name); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,103 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"strings"
+)
+
+// DefaultGPGKeyserver is the keyserver the GPG key is fetched from when
+// gpg_key_path isn't set.
+const DefaultGPGKeyserver = "hkps://keyserver.ubuntu.com"
+
+// GPGKeyFile is the name of the verified GPG key, exported in ASCII
+// armor, in the remote staging directory.
+const GPGKeyFile = "puppet-gpg-key.asc"
+
+// rpmSignatureCheck is the shell snippet importing the verified GPG key
+// into the rpm database and checking that the package at %[1]s is signed
+// with it. Like the other snippets, it is used within a single-quoted
+// sh -c script, so the staging paths are quoted as in innerPackage.
+const rpmSignatureCheck = "{{if .GPGKey}}rpm --import '{{quote (quote .GPGKey)}}' && " +
+	"rpm -Kv %[1]s | grep -qi \"signature, key id {{.GPGKeyID}}: ok\" && {{end}}"
+
+// rpmReleaseInstall is the shell snippet installing the release package
+// at the URL %[1]s. With a GPG key configured, the package is downloaded
+// and its signature checked first.
+var rpmReleaseInstall = "{{if .GPGKey}}curl -fsSL -o /tmp/puppet-release.rpm %[1]s && " +
+	fmt.Sprintf(rpmSignatureCheck, "/tmp/puppet-release.rpm") +
+	"rpm -Uvh /tmp/puppet-release.rpm && rm -f /tmp/puppet-release.rpm{{else}}rpm -Uvh %[1]s{{end}}"
+
+// aptKeyringCheck is the shell snippet checking that a keyring of the
+// apt release package at /tmp/puppet-release.deb holds the verified GPG
+// key, so that apt only trusts the repositories signed with it. The
+// package is extracted without being installed, so that it is checked
+// before dpkg runs its maintainer scripts.
+const aptKeyringCheck = "{{if .GPGKey}}rm -rf /tmp/puppet-release && " +
+	"dpkg-deb -x /tmp/puppet-release.deb /tmp/puppet-release && " +
+	"for k in $(find /tmp/puppet-release -name \"*.gpg\"); do " +
+	"gpg --batch --homedir '{{quote (quote .GPGHome)}}' --no-default-keyring --keyring $k " +
+	"--fingerprint {{.GPGFingerprint}} >/dev/null 2>&1 && found=1; done; " +
+	"rm -rf /tmp/puppet-release; [ -n \"$found\" ] && {{end}}"
+
+// normalizeFingerprint returns a GPG key fingerprint without spaces and
+// in upper case, and whether it is a valid fingerprint.
+func normalizeFingerprint(fingerprint string) (string, bool) {
+	fingerprint = strings.ToUpper(strings.Replace(fingerprint, " ", "", -1))
+	if len(fingerprint) != 40 {
+		return fingerprint, false
+	}
+
+	for _, c := range fingerprint {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return fingerprint, false
+		}
+	}
+
+	return fingerprint, true
+}
+
+// importGPGKey imports the GPG key from gpg_key_path, or from the
+// keyserver, into a keyring in the staging directory, and exports it
+// there for the install commands. It fails unless the key has the
+// configured fingerprint.
+func (p *Provisioner) importGPGKey(ui packer.Ui, comm packer.Communicator) error {
+	if err := p.ensurePrerequisite(ui, "gpg", comm); err != nil {
+		return err
+	}
+
+	home := shellQuote(p.config.guest.Join(p.config.StagingDir, "gnupg"))
+	gpg := fmt.Sprintf("gpg --batch --homedir %s", home)
+	fingerprint := p.config.GPGKeyFingerprint
+
+	var source, fetch string
+	if p.config.GPGKeyPath != "" {
+		ui.Message(fmt.Sprintf("Uploading GPG key: %s", p.config.GPGKeyPath))
+		remotePath, err := p.uploadToStaging(p.config.GPGKeyPath, comm)
+		if err != nil {
+			return fmt.Errorf("Error uploading GPG key: %s", err)
+		}
+
+		source = p.config.GPGKeyPath
+		fetch = fmt.Sprintf("%s --import %s", gpg, shellQuote(remotePath))
+	} else {
+		source = p.config.GPGKeyserver
+		fetch = fmt.Sprintf("%s --keyserver %s --recv-keys %s", gpg, shellQuote(p.config.GPGKeyserver), fingerprint)
+	}
+
+	script := fmt.Sprintf("mkdir -p %[1]s && chmod 700 %[1]s && %[2]s && "+
+		"%[3]s --fingerprint %[4]s && %[3]s --armor --export %[4]s > %[5]s",
+		home, fetch, gpg, fingerprint, shellQuote(p.config.guest.Join(p.config.StagingDir, GPGKeyFile)))
+	command := "sh -c " + shellQuote(script)
+	command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(p.withProxy(command)))
+	if err != nil {
+		return err
+	}
+
+	ui.Message(fmt.Sprintf("Importing GPG key %s from %s", fingerprint, source))
+	if err := p.executeInstallCommand(ui, command, comm); err != nil {
+		return fmt.Errorf("GPG key %s couldn't be imported from %s: %s", fingerprint, source, err)
+	}
+
+	return nil
+}
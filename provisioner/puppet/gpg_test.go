@@ -0,0 +1,136 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFingerprint(t *testing.T) {
+	fingerprint, ok := normalizeFingerprint("d681 1ed3 adee b844 1af5  aa8f 4528 b6cd 9e61 ef26")
+	if !ok || fingerprint != "D6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26" {
+		t.Fatalf("bad: %s", fingerprint)
+	}
+
+	for _, bad := range []string{"9E61EF26", "Z6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26"} {
+		if _, ok := normalizeFingerprint(bad); ok {
+			t.Fatalf("should be invalid: %s", bad)
+		}
+	}
+}
+
+func TestProvisionerPrepare_gpgKey(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["gpg_key_path"] = filepath.Join(config["manifest_path"].(string), "puppet.asc")
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["gpg_key_fingerprint"] = "D6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	if err := ioutil.WriteFile(config["gpg_key_path"].(string), []byte("key"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The default install methods aren't verified with the key
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["install_method"] = []string{"yum"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerInstall_gpgKey(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["install_method"] = []string{"yum"}
+	config["gpg_key_fingerprint"] = "d681 1ed3 adee b844 1af5 aa8f 4528 b6cd 9e61 ef26"
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ui := testUi()
+	comm := new(packer.MockCommunicator)
+	if err := p.importGPGKey(ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, expected := range []string{
+		"--keyserver hkps://keyserver.ubuntu.com --recv-keys D6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26",
+		"--fingerprint D6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26",
+		"> " + RemoteStagingPath + "/" + GPGKeyFile,
+	} {
+		if !strings.Contains(comm.StartCmd.Command, expected) {
+			t.Fatalf("bad: %s", comm.StartCmd.Command)
+		}
+	}
+
+	if err := p.Install(ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, expected := range []string{
+		"rpm --import '" + RemoteStagingPath + "/" + GPGKeyFile + "'",
+		"rpm -Kv /tmp/puppet-release.rpm | grep -qi \"signature, key id 9E61EF26: ok\"",
+	} {
+		if !strings.Contains(comm.StartCmd.Command, expected) {
+			t.Fatalf("bad: %s", comm.StartCmd.Command)
+		}
+	}
+}
+
+func TestProvisionerInstall_gpgKeyBeforeInstall(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["gpg_key_fingerprint"] = "D6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26"
+	config["install_method"] = []string{"apt"}
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if err := p.Install(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	command := comm.StartCmd.Command
+	check := strings.Index(command, "dpkg-deb -x /tmp/puppet-release.deb")
+	install := strings.Index(command, "dpkg -i /tmp/puppet-release.deb")
+	if check < 0 || install < 0 || check > install || !strings.Contains(command, "--fingerprint D6811ED3ADEEB8441AF5AA8F4528B6CD9E61EF26") {
+		t.Fatalf("bad: %s", command)
+	}
+
+	config["install_method"] = []string{"zypper"}
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.Install(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	command = comm.StartCmd.Command
+	if strings.Contains(command, "--gpg-auto-import-keys") ||
+		!strings.Contains(command, "rpm --import '"+RemoteStagingPath+"/"+GPGKeyFile+"'") {
+		t.Fatalf("bad: %s", command)
+	}
+}
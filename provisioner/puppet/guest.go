@@ -0,0 +1,313 @@
+package puppet
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Supported values of guest_os_type.
+const (
+	GuestOSTypeUnix    = "unix"
+	GuestOSTypeWindows = "windows"
+)
+
+// guestOS holds the path and command conventions of a family of guest
+// operating systems.
+type guestOS struct {
+	// Separator between the elements of a remote path.
+	Separator string
+
+	// Separator between the paths of a list, such as the module path.
+	PathListSeparator string
+
+	// Default remote staging directory.
+	StagingDir string
+
+	// Directory containing the puppet executable, or empty if puppet is
+	// expected to be on the PATH.
+	PuppetBinDir string
+
+	// Directory of the external facts of Facter.
+	FactsDir string
+
+	// Quote quotes a string as a single word of a command line, so that
+	// remote paths with spaces or special characters are passed as is.
+	// The path arguments of the command formats below are quoted with it.
+	Quote func(string) string
+
+	// ArgQuote quotes a string as a single argument of a program run by
+	// the command interpreter of the guest, for the quote function of the
+	// execute command templates, which aren't run by PowerShell on
+	// Windows.
+	ArgQuote func(string) string
+
+	// Format of the command that creates a directory and its parents.
+	Mkdir string
+
+	// Format of the command that removes a directory recursively.
+	RemoveDir string
+
+	// Formats of the commands that change the mode and the owner of a
+	// path, given the mode or owner and then the path. Empty if the guest
+	// doesn't support it.
+	Chmod string
+	Chown string
+
+	// Format of the command that stops a service and prevents it from
+	// starting on boot, given the name of the service.
+	DisableService string
+
+	// Format of the command that runs a command with the given directory
+	// as its root directory. Empty if the guest doesn't support it.
+	Chroot string
+
+	// Format of the command that copies the contents of a directory into
+	// another existing directory.
+	CopyContents string
+
+	// Format of the command that copies a file, given the source and then
+	// the destination.
+	Copy string
+
+	// Format of the command that moves a file, given the source and then
+	// the destination.
+	Move string
+
+	// Format of the command that runs a command from the given working
+	// directory, given the directory and then the command, both quoted.
+	Chdir string
+
+	// Format of the path of an executable as used in a command line.
+	Executable string
+
+	// Format of the command that checks the files of a directory against
+	// a file of SHA256 checksums in the format of sha256sum, given the
+	// directory and then the checksums file. Empty if the guest doesn't
+	// support it.
+	VerifyChecksums string
+
+	// Format of the command that creates a symbolic link, given its
+	// target and then its path. Empty if the guest doesn't support it.
+	Symlink string
+
+	// Format of the command that extracts a tar archive into a directory,
+	// preserving the modes of the files, and removes the archive, given
+	// the archive, the directory and then the tar option decompressing
+	// the archive. Empty if the guest doesn't support it.
+	Extract string
+
+	// Format of the command that extracts a tar archive read from its
+	// standard input into a directory, given the directory and then the
+	// tar option decompressing the archive. Empty if the guest doesn't
+	// support it.
+	StreamExtract string
+
+	// Command that exits zero if the tools extracting gzipped tar
+	// archives are available.
+	ArchiveCheck string
+
+	// Default templates of the commands.
+	ExecuteCommand            string
+	EnvironmentExecuteCommand string
+	AgentExecuteCommand       string
+	ElevatedCommand           string
+	PasswordElevatedCommand   string
+	InstallVerifyCommand      string
+
+	// Template of the elevated command used when sudo isn't available.
+	// Empty if the guest has no such fallback.
+	SuElevatedCommand string
+}
+
+const unixDisableServiceCommand = "sh -c '" +
+	"if command -v systemctl >/dev/null 2>&1; then " +
+	"systemctl stop %[1]s; systemctl disable %[1]s; " +
+	"else service %[1]s stop; " +
+	"update-rc.d %[1]s disable || chkconfig %[1]s off; fi'"
+
+const unixVerifyChecksumsCommand = "sh -c 'cd \"$1\" && " +
+	"if command -v sha256sum >/dev/null 2>&1; then sha256sum -c --quiet \"$2\"; " +
+	"else shasum -a 256 -c \"$2\"; fi' sh %s %s"
+
+// windowsExtractCommand extracts archives with the tar of Windows, which
+// ships with it since Windows 10 1803 and Windows Server 2019.
+const windowsExtractCommand = "powershell -Command \"" +
+	"New-Item -ItemType Directory -Force -Path %[2]s | Out-Null; " +
+	"tar %[3]s-xf %[1]s -C %[2]s; if ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }; " +
+	"Remove-Item -Force -Path %[1]s\""
+
+var guestOSTypes = map[string]*guestOS{
+	GuestOSTypeUnix: &guestOS{
+		Separator:                 "/",
+		PathListSeparator:         ":",
+		StagingDir:                RemoteStagingPath,
+		PuppetBinDir:              "",
+		FactsDir:                  "/etc/puppetlabs/facter/facts.d",
+		Quote:                     shellQuote,
+		ArgQuote:                  shellQuote,
+		Mkdir:                     "mkdir -p %s",
+		RemoveDir:                 "rm -rf %s",
+		Chmod:                     "chmod %s %s",
+		Chown:                     "chown %s %s",
+		CopyContents:              "cp -R %s/. %s",
+		Copy:                      "cp -p %s %s",
+		Move:                      "mv -f %s %s",
+		Chdir:                     "sh -c 'cd \"$1\" && eval \"$2\"' sh %s %s",
+		Executable:                "%s",
+		Symlink:                   "ln -sfn %s %s",
+		VerifyChecksums:           unixVerifyChecksumsCommand,
+		Extract:                   "sh -c 'mkdir -p \"$2\" && tar %[3]s-xpf \"$1\" -C \"$2\" && rm -f \"$1\"' sh %[1]s %[2]s",
+		StreamExtract:             "sh -c 'mkdir -p \"$1\" && tar %[2]s-xpf - -C \"$1\"' sh %[1]s",
+		ArchiveCheck:              prerequisites["tar"].Check,
+		Chroot:                    "chroot %s %s",
+		DisableService:            unixDisableServiceCommand,
+		ExecuteCommand:            DefaultExecuteCommand,
+		EnvironmentExecuteCommand: DefaultEnvironmentExecuteCommand,
+		AgentExecuteCommand:       DefaultAgentExecuteCommand,
+		ElevatedCommand:           DefaultElevatedCommand,
+		PasswordElevatedCommand:   DefaultPasswordElevatedCommand,
+		InstallVerifyCommand:      DefaultInstallVerifyCommand,
+		SuElevatedCommand:         DefaultSuElevatedCommand,
+	},
+	GuestOSTypeWindows: &guestOS{
+		Separator:                 "\\",
+		PathListSeparator:         ";",
+		StagingDir:                "C:\\Windows\\Temp\\packer-puppet",
+		PuppetBinDir:              "C:\\Program Files\\Puppet Labs\\Puppet\\bin",
+		FactsDir:                  "C:\\ProgramData\\PuppetLabs\\facter\\facts.d",
+		Quote:                     powershellQuote,
+		ArgQuote:                  cmdQuote,
+		Mkdir:                     "powershell -Command \"New-Item -ItemType Directory -Force -Path %s\"",
+		DisableService:            "powershell -Command \"Stop-Service -Name %[1]s; Set-Service -Name %[1]s -StartupType Disabled\"",
+		RemoveDir:                 "powershell -Command \"Remove-Item -Recurse -Force -Path %s\"",
+		CopyContents:              "powershell -Command \"Copy-Item -Recurse -Force -Path (Join-Path %s '*') -Destination %s\"",
+		Copy:                      "powershell -Command \"Copy-Item -Force -Path %s -Destination %s\"",
+		Move:                      "powershell -Command \"Move-Item -Force -Path %s -Destination %s\"",
+		Chdir:                     "powershell -Command \"Set-Location %s; Invoke-Expression %s\"",
+		Executable:                "\"%s\"",
+		Extract:                   windowsExtractCommand,
+		ArchiveCheck:              "where tar",
+		ExecuteCommand:            "{{.FacterVars}}\"{{.PuppetBinDir}}\\puppet\" apply --verbose {{if .Certname}}--certname={{quote .Certname}} {{end}}{{if .NodeNameValue}}--node_name_value={{quote .NodeNameValue}} {{end}}{{if .HieraConfigPath}}--hiera_config={{quote .HieraConfigPath}} {{end}}--modulepath={{quote .Modulepath}} {{quote .Manifest}}",
+		EnvironmentExecuteCommand: "{{.FacterVars}}\"{{.PuppetBinDir}}\\puppet\" apply --verbose {{if .Certname}}--certname={{quote .Certname}} {{end}}{{if .NodeNameValue}}--node_name_value={{quote .NodeNameValue}} {{end}}{{if .HieraConfigPath}}--hiera_config={{quote .HieraConfigPath}} {{end}}--environmentpath={{quote .EnvironmentPath}} --environment={{quote .Environment}} {{quote .Manifest}}",
+		AgentExecuteCommand:       "{{.FacterVars}}\"{{.PuppetBinDir}}\\puppet\" agent --onetime --no-daemonize --detailed-exitcodes --verbose {{if .Certname}}--certname={{quote .Certname}} {{end}}{{if .NodeNameValue}}--node_name_value={{quote .NodeNameValue}} {{end}}--server={{quote .PuppetServer}}{{if .PuppetServerPort}} --{{.ServerPortSetting}}={{.PuppetServerPort}}{{end}}{{if .Environment}} --environment={{quote .Environment}}{{end}}{{if .WaitForCert}} --waitforcert={{.WaitForCert}}{{end}}",
+		ElevatedCommand:           "{{.Command}}",
+		PasswordElevatedCommand:   "{{.Command}}",
+		InstallVerifyCommand:      "\"{{.PuppetBinDir}}\\puppet\" --version",
+	},
+}
+
+// Join joins path elements using the separator of the guest. Local path
+// elements, which may use either separator, are converted as well.
+func (g *guestOS) Join(elem ...string) string {
+	parts := make([]string, 0, len(elem))
+	for _, e := range elem {
+		e = strings.Replace(filepath.ToSlash(e), "\\", "/", -1)
+		e = strings.Replace(e, "/", g.Separator, -1)
+		if len(parts) > 0 {
+			e = strings.TrimLeft(e, g.Separator)
+		}
+
+		if e != "" && e != "." {
+			parts = append(parts, strings.TrimRight(e, g.Separator))
+		}
+	}
+
+	return strings.Join(parts, g.Separator)
+}
+
+// quoteAll quotes each of the given strings with Quote.
+func (g *guestOS) quoteAll(s []string) []string {
+	quoted := make([]string, len(s))
+	for i, v := range s {
+		quoted[i] = g.Quote(v)
+	}
+
+	return quoted
+}
+
+// ChmodCommand returns the command changing the mode of remote paths.
+func (g *guestOS) ChmodCommand(mode string, paths ...string) string {
+	return fmt.Sprintf(g.Chmod, mode, strings.Join(g.quoteAll(paths), " "))
+}
+
+// ChownCommand returns the command changing the owner of a remote path.
+func (g *guestOS) ChownCommand(owner string, path string) string {
+	return fmt.Sprintf(g.Chown, g.Quote(owner), g.Quote(path))
+}
+
+// ChrootCommand returns the command running command within root. The
+// command is run as is by chroot, so it isn't quoted.
+func (g *guestOS) ChrootCommand(root string, command string) string {
+	return fmt.Sprintf(g.Chroot, g.Quote(root), command)
+}
+
+// CopyContentsCommand returns the command copying the contents of the
+// remote directory src into the remote directory dst.
+func (g *guestOS) CopyContentsCommand(src string, dst string) string {
+	return fmt.Sprintf(g.CopyContents, g.Quote(src), g.Quote(dst))
+}
+
+// CopyCommand returns the command copying the remote file src to dst.
+func (g *guestOS) CopyCommand(src string, dst string) string {
+	return fmt.Sprintf(g.Copy, g.Quote(src), g.Quote(dst))
+}
+
+// MoveCommand returns the command moving the remote file src to dst.
+func (g *guestOS) MoveCommand(src string, dst string) string {
+	return fmt.Sprintf(g.Move, g.Quote(src), g.Quote(dst))
+}
+
+// ChdirCommand returns the command running command from the remote
+// directory dir.
+func (g *guestOS) ChdirCommand(dir string, command string) string {
+	return fmt.Sprintf(g.Chdir, g.Quote(dir), g.Quote(command))
+}
+
+// ExecutablePath returns the path of the named executable within dir,
+// which may be empty, as used in a command line.
+func (g *guestOS) ExecutablePath(dir string, name string) string {
+	return fmt.Sprintf(g.Executable, g.Join(dir, name))
+}
+
+// ExtractCommand returns the command extracting the remote archive into
+// the remote directory dir, decompressing it with the given tar option.
+func (g *guestOS) ExtractCommand(archive string, dir string, tarOption string) string {
+	return fmt.Sprintf(g.Extract, g.Quote(archive), g.Quote(dir), tarOption)
+}
+
+// StreamExtractCommand returns the command extracting the archive read
+// from its standard input into the remote directory dir, decompressing
+// it with the given tar option.
+func (g *guestOS) StreamExtractCommand(dir string, tarOption string) string {
+	return fmt.Sprintf(g.StreamExtract, g.Quote(dir), tarOption)
+}
+
+// VerifyChecksumsCommand returns the command checking the files of the
+// remote directory dir against the remote checksums file.
+func (g *guestOS) VerifyChecksumsCommand(dir string, checksums string) string {
+	return fmt.Sprintf(g.VerifyChecksums, g.Quote(dir), g.Quote(checksums))
+}
+
+// SymlinkCommand returns the command creating a remote symbolic link at
+// path pointing to target.
+func (g *guestOS) SymlinkCommand(target string, path string) string {
+	return fmt.Sprintf(g.Symlink, g.Quote(target), g.Quote(path))
+}
+
+// RemoveDirCommand returns the command removing the given remote
+// directory and everything beneath it.
+func (g *guestOS) RemoveDirCommand(path string) string {
+	return fmt.Sprintf(g.RemoveDir, g.Quote(path))
+}
+
+// DisableServiceCommand returns the command stopping and disabling the
+// given service.
+func (g *guestOS) DisableServiceCommand(name string) string {
+	return fmt.Sprintf(g.DisableService, name)
+}
+
+// MkdirCommand returns the command creating the given remote directory.
+func (g *guestOS) MkdirCommand(path string) string {
+	return fmt.Sprintf(g.Mkdir, g.Quote(path))
+}
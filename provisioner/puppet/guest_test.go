@@ -0,0 +1,68 @@
+package puppet
+
+import (
+	"testing"
+)
+
+func TestGuestOSJoin(t *testing.T) {
+	cases := []struct {
+		guest    string
+		elem     []string
+		expected string
+	}{
+		{GuestOSTypeUnix, []string{"/tmp/staging", "manifests", "site.pp"}, "/tmp/staging/manifests/site.pp"},
+		{GuestOSTypeUnix, []string{"/tmp/staging/", ".", "modules/"}, "/tmp/staging/modules"},
+		{GuestOSTypeWindows, []string{"C:\\staging", "manifests/site.pp"}, "C:\\staging\\manifests\\site.pp"},
+	}
+
+	for _, tc := range cases {
+		actual := guestOSTypes[tc.guest].Join(tc.elem...)
+		if actual != tc.expected {
+			t.Fatalf("%s %#v: %s", tc.guest, tc.elem, actual)
+		}
+	}
+}
+
+func TestGuestOSQuote(t *testing.T) {
+	cases := []struct {
+		guest    string
+		command  string
+		expected string
+	}{
+		{GuestOSTypeUnix, guestOSTypes[GuestOSTypeUnix].MkdirCommand("/tmp/staging"), "mkdir -p /tmp/staging"},
+		{GuestOSTypeUnix, guestOSTypes[GuestOSTypeUnix].MkdirCommand("/tmp/my staging"), "mkdir -p '/tmp/my staging'"},
+		{GuestOSTypeUnix, guestOSTypes[GuestOSTypeUnix].RemoveDirCommand("/tmp/it's $HOME"), `rm -rf '/tmp/it'"'"'s $HOME'`},
+		{GuestOSTypeUnix, guestOSTypes[GuestOSTypeUnix].ChmodCommand("755", "/tmp/a b", "/tmp/c"), "chmod 755 '/tmp/a b' /tmp/c"},
+		{GuestOSTypeWindows, guestOSTypes[GuestOSTypeWindows].MkdirCommand("C:\\it's"),
+			"powershell -Command \"New-Item -ItemType Directory -Force -Path 'C:\\it''s'\""},
+		{GuestOSTypeWindows, guestOSTypes[GuestOSTypeWindows].ExtractCommand("C:\\staging\\modules.tar.gz", "C:\\staging\\modules", "-z "),
+			"powershell -Command \"New-Item -ItemType Directory -Force -Path 'C:\\staging\\modules' | Out-Null; " +
+				"tar -z -xf 'C:\\staging\\modules.tar.gz' -C 'C:\\staging\\modules'; if ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }; " +
+				"Remove-Item -Force -Path 'C:\\staging\\modules.tar.gz'\""},
+	}
+
+	for _, tc := range cases {
+		if tc.command != tc.expected {
+			t.Fatalf("%s: %s", tc.guest, tc.command)
+		}
+	}
+}
+
+func TestGuestOSArgQuote(t *testing.T) {
+	cases := []struct {
+		guest    string
+		arg      string
+		expected string
+	}{
+		{GuestOSTypeUnix, "/tmp/my staging", "'/tmp/my staging'"},
+		{GuestOSTypeWindows, `C:\staging\site.pp`, `^"C:\staging\site.pp^"`},
+		{GuestOSTypeWindows, `C:\my staging\`, `^"C:\my staging\\^"`},
+		{GuestOSTypeWindows, `a&b|c %PATH% "d"`, `^"a^&b^|c ^%PATH^% \^"d\^"^"`},
+	}
+
+	for _, tc := range cases {
+		if actual := guestOSTypes[tc.guest].ArgQuote(tc.arg); actual != tc.expected {
+			t.Fatalf("%s %s: %s", tc.guest, tc.arg, actual)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package puppet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"os"
+	"strings"
+)
+
+// Names of the generated Hiera configuration, of the directory of the
+// Hiera data and of the data file of hiera_overrides within the remote
+// staging directory.
+const (
+	HieraConfigFile    = "hiera.yaml"
+	HieraDataDir       = "hieradata"
+	HieraOverridesFile = "packer_overrides.yaml"
+)
+
+// DefaultEyamlKeysDir is the name of the directory of the eyaml keys
+// within the remote staging directory, and EyamlPrivateKeyFile and
+// EyamlPublicKeyFile are the names of the keys within it.
+const (
+	DefaultEyamlKeysDir = "eyaml"
+	EyamlPrivateKeyFile = "private_key.pkcs7.pem"
+	EyamlPublicKeyFile  = "public_key.pkcs7.pem"
+)
+
+// DefaultHieraHierarchy is the hierarchy used when hiera_data_path is set
+// without hiera_hierarchy.
+var DefaultHieraHierarchy = []HieraLevel{
+	HieraLevel{Name: "Common data", Path: "common.yaml"},
+}
+
+// HieraLevel is a level of the hierarchy of the generated hiera.yaml.
+// Path, or Paths for several files, are relative to the uploaded Hiera
+// data, or to the remote Datadir if set, and may interpolate facts, such
+// as "nodes/%{trusted.certname}.yaml".
+type HieraLevel struct {
+	Name    string
+	Path    string
+	Paths   []string
+	Datadir string
+}
+
+// yamlString quotes s as a YAML scalar. JSON strings are valid YAML.
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// eyamlKeys are the remote paths of the keys of hiera-eyaml.
+type eyamlKeys struct {
+	private string
+	public  string
+}
+
+// renderHieraConfig renders a Hiera 5 configuration whose hierarchy of
+// YAML files lives in the remote directory datadir. With eyaml keys, the
+// files are read with the eyaml backend, which decrypts their encrypted
+// values.
+func renderHieraConfig(datadir string, hierarchy []HieraLevel, eyaml *eyamlKeys) []byte {
+	var config bytes.Buffer
+	config.WriteString("---\nversion: 5\ndefaults:\n")
+	if datadir != "" {
+		fmt.Fprintf(&config, "  datadir: %s\n", yamlString(datadir))
+	}
+	if eyaml != nil {
+		config.WriteString("  lookup_key: eyaml_lookup_key\n  options:\n")
+		fmt.Fprintf(&config, "    pkcs7_private_key: %s\n", yamlString(eyaml.private))
+		fmt.Fprintf(&config, "    pkcs7_public_key: %s\n", yamlString(eyaml.public))
+	} else {
+		config.WriteString("  data_hash: yaml_data\n")
+	}
+	config.WriteString("hierarchy:\n")
+
+	for _, level := range hierarchy {
+		fmt.Fprintf(&config, "  - name: %s\n", yamlString(level.Name))
+		if level.Datadir != "" {
+			fmt.Fprintf(&config, "    datadir: %s\n", yamlString(level.Datadir))
+		}
+
+		if level.Path != "" {
+			fmt.Fprintf(&config, "    path: %s\n", yamlString(level.Path))
+		}
+
+		if len(level.Paths) > 0 {
+			config.WriteString("    paths:\n")
+			for _, path := range level.Paths {
+				fmt.Fprintf(&config, "      - %s\n", yamlString(path))
+			}
+		}
+	}
+
+	return config.Bytes()
+}
+
+// stageHiera uploads the Hiera data and the data of hiera_overrides, if
+// any, along with a hiera.yaml generated from hiera_hierarchy. It returns
+// the remote path of the Hiera configuration, or "" if there is none.
+func (p *Provisioner) stageHiera(ui packer.Ui, comm packer.Communicator) (string, error) {
+	if len(p.config.HieraDataPaths) == 0 && len(p.config.HieraOverrides) == 0 {
+		return "", nil
+	}
+
+	var hierarchy []HieraLevel
+	if len(p.config.HieraOverrides) > 0 {
+		overrides, err := json.MarshalIndent(p.config.HieraOverrides, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("Error rendering hiera_overrides: %s", err)
+		}
+
+		// The overrides are JSON, which is valid YAML, and take
+		// precedence over every level of the hierarchy.
+		remotePath := p.config.guest.Join(p.config.StagingDir, HieraOverridesFile)
+		if err := p.upload(p.hostPath(remotePath), bytes.NewReader(overrides), comm); err != nil {
+			return "", fmt.Errorf("Error uploading Hiera overrides: %s", err)
+		}
+
+		hierarchy = append(hierarchy, HieraLevel{
+			Name:    "Packer overrides",
+			Path:    HieraOverridesFile,
+			Datadir: p.config.StagingDir,
+		})
+	}
+
+	// The first data directory is the default of the levels, and the
+	// levels of the later ones are repeated with their own directory and
+	// a name qualified by it, as names must be unique. Levels with their
+	// own datadir aren't repeated.
+	var datadir string
+	for i, path := range p.config.HieraDataPaths {
+		ui.Say(fmt.Sprintf("Copying Hiera data: %s", path))
+		remoteDir := p.config.guest.Join(p.config.StagingDir, HieraDataDir)
+		if i > 0 {
+			remoteDir = fmt.Sprintf("%s-%d", remoteDir, i)
+		}
+
+		if err := p.uploadLocalDirectory(path, p.hostPath(remoteDir), comm); err != nil {
+			return "", fmt.Errorf("Error uploading Hiera data: %s", err)
+		}
+
+		if i == 0 {
+			datadir = remoteDir
+			hierarchy = append(hierarchy, p.config.HieraHierarchy...)
+			continue
+		}
+
+		for _, level := range p.config.HieraHierarchy {
+			if level.Datadir != "" {
+				continue
+			}
+
+			level.Name = fmt.Sprintf("%s (%s)", level.Name, path)
+			level.Datadir = remoteDir
+			hierarchy = append(hierarchy, level)
+		}
+	}
+
+	var eyaml *eyamlKeys
+	if p.config.EyamlPrivateKeyPath != "" {
+		var err error
+		if eyaml, err = p.uploadEyamlKeys(comm); err != nil {
+			return "", fmt.Errorf("Error uploading eyaml keys: %s", err)
+		}
+	}
+
+	remotePath := p.config.guest.Join(p.config.StagingDir, HieraConfigFile)
+	config := renderHieraConfig(datadir, hierarchy, eyaml)
+	if err := p.upload(p.hostPath(remotePath), bytes.NewReader(config), comm); err != nil {
+		return "", fmt.Errorf("Error uploading Hiera configuration: %s", err)
+	}
+
+	return remotePath, nil
+}
+
+// uploadEyamlKeys uploads the eyaml keys into eyaml_keys_directory and
+// makes them readable only by the user Puppet runs as. The keys are
+// removed again by Cleanup.
+func (p *Provisioner) uploadEyamlKeys(comm packer.Communicator) (*eyamlKeys, error) {
+	dir := p.config.EyamlKeysDir
+	if err := p.createRemoteDirectory(p.hostPath(dir), comm); err != nil {
+		return nil, err
+	}
+
+	if err := p.executeCommand(p.config.guest.ChmodCommand("700", p.hostPath(dir)), comm, 0); err != nil {
+		return nil, err
+	}
+
+	keys := &eyamlKeys{
+		private: p.config.guest.Join(dir, EyamlPrivateKeyFile),
+		public:  p.config.guest.Join(dir, EyamlPublicKeyFile),
+	}
+
+	for local, remote := range map[string]string{
+		p.config.EyamlPrivateKeyPath: keys.private,
+		p.config.EyamlPublicKeyPath:  keys.public,
+	} {
+		f, err := os.Open(local)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.upload(p.hostPath(remote), f, comm)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.executeCommand(p.config.guest.ChmodCommand("600", p.hostPath(remote)), comm, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.config.RunSudo && p.config.guest.Chown != "" {
+		owner := p.config.RunAsUser
+		if owner == "" {
+			owner = "0:0"
+		}
+
+		// Owners are resolved within the image, not the build machine.
+		for _, path := range []string{dir, keys.private, keys.public} {
+			command, err := p.elevateWith(true, "", p.inRoot(p.config.guest.ChownCommand(owner, path)))
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.executeCommand(command, comm, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// hieraLookupCommand returns the command looking up a Hiera key with the
+// Hiera configuration and modules of the stage, and the facts given to
+// the Puppet run as rendered by facterVars.
+func (p *Provisioner) hieraLookupCommand(key string, stage *Stage, facterVars string) string {
+	quote := p.config.guest.ArgQuote
+	args := []string{"lookup"}
+	if p.config.NodeNameValue != "" {
+		args = append(args, "--node="+quote(p.config.NodeNameValue))
+	} else if p.config.Certname != "" {
+		args = append(args, "--node="+quote(p.config.Certname))
+	}
+
+	if stage.HieraConfigPath != "" {
+		args = append(args, "--hiera_config="+quote(stage.HieraConfigPath))
+	}
+
+	if stage.EnvironmentPath != "" {
+		args = append(args,
+			"--environmentpath="+quote(stage.EnvironmentPath),
+			"--environment="+quote(p.config.Environment))
+	} else if stage.ModulePath != "" {
+		args = append(args, "--modulepath="+quote(stage.ModulePath))
+	}
+
+	puppet := p.config.guest.ExecutablePath(p.config.PuppetBinDir, "puppet")
+	return fmt.Sprintf("%s%s %s %s", facterVars, puppet, strings.Join(args, " "), quote(key))
+}
+
+// checkHieraKeys looks up each of required_hiera_keys, as Puppet is run,
+// and fails listing the keys that can't be resolved.
+func (p *Provisioner) checkHieraKeys(ui packer.Ui, comm packer.Communicator, stage *Stage) error {
+	ui.Say("Checking required Hiera keys")
+	facts, err := p.facts()
+	if err != nil {
+		return err
+	}
+
+	facterVars := p.facterVars(facts)
+	var missing []string
+	for _, key := range p.config.RequiredHieraKeys {
+		command, err := p.elevateWith(p.config.RunSudo, p.config.RunAsUser, p.inRoot(p.hieraLookupCommand(key, stage, facterVars)))
+		if err != nil {
+			return err
+		}
+
+		status, err := p.remoteCommandStatus(command, comm)
+		if err != nil {
+			return fmt.Errorf("Error looking up Hiera key %s: %s", key, err)
+		}
+
+		if status != 0 {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Required Hiera keys can't be resolved: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
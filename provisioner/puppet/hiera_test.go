@@ -0,0 +1,305 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderHieraConfig(t *testing.T) {
+	config := renderHieraConfig("/tmp/staging/hieradata", []HieraLevel{
+		HieraLevel{Name: "Per-node data", Path: "nodes/%{trusted.certname}.yaml"},
+		HieraLevel{Name: "Roles", Paths: []string{"roles/%{facts.role}.yaml", "common.yaml"}},
+	}, nil)
+
+	expected := `---
+version: 5
+defaults:
+  datadir: "/tmp/staging/hieradata"
+  data_hash: yaml_data
+hierarchy:
+  - name: "Per-node data"
+    path: "nodes/%{trusted.certname}.yaml"
+  - name: "Roles"
+    paths:
+      - "roles/%{facts.role}.yaml"
+      - "common.yaml"
+`
+	if string(config) != expected {
+		t.Fatalf("bad: %s", config)
+	}
+}
+
+func TestProvisionerStage_hiera(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["hiera_hierarchy"] = []map[string]interface{}{{"name": "Common", "path": "common.yaml"}}
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	data, err := ioutil.TempDir("", "packer-puppet-hieradata")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(data)
+
+	config["hiera_data_path"] = data
+	config["hiera_hierarchy"] = []map[string]interface{}{{"name": "Common"}}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["hiera_hierarchy"] = []map[string]interface{}{{"name": "Common", "path": "common.yaml"}}
+	config["staging_directory"] = "/tmp/staging"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if stage.HieraConfigPath != "/tmp/staging/"+HieraConfigFile {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	if !strings.Contains(comm.uploadData[stage.HieraConfigPath], `datadir: "/tmp/staging/hieradata"`) {
+		t.Fatalf("bad: %s", comm.uploadData[stage.HieraConfigPath])
+	}
+
+	if err := p.Run(testUi(), comm, stage); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	run := comm.commands[len(comm.commands)-1]
+	if !strings.Contains(run, "puppet apply --verbose --hiera_config=/tmp/staging/hiera.yaml --modulepath=") {
+		t.Fatalf("bad: %s", run)
+	}
+}
+
+func TestProvisionerStage_eyaml(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	data, err := ioutil.TempDir("", "packer-puppet-hieradata")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(data)
+
+	for _, name := range []string{EyamlPrivateKeyFile, EyamlPublicKeyFile} {
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(name), 0600); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	config["eyaml_private_key_path"] = filepath.Join(data, EyamlPrivateKeyFile)
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["eyaml_public_key_path"] = filepath.Join(data, EyamlPublicKeyFile)
+	config["hiera_data_path"] = data
+	config["staging_directory"] = "/tmp/staging"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	private := "/tmp/staging/eyaml/" + EyamlPrivateKeyFile
+	if comm.uploadData[private] != EyamlPrivateKeyFile {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	chmodded, chowned := false, false
+	for _, command := range comm.commands {
+		if command == "chmod 600 "+private {
+			chmodded = true
+		}
+		if command == "sudo -E chown 0:0 "+private {
+			chowned = true
+		}
+	}
+	if !chmodded || !chowned {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	hiera := comm.uploadData[stage.HieraConfigPath]
+	if !strings.Contains(hiera, "lookup_key: eyaml_lookup_key") ||
+		!strings.Contains(hiera, `pkcs7_private_key: "`+private+`"`) {
+		t.Fatalf("bad: %s", hiera)
+	}
+
+	// The keys are removed even though the staging directory is kept.
+	p.config.CleanStagingDir = false
+	comm = new(recordingCommunicator)
+	if err := p.Cleanup(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	removed := false
+	for _, command := range comm.commands {
+		if command == "sudo -E rm -rf /tmp/staging/eyaml" {
+			removed = true
+		}
+	}
+	if !removed {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+}
+
+func TestProvisionerStage_hieraOverrides(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["hiera_overrides"] = map[string]interface{}{
+		"profile::app::version": "1.2.3",
+		"profile::app::flags":   map[string]interface{}{"beta": true},
+	}
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	overrides := comm.uploadData["/tmp/staging/"+HieraOverridesFile]
+	if !strings.Contains(overrides, `"profile::app::version": "1.2.3"`) ||
+		!strings.Contains(overrides, `"beta": true`) {
+		t.Fatalf("bad: %s", overrides)
+	}
+
+	expected := `---
+version: 5
+defaults:
+  data_hash: yaml_data
+hierarchy:
+  - name: "Packer overrides"
+    datadir: "/tmp/staging"
+    path: "packer_overrides.yaml"
+`
+	if comm.uploadData[stage.HieraConfigPath] != expected {
+		t.Fatalf("bad: %s", comm.uploadData[stage.HieraConfigPath])
+	}
+}
+
+func TestProvisionerStage_hieraDataPaths(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var paths []string
+	for i := 0; i < 2; i++ {
+		data, err := ioutil.TempDir("", "packer-puppet-hieradata")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(data)
+
+		paths = append(paths, data)
+	}
+
+	config["hiera_data_paths"] = paths
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `---
+version: 5
+defaults:
+  datadir: "/tmp/staging/hieradata"
+  data_hash: yaml_data
+hierarchy:
+  - name: "Common data"
+    path: "common.yaml"
+  - name: "Common data (` + paths[1] + `)"
+    datadir: "/tmp/staging/hieradata-1"
+    path: "common.yaml"
+`
+	if comm.uploadData[stage.HieraConfigPath] != expected {
+		t.Fatalf("bad: %s", comm.uploadData[stage.HieraConfigPath])
+	}
+}
+
+type missingKeyCommunicator struct {
+	recordingCommunicator
+}
+
+func (c *missingKeyCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.StartExitStatus = 0
+	if strings.Contains(rc.Command, "puppet lookup") && strings.Contains(rc.Command, "missing") {
+		c.StartExitStatus = 1
+	}
+
+	return c.recordingCommunicator.Start(rc)
+}
+
+func TestProvisionerRun_requiredHieraKeys(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["required_hiera_keys"] = []string{"profile::app::version", "profile::missing"}
+	config["puppet_bin_dir"] = "/opt/puppetlabs/bin"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(missingKeyCommunicator)
+	stage := &Stage{
+		ModulePath:      "/tmp/staging/modules-0",
+		Manifest:        "/tmp/staging/site.pp",
+		HieraConfigPath: "/tmp/staging/hiera.yaml",
+	}
+
+	err := p.Run(testUi(), comm, stage)
+	if err == nil || !strings.Contains(err.Error(), "can't be resolved: profile::missing") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	lookup := comm.commands[0]
+	if !strings.Contains(lookup, "puppet lookup --hiera_config=/tmp/staging/hiera.yaml --modulepath=/tmp/staging/modules-0 ") {
+		t.Fatalf("bad: %s", lookup)
+	}
+
+	// Keys are looked up with the facts and puppet of the Puppet run.
+	if !strings.HasPrefix(lookup, "sudo -E env FACTER_packer_build_uuid=") ||
+		!strings.Contains(lookup, " /opt/puppetlabs/bin/puppet lookup ") {
+		t.Fatalf("bad: %s", lookup)
+	}
+
+	for _, command := range comm.commands {
+		if strings.Contains(command, "puppet apply") {
+			t.Fatalf("should not run: %s", command)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package puppet
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFiles are the names of the files at the root of an uploaded
+// directory listing, with the syntax of .gitignore, the paths that
+// aren't uploaded.
+var IgnoreFiles = []string{".packerignore", ".pupignore"}
+
+// ignoreRule is a pattern of an ignore file.
+type ignoreRule struct {
+	pattern *regexp.Regexp
+
+	// Negate is true if the pattern re-includes the paths it matches.
+	negate bool
+
+	// DirOnly is true if the pattern only matches directories.
+	dirOnly bool
+}
+
+// ignoreRules are the patterns of the ignore files of a directory, in
+// order.
+type ignoreRules []ignoreRule
+
+// readIgnoreRules reads the ignore files at the root of localDir. It
+// returns nil if there are none.
+func readIgnoreRules(localDir string) (ignoreRules, error) {
+	var rules ignoreRules
+	for _, name := range IgnoreFiles {
+		f, err := os.Open(filepath.Join(localDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The ignore files themselves aren't uploaded
+		rules = append(rules, parseIgnorePattern("/"+name))
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			rules = append(rules, parseIgnorePattern(line))
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// parseIgnorePattern parses a pattern with the syntax of .gitignore.
+func parseIgnorePattern(pattern string) ignoreRule {
+	var rule ignoreRule
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	// Patterns with a slash are relative to the root, others match at
+	// any depth.
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := ""
+	if !anchored {
+		expr = "(.*/)?"
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr += ".*"
+			i++
+		case pattern[i] == '*':
+			expr += "[^/]*"
+		case pattern[i] == '?':
+			expr += "[^/]"
+		default:
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+
+	rule.pattern = regexp.MustCompile("^" + expr + "$")
+	return rule
+}
+
+// Ignored returns whether the path relative to the root of the
+// directory, with slash separators, is ignored. The last matching
+// pattern wins.
+func (r ignoreRules) Ignored(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.pattern.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
@@ -0,0 +1,78 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	var rules ignoreRules
+	for _, pattern := range []string{"*.swp", "spec/", "/Gemfile", "ntp/files/**/*.bin", "!keep.swp"} {
+		rules = append(rules, parseIgnorePattern(pattern))
+	}
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"init.pp.swp", false, true},
+		{"ntp/manifests/init.pp.swp", false, true},
+		{"ntp/manifests/keep.swp", false, false},
+		{"ntp/spec", true, true},
+		{"ntp/spec", false, false},
+		{"Gemfile", false, true},
+		{"ntp/Gemfile", false, false},
+		{"ntp/files/a/b/firmware.bin", false, true},
+		{"ntp/files/firmware.bin", false, true},
+		{"apache/files/firmware.bin", false, false},
+		{"ntp/manifests/init.pp", false, false},
+	}
+
+	for _, tc := range cases {
+		if rules.Ignored(tc.path, tc.isDir) != tc.ignored {
+			t.Fatalf("bad: %s %v", tc.path, tc.isDir)
+		}
+	}
+}
+
+func TestProvisionerUploadLocalDirectory_ignoreFile(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	modules := config["module_path"].(string)
+	if err := os.MkdirAll(filepath.Join(modules, "ntp", "spec"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := map[string]string{
+		".packerignore":         "# Tests\nspec/\n",
+		"ntp/init.pp":           "class ntp {}",
+		"ntp/spec/init_spec.rb": "describe 'ntp'",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(modules, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.uploadLocalDirectory(modules, "/tmp/staging/modules-0", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sort.Strings(comm.uploads)
+	expected := []string{"/tmp/staging/modules-0/ntp/init.pp"}
+	if !reflect.DeepEqual(comm.uploads, expected) {
+		t.Fatalf("bad: %#v", comm.uploads)
+	}
+}
@@ -0,0 +1,192 @@
+package puppet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// symlinkChecksumPrefix prefixes the target of a recreated symbolic
+// link, which stands for its checksum in the manifest.
+const symlinkChecksumPrefix = "symlink:"
+
+// UploadManifestSuffix is appended to the remote path of a directory to
+// name the manifest of the checksums of the files uploaded into it.
+const UploadManifestSuffix = ".manifest.json"
+
+// checksumDirectory returns the SHA256 checksums of the files within
+// localDir, but for the ignored ones, by their slash separated path
+// relative to it.
+func (p *Provisioner) checksumDirectory(localDir string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := p.walkLocalDirectory(localDir, func(path string, relPath string, f os.FileInfo) error {
+		if f.IsDir() {
+			return nil
+		}
+
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			sums[filepath.ToSlash(relPath)] = symlinkChecksumPrefix + target
+			return err
+		}
+
+		sum, err := checksumFile(path)
+		sums[filepath.ToSlash(relPath)] = sum
+		return err
+	})
+
+	return sums, err
+}
+
+// ChecksumsSuffix is appended to the remote path of a directory to name
+// the file of the checksums its uploaded files are verified against.
+const ChecksumsSuffix = ".sha256"
+
+// verifyUpload checks on the remote machine that the files uploaded
+// from localDir into remoteDir have the same checksums as the local
+// files.
+func (p *Provisioner) verifyUpload(localDir string, remoteDir string, comm packer.Communicator) error {
+	sums, err := p.checksumDirectory(localDir)
+	if err != nil {
+		return fmt.Errorf("Error computing checksums of %s: %s", localDir, err)
+	}
+
+	paths := make([]string, 0, len(sums))
+	for relPath, sum := range sums {
+		if !strings.HasPrefix(sum, symlinkChecksumPrefix) {
+			paths = append(paths, relPath)
+		}
+	}
+	sort.Strings(paths)
+
+	var checksums bytes.Buffer
+	for _, relPath := range paths {
+		fmt.Fprintf(&checksums, "%s  %s\n", sums[relPath], relPath)
+	}
+
+	checksumsPath := remoteDir + ChecksumsSuffix
+	if err := p.upload(checksumsPath, bytes.NewReader(checksums.Bytes()), comm); err != nil {
+		return fmt.Errorf("Error uploading checksums: %s", err)
+	}
+
+	log.Printf("Verifying the checksums of %d files uploaded to %s", len(paths), remoteDir)
+	command := p.config.guest.VerifyChecksumsCommand(remoteDir, checksumsPath)
+	if err := p.executeCommand(command, comm, 0); err != nil {
+		return fmt.Errorf("Files uploaded to %s don't match their checksums: %s", remoteDir, err)
+	}
+
+	return nil
+}
+
+// checksumFile returns the SHA256 checksum of a local file.
+func checksumFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadIncremental uploads the files of localDir that changed since the
+// last upload into remoteDir, as recorded by the manifest kept next to
+// it, and removes the files that no longer exist locally.
+func (p *Provisioner) uploadIncremental(localDir string, remoteDir string, comm packer.Communicator) error {
+	local, err := p.checksumDirectory(localDir)
+	if err != nil {
+		return fmt.Errorf("Error computing checksums of %s: %s", localDir, err)
+	}
+
+	manifestPath := remoteDir + UploadManifestSuffix
+	remote := make(map[string]string)
+	var manifest bytes.Buffer
+	if err := comm.Download(manifestPath, &manifest); err != nil || json.Unmarshal(manifest.Bytes(), &remote) != nil {
+		log.Printf("No upload manifest at %s, uploading all files", manifestPath)
+		remote = make(map[string]string)
+	}
+
+	changed := make([]string, 0)
+	for relPath, sum := range local {
+		if remote[relPath] != sum {
+			changed = append(changed, relPath)
+		}
+	}
+	sort.Strings(changed)
+
+	removed := make([]string, 0)
+	for relPath := range remote {
+		if _, ok := local[relPath]; !ok {
+			removed = append(removed, relPath)
+		}
+	}
+	sort.Strings(removed)
+
+	p.ui.Message(fmt.Sprintf("Uploading %d changed files out of %d", len(changed), len(local)))
+
+	dirs := map[string]bool{remoteDir: true}
+	if err := p.createRemoteDirectory(remoteDir, comm); err != nil {
+		return err
+	}
+
+	uploads := make([]fileUpload, 0, len(changed))
+	links := make([]fileUpload, 0)
+	for _, relPath := range changed {
+		remotePath := p.config.guest.Join(remoteDir, relPath)
+		if dir := p.config.guest.Join(remoteDir, filepath.Dir(relPath)); !dirs[dir] {
+			dirs[dir] = true
+			if err := p.createRemoteDirectory(dir, comm); err != nil {
+				return err
+			}
+		}
+
+		upload := fileUpload{filepath.Join(localDir, relPath), remotePath}
+		if strings.HasPrefix(local[relPath], symlinkChecksumPrefix) {
+			links = append(links, upload)
+		} else {
+			uploads = append(uploads, upload)
+		}
+	}
+
+	if err := p.uploadConcurrently(uploads, comm); err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if err := p.recreateSymlink(link, comm); err != nil {
+			return err
+		}
+	}
+
+	for _, relPath := range removed {
+		command := p.config.guest.RemoveDirCommand(p.config.guest.Join(remoteDir, relPath))
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return fmt.Errorf("Error removing %s: %s", relPath, err)
+		}
+	}
+
+	data, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+
+	if err := p.upload(manifestPath, bytes.NewReader(data), comm); err != nil {
+		return fmt.Errorf("Error uploading manifest: %s", err)
+	}
+
+	return nil
+}
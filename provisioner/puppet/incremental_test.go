@@ -0,0 +1,109 @@
+package puppet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerUploadIncremental(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["incremental_upload"] = true
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.ui = testUi()
+
+	modules := config["module_path"].(string)
+	for name, contents := range map[string]string{"same.pp": "same", "changed.pp": "new"} {
+		if err := ioutil.WriteFile(filepath.Join(modules, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	sums, err := p.checksumDirectory(modules)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	comm.DownloadData = `{"same.pp": "` + sums["same.pp"] + `", "changed.pp": "old", "removed.pp": "gone"}`
+	if err := p.uploadLocalDirectory(modules, "/tmp/staging/modules-0", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.DownloadPath != "/tmp/staging/modules-0"+UploadManifestSuffix {
+		t.Fatalf("bad: %s", comm.DownloadPath)
+	}
+
+	sort.Strings(comm.uploads)
+	expected := []string{"/tmp/staging/modules-0.manifest.json", "/tmp/staging/modules-0/changed.pp"}
+	if !reflect.DeepEqual(comm.uploads, expected) {
+		t.Fatalf("bad: %#v", comm.uploads)
+	}
+
+	if comm.StartCmd.Command != "rm -rf /tmp/staging/modules-0/removed.pp" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	config["upload_archive"] = true
+	var bad Provisioner
+	if err := bad.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerVerifyUpload(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	localDir := config["module_path"].(string)
+	if err := ioutil.WriteFile(filepath.Join(localDir, "init.pp"), []byte("class foo {}"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["verify_uploads"] = true
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if err := p.verifyUpload(localDir, "/tmp/staging/modules", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.UploadPath != "/tmp/staging/modules.sha256" {
+		t.Fatalf("bad: %s", comm.UploadPath)
+	}
+
+	sum := sha256.Sum256([]byte("class foo {}"))
+	expected := hex.EncodeToString(sum[:]) + "  init.pp\n"
+	if comm.UploadData != expected {
+		t.Fatalf("bad: %q", comm.UploadData)
+	}
+
+	if !strings.HasSuffix(comm.StartCmd.Command, " sh /tmp/staging/modules /tmp/staging/modules.sha256") {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	comm.StartExitStatus = 1
+	if err := p.verifyUpload(localDir, "/tmp/staging/modules", comm); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["guest_os_type"] = "windows"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
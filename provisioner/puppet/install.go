@@ -0,0 +1,871 @@
+package puppet
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// installMethod describes one way of installing Puppet on the remote
+// machine.
+type installMethod struct {
+	// Check is a command that must exit zero for the method to be usable
+	// on the remote machine.
+	Check string
+
+	// Reason explains why the method is skipped when Check fails.
+	Reason string
+
+	// Install is the template of the command that installs Puppet. It is
+	// run through the elevated command.
+	Install string
+
+	// Uninstall is the template of the command that removes what
+	// Install installed. Empty if the method can't remove Puppet.
+	Uninstall string
+
+	// BinDir is the directory the method installs the puppet binary
+	// into, if it isn't on the default PATH. It is used when
+	// puppet_bin_dir isn't set.
+	BinDir string
+
+	// Gem is true if the method runs gem, and so honors the gem
+	// settings.
+	Gem bool
+
+	// Collection is true if the method installs the configured Puppet
+	// collection.
+	Collection bool
+
+	// Windows is true if the method installs Puppet on Windows guests
+	// rather than on unix ones.
+	Windows bool
+
+	// GPG is true if the method verifies what it installs with the
+	// configured GPG key.
+	GPG bool
+
+	// Unversioned is true if the method can only install the current
+	// version of Puppet, and so can't honor version.
+	Unversioned bool
+}
+
+type InstallTemplate struct {
+	Version        string
+	FacterVersion  string
+	Package        string
+	TrustPolicy    string
+	Release        string
+	AptRepository  string
+	YumRepository  string
+	FreeBSDPackage string
+	MacRepository  string
+	MSIRepository  string
+	Proxy          string
+	Gem            string
+	GemFlags       string
+	GemNoDocument  bool
+	ScriptArgs     string
+	GPGKey         string
+	GPGHome        string
+	GPGFingerprint string
+	GPGKeyID       string
+}
+
+// gemDocumentFlags are the flags of gem install that skip generating
+// documentation. RubyGems 2 and later replaced --no-ri and --no-rdoc
+// with --no-document.
+const gemDocumentFlags = "{{if .GemNoDocument}}--no-document{{else}}--no-ri --no-rdoc{{end}}"
+
+// gemTrustPolicies are the security policies gem install accepts.
+var gemTrustPolicies = map[string]bool{
+	"NoSecurity":       true,
+	"AlmostNoSecurity": true,
+	"LowSecurity":      true,
+	"MediumSecurity":   true,
+	"HighSecurity":     true,
+}
+
+// AIOBinDir is the directory the all-in-one puppet-agent packages
+// install the puppet binary into.
+const AIOBinDir = "/opt/puppetlabs/bin"
+
+// puppetCollection describes where the release package of a Puppet
+// collection, which configures its package repositories, is found, and
+// how the collection is packaged elsewhere.
+type puppetCollection struct {
+	Release       string
+	AptRepository string
+	YumRepository string
+
+	// FreeBSDPackage is the name of the FreeBSD package of the
+	// collection.
+	FreeBSDPackage string
+
+	// MacRepository is where the macOS disk images of the collection
+	// are found.
+	MacRepository string
+
+	// MSIRepository is where the Windows installers of the collection
+	// are found.
+	MSIRepository string
+}
+
+var puppetCollections = map[string]*puppetCollection{
+	"puppet": &puppetCollection{
+		Release:        "puppet-release",
+		AptRepository:  "https://apt.puppetlabs.com",
+		YumRepository:  "https://yum.puppetlabs.com",
+		FreeBSDPackage: "puppet8",
+		MacRepository:  "https://downloads.puppetlabs.com/mac/puppet8",
+		MSIRepository:  "https://downloads.puppetlabs.com/windows/puppet8",
+	},
+	"puppet7": &puppetCollection{
+		Release:        "puppet7-release",
+		AptRepository:  "https://apt.puppetlabs.com",
+		YumRepository:  "https://yum.puppetlabs.com",
+		FreeBSDPackage: "puppet7",
+		MacRepository:  "https://downloads.puppetlabs.com/mac/puppet7",
+		MSIRepository:  "https://downloads.puppetlabs.com/windows/puppet7",
+	},
+	"puppet8": &puppetCollection{
+		Release:        "puppet8-release",
+		AptRepository:  "https://apt.puppetlabs.com",
+		YumRepository:  "https://yum.puppetlabs.com",
+		FreeBSDPackage: "puppet8",
+		MacRepository:  "https://downloads.puppetlabs.com/mac/puppet8",
+		MSIRepository:  "https://downloads.puppetlabs.com/windows/puppet8",
+	},
+	"nightly": &puppetCollection{
+		Release:        "puppet-nightly-release",
+		AptRepository:  "https://nightlies.puppet.com/apt",
+		YumRepository:  "https://nightlies.puppet.com/yum",
+		FreeBSDPackage: "puppet8",
+		MacRepository:  "https://nightlies.puppet.com/downloads/mac/puppet8-nightly",
+		MSIRepository:  "https://nightlies.puppet.com/downloads/windows/puppet8-nightly",
+	},
+}
+
+// msiexecInstall holds the PowerShell statements installing the Windows
+// installer at $msi silently and exiting with the status of msiexec.
+// 3010 means that a reboot is needed to complete the install, which
+// isn't a failure.
+const msiexecInstall = "$p = Start-Process msiexec.exe -Wait -PassThru " +
+	"-ArgumentList '/qn','/norestart','/i',$msi; " +
+	"if ($p.ExitCode -eq 3010) { exit 0 }; exit $p.ExitCode"
+
+// msiUninstall is the command removing the puppet-agent installed from
+// a Windows installer.
+const msiUninstall = "powershell -Command \"Get-Package -Name 'Puppet Agent*' | Uninstall-Package -Force\""
+
+// DefaultPuppetCollection is the collection whose repositories are
+// used when puppet_collection isn't set.
+const DefaultPuppetCollection = "puppet"
+
+var installMethods = map[string]*installMethod{
+	"apt": &installMethod{
+		Check:  "command -v apt-get && command -v dpkg && command -v wget",
+		Reason: "apt-get, dpkg and wget are required",
+		Install: "sh -c '" +
+			"codename=$(. /etc/os-release && echo $VERSION_CODENAME); " +
+			"[ -n \"$codename\" ] || codename=$(lsb_release -cs); " +
+			"wget -q -O /tmp/puppet-release.deb {{.AptRepository}}/{{.Release}}-$codename.deb && " +
+			aptKeyringCheck +
+			"dpkg -i /tmp/puppet-release.deb && rm -f /tmp/puppet-release.deb && " +
+			"apt-get update && " +
+			"apt-get install -y puppet-agent{{if .Version}}={{.Version}}*{{end}}'",
+		Uninstall:  "apt-get remove -y --purge puppet-agent {{.Release}}",
+		BinDir:     AIOBinDir,
+		Collection: true,
+		GPG:        true,
+	},
+	"package": &installMethod{
+		Check:  "command -v apt-get || command -v yum",
+		Reason: "no supported package manager (apt-get, yum) found",
+		Install: "sh -c '" +
+			"if command -v apt-get >/dev/null 2>&1; then " +
+			"apt-get install -y puppet{{if .Version}}={{.Version}}*{{end}}; " +
+			"else yum install -y puppet{{if .Version}}-{{.Version}}{{end}}; fi'",
+		Uninstall: "sh -c '" +
+			"if command -v apt-get >/dev/null 2>&1; then " +
+			"apt-get remove -y --purge puppet; " +
+			"else yum remove -y puppet; fi'",
+	},
+	"yum": &installMethod{
+		Check:  "command -v rpm && (command -v dnf || command -v yum)",
+		Reason: "rpm and dnf or yum are required",
+		Install: "sh -c '" +
+			"el=$(rpm -E %rhel); " +
+			"case \"$el\" in [0-9]*) ;; *) el=$(. /etc/os-release && echo ${VERSION_ID%%.*}) ;; esac; " +
+			fmt.Sprintf(rpmReleaseInstall, "{{.YumRepository}}/{{.Release}}-el-$el.noarch.rpm") + " && " +
+			"if command -v dnf >/dev/null 2>&1; then pm=dnf; else pm=yum; fi && " +
+			"$pm install -y puppet-agent{{if .Version}}-{{.Version}}{{end}}'",
+		Uninstall: "sh -c '" +
+			"if command -v dnf >/dev/null 2>&1; then pm=dnf; else pm=yum; fi; " +
+			"$pm remove -y puppet-agent {{.Release}}'",
+		BinDir:     AIOBinDir,
+		Collection: true,
+		GPG:        true,
+	},
+	"zypper": &installMethod{
+		Check:  "command -v zypper && command -v rpm",
+		Reason: "zypper and rpm are required",
+		Install: "sh -c '" +
+			"sles=$(. /etc/os-release && echo ${VERSION_ID%%.*}); " +
+			fmt.Sprintf(rpmReleaseInstall, "{{.YumRepository}}/{{.Release}}-sles-$sles.noarch.rpm") + " && " +
+			"zypper --non-interactive {{if not .GPGKey}}--gpg-auto-import-keys {{end}}refresh && " +
+			"zypper --non-interactive install puppet-agent{{if .Version}}={{.Version}}{{end}}'",
+		Uninstall:  "zypper --non-interactive remove puppet-agent {{.Release}}",
+		BinDir:     AIOBinDir,
+		Collection: true,
+		GPG:        true,
+	},
+	"apk": &installMethod{
+		Check:     "command -v apk",
+		Reason:    "apk is not available",
+		Install:   "apk add --no-cache puppet{{if .Version}}~{{.Version}}{{end}}",
+		Uninstall: "apk del puppet",
+	},
+	"pacman": &installMethod{
+		Check:       "command -v pacman",
+		Reason:      "pacman is not available",
+		Install:     "pacman -Syu --noconfirm puppet",
+		Uninstall:   "pacman -R --noconfirm puppet",
+		Unversioned: true,
+	},
+	"pkg": &installMethod{
+		Check:       "sh -c 'command -v pkg && [ \"$(uname -s)\" = FreeBSD ]'",
+		Reason:      "not a FreeBSD machine with pkg",
+		Install:     "pkg install -y {{.FreeBSDPackage}}",
+		Uninstall:   "pkg delete -y {{.FreeBSDPackage}}",
+		BinDir:      "/usr/local/bin",
+		Collection:  true,
+		Unversioned: true,
+	},
+	"dmg": &installMethod{
+		Check:  "sh -c 'command -v hdiutil && command -v installer && command -v curl'",
+		Reason: "not a macOS machine with curl",
+		Install: "sh -c '" +
+			"os=$(sw_vers -productVersion | cut -d. -f1); " +
+			"arch=$(uname -m); [ \"$arch\" = arm64 ] || arch=x86_64; " +
+			"curl -fsSL -o /tmp/puppet-agent.dmg " +
+			"{{.MacRepository}}/$os/$arch/puppet-agent-{{if .Version}}{{.Version}}-1.osx$os{{else}}latest{{end}}.dmg && " +
+			"hdiutil attach -nobrowse -mountpoint /Volumes/puppet-agent /tmp/puppet-agent.dmg && " +
+			"{ installer -pkg /Volumes/puppet-agent/puppet-agent-*.pkg -target /; rc=$?; " +
+			"hdiutil detach /Volumes/puppet-agent; rm -f /tmp/puppet-agent.dmg; exit $rc; }'",
+		Uninstall: "sh -c '" +
+			"launchctl unload /Library/LaunchDaemons/com.puppetlabs.*.plist; " +
+			"rm -rf /opt/puppetlabs /Library/LaunchDaemons/com.puppetlabs.*.plist && " +
+			"pkgutil --forget com.puppetlabs.puppet-agent'",
+		BinDir:     AIOBinDir,
+		Collection: true,
+	},
+	"script": &installMethod{
+		Check:   "command -v sh",
+		Reason:  "sh is not available",
+		Install: "sh {{quote .Package}}{{if .ScriptArgs}} {{.ScriptArgs}}{{end}}",
+		BinDir:  AIOBinDir,
+	},
+	"msi": &installMethod{
+		Check:  "where msiexec",
+		Reason: "msiexec is not available",
+		Install: "powershell -Command \"$ErrorActionPreference = 'Stop'; " +
+			"$msi = Join-Path $env:TEMP 'puppet-agent.msi'; " +
+			"Invoke-WebRequest -UseBasicParsing -OutFile $msi{{if .Proxy}} -Proxy '{{.Proxy}}'{{end}} " +
+			"-Uri {{.MSIRepository}}/puppet-agent-{{if .Version}}{{.Version}}-x64{{else}}x64-latest{{end}}.msi; " +
+			msiexecInstall + "\"",
+		Uninstall:  msiUninstall,
+		Collection: true,
+		Windows:    true,
+	},
+	"gem": &installMethod{
+		Check:  "command -v {{.Gem}}",
+		Reason: "gem is not available",
+		Install: "{{.Gem}} install puppet{{if .Version}} -v {{.Version}}{{end}}" +
+			"{{if .TrustPolicy}} --trust-policy {{.TrustPolicy}}{{end}}{{if .GemFlags}} {{.GemFlags}}{{end}} " +
+			gemDocumentFlags,
+		Uninstall: "{{.Gem}} uninstall -a -x puppet",
+		Gem:       true,
+	},
+}
+
+// facterGemInstall is the command of the "gem" install method that
+// installs the gem of facter_version before Puppet, so that the Puppet gem
+// depends on it rather than on the latest Facter.
+const facterGemInstall = "{{.Gem}} install facter -v {{.FacterVersion}}" +
+	"{{if .TrustPolicy}} --trust-policy {{.TrustPolicy}}{{end}}{{if .GemFlags}} {{.GemFlags}}{{end}} " +
+	gemDocumentFlags
+
+// innerPackage is the path of the package as quoted within a command
+// that is itself single-quoted, such as the script of a sh -c: the
+// quotes are closed around the path quoted twice.
+const innerPackage = "'{{quote (quote .Package)}}'"
+
+// localPackageMethods install a package uploaded from local_package_path,
+// by file extension. They need no network access from the guest.
+var localPackageMethods = map[string]*installMethod{
+	".deb": &installMethod{
+		Install:   "dpkg -i {{quote .Package}}",
+		Uninstall: "sh -c 'dpkg -r puppet-agent 2>/dev/null || dpkg -r puppet'",
+	},
+	".rpm": &installMethod{
+		Install:   "sh -c '" + fmt.Sprintf(rpmSignatureCheck, innerPackage) + "rpm -Uvh " + innerPackage + "'",
+		Uninstall: "sh -c 'rpm -e puppet-agent 2>/dev/null || rpm -e puppet'",
+		GPG:       true,
+	},
+	".gem": &installMethod{
+		Install:   "{{.Gem}} install --local {{quote .Package}}{{if .GemFlags}} {{.GemFlags}}{{end}} " + gemDocumentFlags,
+		Uninstall: "{{.Gem}} uninstall -a -x puppet",
+		Gem:       true,
+	},
+	".msi": &installMethod{
+		Install:   "powershell -Command \"$msi = {{quote .Package}}; " + msiexecInstall + "\"",
+		Uninstall: msiUninstall,
+		Windows:   true,
+	},
+}
+
+// gemBundleMethod installs the gems uploaded from gem_bundle_path. The
+// bundle holds puppet along with all its dependencies, so they are
+// installed without resolving dependencies from the network.
+var gemBundleMethod = &installMethod{
+	Install: "{{.Gem}} install --local --ignore-dependencies {{quote .Package}}/*.gem" +
+		"{{if .GemFlags}} {{.GemFlags}}{{end}} " + gemDocumentFlags,
+	Uninstall: "{{.Gem}} uninstall -a -x puppet",
+	Gem:       true,
+}
+
+// GemBundleMethod is the name under which a gem bundle install is
+// recorded.
+const GemBundleMethod = "gem-bundle"
+
+// installMethodGroups are names standing for several install methods in
+// install_method.
+var installMethodGroups = map[string][]string{
+	"native":   []string{"package", "apk", "pacman", "pkg"},
+	"aio-repo": []string{"apt", "yum", "zypper", "dmg"},
+}
+
+// installMethodSettings are the settings that only apply to some install
+// methods, a description of those methods, and whether they apply to a
+// given method.
+var installMethodSettings = []struct {
+	keys    []string
+	methods string
+	applies func(name string, method *installMethod) bool
+}{
+	{
+		[]string{"gem_binary", "gem_flags", "gem_no_document", "gem_login_shell",
+			"gem_cert_path", "gem_trust_policy"},
+		"the gem install methods",
+		func(name string, method *installMethod) bool { return method.Gem },
+	},
+	{
+		[]string{"facter_version"},
+		"the gem install method",
+		func(name string, method *installMethod) bool { return name == "gem" },
+	},
+	{
+		[]string{"bootstrap_script_url", "bootstrap_script_sha256", "bootstrap_script_args"},
+		"the script install method",
+		func(name string, method *installMethod) bool { return name == "script" },
+	},
+	{
+		[]string{"gpg_key_fingerprint", "gpg_key_path", "gpg_keyserver"},
+		"the apt, yum and zypper install methods and .rpm packages",
+		func(name string, method *installMethod) bool { return method.GPG },
+	},
+	{
+		[]string{"puppet_collection"},
+		"the aio-repo, pkg and msi install methods",
+		func(name string, method *installMethod) bool { return method.Collection },
+	},
+}
+
+// expandInstallMethods replaces the groups of install methods with the
+// methods they stand for.
+func expandInstallMethods(names []string) []string {
+	result := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		expanded, ok := installMethodGroups[name]
+		if !ok {
+			expanded = []string{name}
+		}
+
+		for _, method := range expanded {
+			if !seen[method] {
+				seen[method] = true
+				result = append(result, method)
+			}
+		}
+	}
+
+	return result
+}
+
+// installSettingsErrors checks that the install settings that were set
+// apply to the install methods that will be used.
+func (p *Provisioner) installSettingsErrors(decoded map[string]bool) []error {
+	errs := make([]error, 0)
+
+	methods := make(map[string]*installMethod)
+	switch {
+	case p.config.LocalPackagePath != "":
+		ext := filepath.Ext(p.config.LocalPackagePath)
+		if method, ok := localPackageMethods[ext]; ok {
+			methods[ext] = method
+		}
+	case p.config.GemBundlePath != "":
+		methods[GemBundleMethod] = gemBundleMethod
+	default:
+		for _, name := range p.config.InstallMethod {
+			if method, ok := installMethods[name]; ok {
+				methods[name] = method
+			}
+		}
+	}
+
+	windows := p.config.guest == guestOSTypes[GuestOSTypeWindows]
+	for name, method := range methods {
+		if method.Windows != windows {
+			errs = append(errs, fmt.Errorf(
+				"Installing Puppet with '%s' isn't supported on %s guests", name, p.config.GuestOSType))
+		}
+
+		if method.Unversioned && decoded["version"] {
+			errs = append(errs, fmt.Errorf(
+				"version isn't supported by the '%s' install method, which installs the current version", name))
+		}
+	}
+
+	if decoded["install_method"] && (p.config.LocalPackagePath != "" || p.config.GemBundlePath != "") {
+		errs = append(errs, fmt.Errorf(
+			"install_method can't be set along with local_package_path or gem_bundle_path"))
+	}
+
+	for _, setting := range installMethodSettings {
+		applies := false
+		for name, method := range methods {
+			applies = applies || setting.applies(name, method)
+		}
+
+		for _, key := range setting.keys {
+			if decoded[key] && !applies {
+				errs = append(errs, fmt.Errorf("%s only applies to %s", key, setting.methods))
+			}
+		}
+	}
+
+	return errs
+}
+
+// DefaultInstallMethods is the order in which install methods are tried
+// when none are configured.
+var DefaultInstallMethods = []string{"package", "gem"}
+
+// AIOInstallMethods are the install methods tried when a Puppet
+// collection is configured.
+var AIOInstallMethods = []string{"apt", "yum", "zypper"}
+
+// WindowsInstallMethods are the install methods tried on Windows guests
+// when none are configured.
+var WindowsInstallMethods = []string{"msi"}
+
+// Install installs Puppet on the remote machine, trying each configured
+// install method in turn until one of them succeeds.
+func (p *Provisioner) Install(ui packer.Ui, comm packer.Communicator) error {
+	p.ui = ui
+	p.quiet = p.config.InstallOutput == OutputQuiet
+	defer func() { p.quiet = false }()
+
+	if p.config.UpdatePackageCache {
+		if err := p.updatePackageCache(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	if p.config.GPGKeyFingerprint != "" {
+		if err := p.importGPGKey(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	if p.config.LocalPackagePath != "" {
+		return p.installLocalPackage(ui, comm)
+	}
+
+	if p.config.GemBundlePath != "" {
+		return p.installGemBundle(ui, comm)
+	}
+
+	failures := make([]string, 0, len(p.config.InstallMethod))
+	for _, name := range p.config.InstallMethod {
+		method := installMethods[name]
+
+		if method.Gem {
+			if err := p.ensurePrerequisite(ui, "ruby", comm); err != nil {
+				return err
+			}
+		}
+
+		status, err := p.remoteCommandStatus(p.checkInRoot(p.installCommand(method, method.Check, nil)), comm)
+		if err != nil {
+			return err
+		}
+
+		if status != 0 {
+			ui.Message(fmt.Sprintf("Skipping install method '%s': %s", name, method.Reason))
+			failures = append(failures, fmt.Sprintf("%s: %s", name, method.Reason))
+			continue
+		}
+
+		if name == "gem" && p.config.GemCertPath != "" {
+			ui.Message(fmt.Sprintf("Trusting gem certificate: %s", p.config.GemCertPath))
+			if err := p.trustGemCert(comm); err != nil {
+				return fmt.Errorf("Error trusting gem certificate: %s", err)
+			}
+		}
+
+		if name == "gem" && p.config.FacterVersion != "" {
+			ui.Message(fmt.Sprintf("Installing Facter %s", p.config.FacterVersion))
+			install := p.withProxy(p.installCommand(method, facterGemInstall, nil))
+			command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(install))
+			if err != nil {
+				return err
+			}
+
+			if err := p.executeInstallCommand(ui, command, comm); err != nil {
+				return fmt.Errorf("Error installing Facter: %s", err)
+			}
+		}
+
+		data := new(InstallTemplate)
+		if name == "script" {
+			data.Package, err = p.uploadBootstrapScript(ui, comm)
+			if err != nil {
+				return fmt.Errorf("Error uploading bootstrap script: %s", err)
+			}
+		}
+
+		install := p.withProxy(p.installCommand(method, method.Install, data))
+		command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(install))
+		if err != nil {
+			return err
+		}
+
+		ui.Message(fmt.Sprintf("Installing Puppet using method '%s'", name))
+		if err := p.executeInstallCommand(ui, command, comm); err != nil {
+			ui.Message(fmt.Sprintf("Install method '%s' failed: %s", name, err))
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+
+		p.installedMethod = name
+		if p.config.PuppetBinDir == "" {
+			p.config.PuppetBinDir = method.BinDir
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("All install methods failed:\n%s", strings.Join(failures, "\n"))
+}
+
+// executeInstallCommand runs an install command, retrying it with an
+// increasing delay as configured when it fails.
+func (p *Provisioner) executeInstallCommand(ui packer.Ui, command string, comm packer.Communicator) error {
+	delay := p.config.installRetryDelay
+	for retry := 0; ; retry++ {
+		err := p.executeCommand(command, comm, 0)
+		if err == nil || retry >= p.config.InstallRetries {
+			return err
+		}
+
+		ui.Message(fmt.Sprintf("Install command failed, retrying in %s: %s", delay, err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// verifyInstall runs install_verify_command, failing with its output if
+// it exits with a non-zero status.
+func (p *Provisioner) verifyInstall(ui packer.Ui, comm packer.Communicator) error {
+	var command bytes.Buffer
+	t := template.Must(p.commandTemplate("install-verify").Parse(p.config.InstallVerifyCommand))
+	t.Execute(&command, &InstallVerifyTemplate{PuppetBinDir: p.config.PuppetBinDir})
+
+	elevated, err := p.elevateWith(p.config.RunSudo, p.config.RunAsUser, p.inRoot(command.String()))
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: elevated,
+		Stdin:   p.elevatedStdin(elevated),
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+
+	log.Printf("Executing command: %s", p.redact(elevated))
+	p.audit(elevated)
+	if err := comm.Start(cmd); err != nil {
+		return fmt.Errorf("Error verifying the Puppet install: %s", err)
+	}
+	cmd.Wait()
+
+	output := p.redact(strings.TrimSpace(stdout.String() + stderr.String()))
+	if cmd.ExitStatus != 0 {
+		return fmt.Errorf("Puppet doesn't work after installing it, %s exited with status %d:\n%s",
+			p.redact(command.String()), cmd.ExitStatus, output)
+	}
+
+	if output != "" {
+		ui.Message(output)
+	}
+
+	return nil
+}
+
+// installLocalPackage uploads the package at local_package_path to the
+// staging directory and installs it.
+func (p *Provisioner) installLocalPackage(ui packer.Ui, comm packer.Communicator) error {
+	ext := filepath.Ext(p.config.LocalPackagePath)
+	method := localPackageMethods[ext]
+
+	if method.Gem {
+		if err := p.ensurePrerequisite(ui, "ruby", comm); err != nil {
+			return err
+		}
+	}
+
+	ui.Message(fmt.Sprintf("Uploading package: %s", p.config.LocalPackagePath))
+	remotePath, err := p.uploadToStaging(p.config.LocalPackagePath, comm)
+	if err != nil {
+		return fmt.Errorf("Error uploading package: %s", err)
+	}
+
+	install := p.installCommand(method, method.Install, &InstallTemplate{Package: remotePath})
+	command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(p.withProxy(install)))
+	if err != nil {
+		return err
+	}
+
+	ui.Message(fmt.Sprintf("Installing Puppet from package: %s", filepath.Base(remotePath)))
+	if err := p.executeInstallCommand(ui, command, comm); err != nil {
+		return err
+	}
+
+	p.installedMethod = ext
+	if p.config.PuppetBinDir == "" && strings.HasPrefix(filepath.Base(remotePath), "puppet-agent") {
+		p.config.PuppetBinDir = AIOBinDir
+	}
+
+	return nil
+}
+
+// installGemBundle uploads the gems at gem_bundle_path to the staging
+// directory and installs them.
+func (p *Provisioner) installGemBundle(ui packer.Ui, comm packer.Communicator) error {
+	if err := p.ensurePrerequisite(ui, "ruby", comm); err != nil {
+		return err
+	}
+
+	ui.Message(fmt.Sprintf("Uploading gem bundle: %s", p.config.GemBundlePath))
+	remotePath := p.config.guest.Join(p.config.StagingDir, "gems")
+	if err := p.uploadLocalDirectory(p.config.GemBundlePath, p.hostPath(remotePath), comm); err != nil {
+		return fmt.Errorf("Error uploading gem bundle: %s", err)
+	}
+
+	install := p.installCommand(gemBundleMethod, gemBundleMethod.Install, &InstallTemplate{Package: remotePath})
+	command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(install))
+	if err != nil {
+		return err
+	}
+
+	ui.Message("Installing Puppet from the gem bundle")
+	if err := p.executeInstallCommand(ui, command, comm); err != nil {
+		return err
+	}
+
+	p.installedMethod = GemBundleMethod
+	return nil
+}
+
+// uploadToStaging uploads a local file into the remote staging
+// directory and returns its remote path.
+func (p *Provisioner) uploadToStaging(localPath string, comm packer.Communicator) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = p.createRemoteDirectory(p.hostPath(p.config.StagingDir), comm)
+	if err != nil {
+		return "", err
+	}
+
+	remotePath := p.config.guest.Join(p.config.StagingDir, filepath.Base(localPath))
+	if err := p.upload(p.hostPath(remotePath), f, comm); err != nil {
+		return "", err
+	}
+
+	return remotePath, nil
+}
+
+// trustGemCert uploads the configured gem signing certificate to the
+// staging directory and adds it to the trusted certificates.
+func (p *Provisioner) trustGemCert(comm packer.Communicator) error {
+	remotePath, err := p.uploadToStaging(p.config.GemCertPath, comm)
+	if err != nil {
+		return err
+	}
+
+	trust := p.installCommand(installMethods["gem"], "{{.Gem}} cert --add {{quote .Package}}",
+		&InstallTemplate{Package: remotePath})
+	command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(trust))
+	if err != nil {
+		return err
+	}
+
+	return p.executeCommand(command, comm, 0)
+}
+
+// installCommand renders the template of a command of an install
+// method, such as its install or uninstall command. data holds the
+// values specific to the command, if any, and the values coming from
+// the settings are filled in. Commands of gem methods run through a
+// login shell if gem_login_shell is set.
+func (p *Provisioner) installCommand(method *installMethod, command string, data *InstallTemplate) string {
+	if data == nil {
+		data = new(InstallTemplate)
+	}
+
+	collection := puppetCollections[p.config.PuppetCollection]
+	data.Version = p.config.Version
+	data.FacterVersion = p.config.FacterVersion
+	data.TrustPolicy = p.config.GemTrustPolicy
+	data.Release = collection.Release
+	data.AptRepository = collection.AptRepository
+	data.YumRepository = collection.YumRepository
+	data.FreeBSDPackage = collection.FreeBSDPackage
+	data.MacRepository = collection.MacRepository
+	data.MSIRepository = collection.MSIRepository
+	data.Proxy = p.config.HTTPSProxy
+	if data.Proxy == "" {
+		data.Proxy = p.config.HTTPProxy
+	}
+	data.Gem = p.config.GemBinary
+	data.GemFlags = strings.Join(p.config.GemFlags, " ")
+	data.GemNoDocument = p.config.GemNoDocument
+	data.ScriptArgs = strings.Join(p.config.BootstrapScriptArgs, " ")
+	if p.config.GPGKeyFingerprint != "" {
+		data.GPGKey = p.config.guest.Join(p.config.StagingDir, GPGKeyFile)
+		data.GPGHome = p.config.guest.Join(p.config.StagingDir, "gnupg")
+		data.GPGFingerprint = p.config.GPGKeyFingerprint
+		data.GPGKeyID = p.config.GPGKeyFingerprint[len(p.config.GPGKeyFingerprint)-8:]
+	}
+
+	var result bytes.Buffer
+	t := template.Must(p.commandTemplate("puppet-install").Parse(command))
+	t.Execute(&result, data)
+
+	if method.Gem && p.config.GemLoginShell {
+		return "bash -lc " + shellQuote(result.String())
+	}
+
+	return result.String()
+}
+
+// withProxy wraps a command so that it runs with the configured proxy
+// settings in its environment. Commands installing on Windows guests are
+// given the proxy by their template instead.
+func (p *Provisioner) withProxy(command string) string {
+	if p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+		return command
+	}
+
+	env := make([]string, 0, 3)
+	for _, v := range []struct{ name, value string }{
+		{"http_proxy", p.config.HTTPProxy},
+		{"https_proxy", p.config.HTTPSProxy},
+		{"no_proxy", p.config.NoProxy},
+	} {
+		if v.value != "" {
+			env = append(env, fmt.Sprintf("%s=%s", v.name, shellQuote(v.value)))
+		}
+	}
+
+	if len(env) == 0 {
+		return command
+	}
+
+	return fmt.Sprintf("env %s %s", strings.Join(env, " "), command)
+}
+
+// remoteCommandStatus runs a command on the remote machine, discarding
+// its output, and returns its exit status.
+func (p *Provisioner) remoteCommandStatus(command string, comm packer.Communicator) (int, error) {
+	_, status, err := p.remoteCommandOutput(command, comm)
+	return status, err
+}
+
+// remoteCommandOutput runs a command on the remote machine and returns
+// its standard output and exit status.
+func (p *Provisioner) remoteCommandOutput(command string, comm packer.Communicator) (string, int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdin:   p.elevatedStdin(command),
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+
+	p.audit(command)
+	if err := comm.Start(cmd); err != nil {
+		return "", 0, err
+	}
+
+	cmd.Wait()
+	return stdout.String(), cmd.ExitStatus, nil
+}
+
+// removePuppet uninstalls Puppet using the method that installed it.
+func (p *Provisioner) removePuppet(ui packer.Ui, comm packer.Communicator) error {
+	if p.installedMethod == "" {
+		ui.Message("Puppet wasn't installed by this provisioner, leaving it in place")
+		return nil
+	}
+
+	p.quiet = p.config.InstallOutput == OutputQuiet
+	defer func() { p.quiet = false }()
+
+	method, ok := installMethods[p.installedMethod]
+	if !ok {
+		method, ok = localPackageMethods[p.installedMethod]
+	}
+	if !ok {
+		method = gemBundleMethod
+	}
+
+	if method.Uninstall == "" {
+		ui.Message(fmt.Sprintf("Install method '%s' can't remove Puppet, leaving it in place", p.installedMethod))
+		return nil
+	}
+
+	command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(p.installCommand(method, method.Uninstall, nil)))
+	if err != nil {
+		return err
+	}
+
+	ui.Message(fmt.Sprintf("Removing Puppet using method '%s'", p.installedMethod))
+	return p.executeCommand(command, comm, 0)
+}
@@ -0,0 +1,32 @@
+package puppet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+// Invocation describes how Puppet was run on the remote machine. It is
+// written as JSON to the invocation_file so that later provisioners and
+// post-processors can inspect or replay the exact run.
+type Invocation struct {
+	BuildName        string `json:"build_name"`
+	Command          string `json:"command"`
+	StagingDirectory string `json:"staging_directory"`
+	ModulePath       string `json:"module_path"`
+	Manifest         string `json:"manifest"`
+	Environment      string `json:"environment,omitempty"`
+	EnvironmentPath  string `json:"environment_path,omitempty"`
+	ConfigVersion    string `json:"config_version,omitempty"`
+}
+
+// writeInvocation writes the invocation to the configured local file.
+func (p *Provisioner) writeInvocation(inv *Invocation) error {
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Writing Puppet invocation to %s", p.config.InvocationFile)
+	return ioutil.WriteFile(p.config.InvocationFile, []byte(p.redact(string(data))), 0644)
+}
@@ -0,0 +1,58 @@
+package puppet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProvisionerWriteInvocation(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer-puppet-invocation")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	var p Provisioner
+	p.config.InvocationFile = tf.Name()
+	p.config.secrets = []string{"hunter2"}
+
+	err = p.writeInvocation(&Invocation{
+		Command:         "echo hunter2 | sudo -S puppet apply site.pp",
+		Manifest:        "site.pp",
+		Environment:     "production",
+		EnvironmentPath: "/tmp/staging/environments",
+		ConfigVersion:   "abc123",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(tf.Name())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var inv Invocation
+	if err := json.Unmarshal(data, &inv); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if inv.Command != "echo <sensitive> | sudo -S puppet apply site.pp" {
+		t.Fatalf("bad: %#v", inv)
+	}
+
+	if inv.Manifest != "site.pp" {
+		t.Fatalf("bad: %#v", inv)
+	}
+
+	if inv.Environment != "production" || inv.EnvironmentPath != "/tmp/staging/environments" {
+		t.Fatalf("bad: %#v", inv)
+	}
+
+	if inv.ConfigVersion != "abc123" {
+		t.Fatalf("bad: %#v", inv)
+	}
+}
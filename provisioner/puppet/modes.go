@@ -0,0 +1,72 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"os"
+	"sort"
+)
+
+// Modes given to the files and directories created by uploads, which
+// don't need to be restored.
+const (
+	uploadedFileMode os.FileMode = 0644
+	uploadedDirMode  os.FileMode = 0755
+)
+
+// maxChmodPaths is the number of paths changed by a single chmod
+// command, to keep command lines short.
+const maxChmodPaths = 100
+
+// restoreModes gives the files and directories uploaded from localDir
+// into remoteDir the modes they have locally, such as the executable
+// bits of scripts, when those differ from the modes uploads create them
+// with. Guests that don't support changing modes are left alone.
+func (p *Provisioner) restoreModes(localDir string, remoteDir string, comm packer.Communicator) error {
+	if p.config.guest.Chmod == "" {
+		return nil
+	}
+
+	modes := make(map[os.FileMode][]string)
+	err := p.walkLocalDirectory(localDir, func(path string, relPath string, f os.FileInfo) error {
+		// The modes of recreated symbolic links don't matter
+		if relPath == "." || f.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		mode := f.Mode().Perm()
+		if (f.IsDir() && mode != uploadedDirMode) || (!f.IsDir() && mode != uploadedFileMode) {
+			modes[mode] = append(modes[mode], p.config.guest.Join(remoteDir, relPath))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]int, 0, len(modes))
+	for mode := range modes {
+		sorted = append(sorted, int(mode))
+	}
+	sort.Ints(sorted)
+
+	for _, mode := range sorted {
+		paths := modes[os.FileMode(mode)]
+		for len(paths) > 0 {
+			n := len(paths)
+			if n > maxChmodPaths {
+				n = maxChmodPaths
+			}
+
+			command := p.config.guest.ChmodCommand(fmt.Sprintf("%o", mode), paths[:n]...)
+			if err := p.executeCommand(command, comm, 0); err != nil {
+				return err
+			}
+
+			paths = paths[n:]
+		}
+	}
+
+	return nil
+}
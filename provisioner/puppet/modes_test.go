@@ -0,0 +1,59 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerRestoreModes(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	modules := config["module_path"].(string)
+	if err := os.MkdirAll(filepath.Join(modules, "ntp", "files"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for name, mode := range map[string]os.FileMode{
+		"ntp/files/check.sh": 0755,
+		"ntp/files/secret":   0600,
+		"ntp/files/ntp.conf": 0644,
+	} {
+		path := filepath.Join(modules, name)
+		if err := ioutil.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// Don't depend on the umask
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.uploadLocalDirectory(modules, "/tmp/staging/modules-0", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	commands := strings.Join(comm.commands, "\n")
+	for _, expected := range []string{
+		"chmod 600 /tmp/staging/modules-0/ntp/files/secret",
+		"chmod 755 /tmp/staging/modules-0/ntp/files/check.sh",
+	} {
+		if !strings.Contains(commands, expected) {
+			t.Fatalf("bad: %s", commands)
+		}
+	}
+
+	if strings.Contains(commands, "ntp.conf") {
+		t.Fatalf("bad: %s", commands)
+	}
+}
@@ -0,0 +1,59 @@
+package puppet
+
+import (
+	"bufio"
+	"io"
+)
+
+// ContinuationMarker is appended to every chunk of an output line that
+// was split because it exceeded the maximum line length.
+const ContinuationMarker = " \\"
+
+// LineReader reads newline-delimited lines from r and sends them on the
+// returned channel, which is closed once r is exhausted. Lines longer than
+// max bytes are split into chunks, each but the last one carrying the
+// ContinuationMarker, so that arbitrarily long lines never have to be
+// buffered whole.
+func LineReader(r io.Reader, max int) <-chan string {
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+
+		buf := bufio.NewReaderSize(r, max)
+		for {
+			data, isPrefix, err := buf.ReadLine()
+
+			// Copied before peeking, which may overwrite the buffer
+			line := string(data)
+			if isPrefix && lineEndsNext(buf) {
+				// A line exactly max bytes long is reported as a prefix,
+				// followed by an empty line for its end, which is
+				// consumed here.
+				buf.ReadLine()
+				isPrefix = false
+			}
+
+			if len(line) > 0 || (err == nil && !isPrefix) {
+				if isPrefix {
+					ch <- line + ContinuationMarker
+				} else {
+					ch <- line
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// lineEndsNext returns whether the next bytes of buf end a line, or
+// there are none left.
+func lineEndsNext(buf *bufio.Reader) bool {
+	next, _ := buf.Peek(2)
+	return len(next) == 0 || next[0] == '\n' || (len(next) == 2 && next[0] == '\r' && next[1] == '\n')
+}
@@ -0,0 +1,49 @@
+package puppet
+
+import (
+	"strings"
+	"testing"
+)
+
+func readLines(ch <-chan string) []string {
+	result := make([]string, 0)
+	for line := range ch {
+		result = append(result, line)
+	}
+
+	return result
+}
+
+func TestLineReader(t *testing.T) {
+	lines := readLines(LineReader(strings.NewReader("foo\nbar\r\n\nbaz"), 32))
+	expected := []string{"foo", "bar", "", "baz"}
+
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("bad: %#v", lines)
+	}
+}
+
+func TestLineReader_longLines(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	lines := readLines(LineReader(strings.NewReader(long+"\nshort\n"), 16))
+	expected := []string{
+		strings.Repeat("a", 16) + ContinuationMarker,
+		strings.Repeat("a", 16) + ContinuationMarker,
+		strings.Repeat("a", 8),
+		"short",
+	}
+
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("bad: %#v", lines)
+	}
+}
+
+func TestLineReader_maxLengthLines(t *testing.T) {
+	exact := strings.Repeat("a", 16)
+	lines := readLines(LineReader(strings.NewReader(exact+"\n"+exact+"\r\nshort\n"+exact), 16))
+	expected := []string{exact, exact, "short", exact}
+
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("bad: %#v", lines)
+	}
+}
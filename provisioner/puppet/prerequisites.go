@@ -0,0 +1,155 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"strings"
+)
+
+// prerequisite is a set of tools the provisioner may need on the remote
+// machine, along with the packages providing them for each supported
+// package manager.
+type prerequisite struct {
+	// Check is the template of a command that exits zero if the tools
+	// are available.
+	Check string
+
+	// Gem is true if Check runs gem, and so honors the gem settings.
+	Gem bool
+
+	// Packages maps the package managers to the packages to install.
+	Packages map[string]string
+}
+
+var prerequisites = map[string]*prerequisite{
+	"ruby": &prerequisite{
+		Check: "command -v {{.Gem}}",
+		Gem:   true,
+		Packages: map[string]string{
+			"apt-get": "ruby",
+			"dnf":     "ruby rubygems",
+			"yum":     "ruby rubygems",
+			"zypper":  "ruby",
+			"apk":     "ruby",
+			"pacman":  "ruby",
+			"pkg":     "ruby devel/ruby-gems",
+		},
+	},
+	"gpg": &prerequisite{
+		Check: "command -v gpg",
+		Packages: map[string]string{
+			"apt-get": "gnupg",
+			"dnf":     "gnupg2",
+			"yum":     "gnupg2",
+			"zypper":  "gpg2",
+			"apk":     "gnupg",
+			"pacman":  "gnupg",
+			"pkg":     "gnupg",
+		},
+	},
+	"tar": &prerequisite{
+		Check: "sh -c 'command -v tar && command -v gzip'",
+		Packages: map[string]string{
+			"apt-get": "tar gzip",
+			"dnf":     "tar gzip",
+			"yum":     "tar gzip",
+			"zypper":  "tar gzip",
+			"apk":     "tar gzip",
+			"pacman":  "tar gzip",
+			"pkg":     "gtar",
+		},
+	},
+}
+
+// packageManagers are the package managers prerequisites are installed
+// with, in the order they are looked for, their install commands and
+// the commands refreshing their package indexes.
+var packageManagers = []struct{ name, install, update string }{
+	{"apt-get", "apt-get update && apt-get install -y %s", "apt-get update"},
+	{"dnf", "dnf install -y %s", "dnf makecache"},
+	{"yum", "yum install -y %s", "yum makecache"},
+	{"zypper", "zypper --non-interactive install %s", "zypper --non-interactive refresh"},
+	{"apk", "apk add --no-cache %s", "apk update"},
+	{"pacman", "pacman -Sy --noconfirm %s", "pacman -Sy"},
+	{"pkg", "pkg install -y %s", "pkg update"},
+}
+
+// prerequisiteInstallCommand returns the command installing the packages
+// of a prerequisite with whichever package manager is available.
+func prerequisiteInstallCommand(req *prerequisite) string {
+	branches := make([]string, 0, len(packageManagers))
+	for _, pm := range packageManagers {
+		packages, ok := req.Packages[pm.name]
+		if !ok {
+			continue
+		}
+
+		branches = append(branches, fmt.Sprintf(
+			"if command -v %s >/dev/null 2>&1; then %s; ", pm.name, fmt.Sprintf(pm.install, packages)))
+	}
+
+	return "sh -c '" + strings.Join(branches, "el") + "else exit 1; fi'"
+}
+
+// packageCacheUpdateCommand returns the command refreshing the package
+// indexes of whichever package manager is available.
+func packageCacheUpdateCommand() string {
+	branches := make([]string, 0, len(packageManagers))
+	for _, pm := range packageManagers {
+		branches = append(branches, fmt.Sprintf(
+			"if command -v %s >/dev/null 2>&1; then %s; ", pm.name, pm.update))
+	}
+
+	return "sh -c '" + strings.Join(branches, "el") + "else exit 1; fi'"
+}
+
+// updatePackageCache refreshes the package indexes of the remote
+// machine, which are often stale on fresh cloud images.
+func (p *Provisioner) updatePackageCache(ui packer.Ui, comm packer.Communicator) error {
+	command, err := p.elevateWith(p.config.InstallSudo, "",
+		p.inRoot(p.withProxy(packageCacheUpdateCommand())))
+	if err != nil {
+		return err
+	}
+
+	ui.Message("Updating the package cache")
+	if err := p.executeInstallCommand(ui, command, comm); err != nil {
+		return fmt.Errorf("Error updating the package cache: %s", err)
+	}
+
+	return nil
+}
+
+// ensurePrerequisite installs the packages providing the named
+// prerequisite, unless it is already available, install_prerequisites
+// isn't set or the guest isn't a unix one, as the prerequisites are
+// installed with unix package managers.
+func (p *Provisioner) ensurePrerequisite(ui packer.Ui, name string, comm packer.Communicator) error {
+	if !p.config.InstallPrerequisites || p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+		return nil
+	}
+
+	req := prerequisites[name]
+	check := p.installCommand(&installMethod{Gem: req.Gem}, req.Check, nil)
+	status, err := p.remoteCommandStatus(p.checkInRoot(check), comm)
+	if err != nil {
+		return err
+	}
+
+	if status == 0 {
+		return nil
+	}
+
+	command, err := p.elevateWith(p.config.InstallSudo, "",
+		p.inRoot(p.withProxy(prerequisiteInstallCommand(req))))
+	if err != nil {
+		return err
+	}
+
+	ui.Message(fmt.Sprintf("Installing prerequisite: %s", name))
+	if err := p.executeInstallCommand(ui, command, comm); err != nil {
+		return fmt.Errorf("Error installing prerequisite %s: %s", name, err)
+	}
+
+	return nil
+}
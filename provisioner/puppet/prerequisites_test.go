@@ -0,0 +1,120 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"strings"
+	"testing"
+)
+
+func TestPrerequisiteInstallCommand(t *testing.T) {
+	command := prerequisiteInstallCommand(prerequisites["ruby"])
+
+	if !strings.HasPrefix(command, "sh -c 'if command -v apt-get >/dev/null 2>&1; then "+
+		"apt-get update && apt-get install -y ruby; elif command -v dnf") {
+		t.Fatalf("bad: %s", command)
+	}
+
+	if !strings.HasSuffix(command, "then pkg install -y ruby devel/ruby-gems; else exit 1; fi'") {
+		t.Fatalf("bad: %s", command)
+	}
+}
+
+func TestProvisionerEnsurePrerequisite(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartExitStatus = 1
+	if err := p.ensurePrerequisite(testUi(), "ruby", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCalled {
+		t.Fatal("should not install prerequisites unless asked to")
+	}
+
+	config["install_prerequisites"] = true
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm.StartExitStatus = 0
+	if err := p.ensurePrerequisite(testUi(), "ruby", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Command != "command -v gem" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	config["apply_root"] = "/mnt/image"
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.ensurePrerequisite(testUi(), "ruby", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Command != "chroot /mnt/image sh -c 'command -v gem'" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	delete(config, "apply_root")
+	config["gem_binary"] = "/opt/ruby/bin/gem"
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.ensurePrerequisite(testUi(), "ruby", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Command != "command -v /opt/ruby/bin/gem" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerUpdatePackageCache(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["update_package_cache"] = true
+	config["install_method"] = []string{"gem"}
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(countingCommunicator)
+	if err := p.Install(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Updating the cache, checking for gem and installing
+	if comm.starts != 3 {
+		t.Fatalf("bad: %d", comm.starts)
+	}
+
+	command := packageCacheUpdateCommand()
+	for _, expected := range []string{"then apt-get update; ", "then yum makecache; ", "else exit 1; fi'"} {
+		if !strings.Contains(command, expected) {
+			t.Fatalf("bad: %s", command)
+		}
+	}
+
+	config["guest_os_type"] = "windows"
+	delete(config, "install_method")
+	var w Provisioner
+	if err := w.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
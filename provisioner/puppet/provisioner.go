@@ -4,16 +4,25 @@ package puppet
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"github.com/mitchellh/iochan"
-	"github.com/mitchellh/mapstructure"
+	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/packer"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 const (
@@ -21,158 +30,2570 @@ const (
 	DefaultModulePath   = "modules"
 	DefaultManifestPath = "manifests"
 	DefaultManifestFile = "site.pp"
+	DefaultEnvironment  = "production"
+
+	DefaultMaxLineLength = 8192
+
+	DefaultInstallRetryDelay = "10s"
+	DefaultCertWaitTimeout   = "10m"
+	DefaultUploadRetryDelay  = "5s"
+
+	AgentServiceName = "puppet"
+
+	PauseUntilEnter = "until-enter"
+
+	OutputShow  = "show"
+	OutputQuiet = "quiet"
+
+	DefaultExecuteCommand            = "{{.FacterVars}}{{if .PuppetBinDir}}{{.PuppetBinDir}}/{{end}}puppet apply --verbose {{if .Certname}}--certname={{quote .Certname}} {{end}}{{if .NodeNameValue}}--node_name_value={{quote .NodeNameValue}} {{end}}{{if .HieraConfigPath}}--hiera_config={{quote .HieraConfigPath}} {{end}}--modulepath={{quote .Modulepath}} {{quote .Manifest}}"
+	DefaultEnvironmentExecuteCommand = "{{.FacterVars}}{{if .PuppetBinDir}}{{.PuppetBinDir}}/{{end}}puppet apply --verbose {{if .Certname}}--certname={{quote .Certname}} {{end}}{{if .NodeNameValue}}--node_name_value={{quote .NodeNameValue}} {{end}}{{if .HieraConfigPath}}--hiera_config={{quote .HieraConfigPath}} {{end}}--environmentpath={{quote .EnvironmentPath}} --environment={{quote .Environment}} {{quote .Manifest}}"
+	DefaultAgentExecuteCommand       = "{{.FacterVars}}{{if .PuppetBinDir}}{{.PuppetBinDir}}/{{end}}puppet agent --onetime --no-daemonize --detailed-exitcodes --verbose {{if .Certname}}--certname={{quote .Certname}} {{end}}{{if .NodeNameValue}}--node_name_value={{quote .NodeNameValue}} {{end}}--server={{quote .PuppetServer}}{{if .PuppetServerPort}} --{{.ServerPortSetting}}={{.PuppetServerPort}}{{end}}{{if .Environment}} --environment={{quote .Environment}}{{end}}{{if .WaitForCert}} --waitforcert={{.WaitForCert}}{{end}}"
+	DefaultInstallVerifyCommand      = "{{if .PuppetBinDir}}{{.PuppetBinDir}}/{{end}}puppet --version"
+
+	DefaultElevatedCommand         = "sudo {{if .User}}-u {{.User}} {{end}}-E {{.Command}}"
+	DefaultPasswordElevatedCommand = "sudo -S -p '' {{if .User}}-u {{.User}} {{end}}-E {{.Command}}"
+	DefaultSuElevatedCommand       = "su -m {{if .User}}{{.User}}{{else}}root{{end}} -c {{.QuotedCommand}}"
+
+	// passwordElevatedPrefix is how commands elevated with
+	// DefaultPasswordElevatedCommand start.
+	passwordElevatedPrefix = "sudo -S "
+
+	DefaultDscWmfVersion      = "5.0"
+	DefaultDscExecutionPolicy = "RemoteSigned"
+)
+
+// Results an exit code of the execute command can be mapped to.
+const (
+	ExitCodeSuccess = "success"
+	ExitCodeChanged = "changed"
+	ExitCodeFailure = "failure"
+)
+
+type config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	masterlessConfig `mapstructure:",squash"`
+	agentConfig      `mapstructure:",squash"`
+
+	// Family of the guest operating system, "unix" or "windows". It drives
+	// the remote path and command conventions. Defaults to "unix".
+	GuestOSType string `mapstructure:"guest_os_type"`
+
+	// Remote directory where files are staged. Defaults to a temporary
+	// directory suited to the guest operating system.
+	StagingDir string `mapstructure:"staging_directory"`
+
+	// Remote directory containing the puppet executable. Defaults to the
+	// conventional location for the guest operating system.
+	PuppetBinDir string `mapstructure:"puppet_bin_dir"`
+
+	// If true, fails when the modules paths contain nested version control
+	// checkouts or empty directories, instead of only warning about them,
+	// since they usually mean that git submodules weren't updated.
+	StrictSources bool `mapstructure:"strict_sources"`
+
+	// If true, each directory is uploaded as a single compressed tar archive
+	// that is extracted on the remote machine, instead of file by file,
+	// which is much faster for large module trees. It requires tar and
+	// gzip on the remote machine, and falls back to uploading file by file
+	// with a warning without them. Unix only.
+	UploadArchive bool `mapstructure:"upload_archive"`
+
+	// Compression of the archives uploaded with upload_archive: "gzip",
+	// "zstd" or "none". zstd needs the zstd command locally, and falls
+	// back to gzip with a warning if the remote machine lacks it.
+	// Defaults to "gzip".
+	Compression string `mapstructure:"compression"`
+
+	// If true, the archives of upload_archive are streamed to the
+	// standard input of tar on the remote machine instead of being
+	// uploaded to a file first, which halves the disk space needed. The
+	// communicator must support standard input, and failed uploads
+	// aren't retried.
+	StreamArchive bool `mapstructure:"stream_archive"`
+
+	// Local directory in which upload archives and downloaded module
+	// bundles are written before being uploaded. Defaults to TMPDIR, or
+	// to the default temporary directory of the OS.
+	LocalTempDir string `mapstructure:"local_temp_dir"`
+
+	// How symbolic links within uploaded directories are handled:
+	// "follow" uploads what they point to, "skip" ignores them and
+	// "recreate" creates the same links remotely. Links looping back to
+	// a directory being uploaded are skipped when following them.
+	// Defaults to "follow".
+	SymlinkMode string `mapstructure:"symlink_mode"`
+
+	// Number of times a failed upload is retried, and the delay before
+	// the first retry, such as "5s". The delay doubles with each retry.
+	// They default to no retries and "5s".
+	UploadRetries       int    `mapstructure:"upload_retries"`
+	RawUploadRetryDelay string `mapstructure:"upload_retry_delay"`
+	uploadRetryDelay    time.Duration
+
+	// Maximum rate of the uploads, in bytes per second, shared by all
+	// uploads running at once. Defaults to no limit.
+	UploadBandwidthLimit int `mapstructure:"upload_bandwidth_limit"`
+	uploadLimiter        *rateLimiter
+
+	// Maximum total size, in bytes, of the files staged on the remote
+	// machine. Staging fails before uploading anything if the modules,
+	// manifests or environment are larger, which usually means one of
+	// their paths is wrong. Defaults to no limit.
+	MaxUploadSize int64 `mapstructure:"max_upload_size"`
+
+	// If true, files with the same contents, such as those of modules
+	// vendored in several modules paths, are only uploaded once and
+	// copied remotely for the other paths.
+	DeduplicateUploads bool `mapstructure:"deduplicate_uploads"`
+
+	// Persistent remote directory, outside of the staging directory, in
+	// which uploaded files are kept by the checksum of their contents.
+	// Files already in it, such as from a previous build on a long-lived
+	// machine, aren't uploaded again but copied from it. Unix only.
+	RemoteCacheDir string `mapstructure:"remote_cache_directory"`
+
+	// If true, the checksums of the uploaded files are verified on the
+	// remote machine with sha256sum, failing on any mismatch. Unix only.
+	VerifyUploads bool `mapstructure:"verify_uploads"`
+
+	// Number of files uploaded at once when directories are uploaded
+	// file by file, because the communicator can't upload them whole.
+	// Defaults to 1.
+	UploadConcurrency int `mapstructure:"upload_concurrency"`
+
+	// If true, a manifest of the checksums of the uploaded files is kept
+	// in the staging directory, and only the files that changed since are
+	// uploaded again. This speeds up repeated runs against the same
+	// machine, and requires clean_staging_directory to be false.
+	IncrementalUpload bool `mapstructure:"incremental_upload"`
+
+	// Remote directories created before anything is uploaded, for
+	// catalogs that expect them to exist with a given mode and owner.
+	RemoteDirectories []RemoteDirectory `mapstructure:"remote_directories"`
+
+	// Name of the environment Puppet runs in. Defaults to "production",
+	// except in agent mode where it defaults to the environment the
+	// agent is assigned by its configuration or by the server.
+	Environment string `mapstructure:"environment"`
+
+	// Settings of the directory environment, once overrides are applied.
+	environmentConf map[string]string
+
+	// Certname Puppet is run with, in apply and agent modes, so that the
+	// node definitions and the Hiera data of the node match regardless of
+	// the name of the build machine.
+	Certname string `mapstructure:"certname"`
+
+	// Node name the catalog is compiled for, passed as the node_name_value
+	// setting of Puppet, so that a logical name such as
+	// webserver.prod.example.com is classified regardless of the certname
+	// and hostname of the build machine. In agent mode, the auth.conf of
+	// puppet_server must allow the certname to request that node.
+	NodeNameValue string `mapstructure:"node_name_value"`
+
+	// Option to avoid elevating privileges when executing commands.
+	// Defaults to false.
+	PreventSudo bool `mapstructure:"prevent_sudo"`
+
+	// Whether to elevate privileges when installing Puppet and its
+	// prerequisites, and for everything else, from configuring and running
+	// Puppet to cleaning up, respectively. Both default to the opposite of
+	// prevent_sudo.
+	InstallSudo bool `mapstructure:"install_sudo"`
+	RunSudo     bool `mapstructure:"run_sudo"`
+
+	// If true, removes the staging directory, and with it the uploaded
+	// modules and manifests, after a successful run. Defaults to true.
+	CleanStagingDir bool `mapstructure:"clean_staging_directory"`
+
+	// Template used to run the install and Puppet commands with elevated
+	// privileges, with the wrapped command available as {{.Command}} and
+	// the target user, if any, as {{.User}}. {{.QuotedCommand}} is the
+	// command quoted as a single shell word. Defaults to sudo, or to su
+	// on machines without sudo.
+	ElevatedCommand string `mapstructure:"elevated_command"`
+
+	// If true, the default elevated command falls back to su when the
+	// remote machine doesn't have sudo.
+	suFallback bool
+
+	// Password fed to sudo on standard input, for machines that don't
+	// allow passwordless sudo. It is never shown in the output, and can't
+	// be used with a custom elevated_command.
+	SudoPassword string `mapstructure:"sudo_password"`
+
+	// Values, such as tokens given to the manifests, that are masked in
+	// the logged commands and in the output of the commands, along with
+	// the sudo and proxy passwords.
+	SensitiveValues []string `mapstructure:"sensitive_values"`
+
+	// Remote user to run Puppet as, instead of root.
+	RunAsUser string `mapstructure:"run_as_user"`
+
+	// User and password of a scheduled task Puppet is run in, with the
+	// highest privileges, on Windows guests whose WinRM sessions lack the
+	// privileges Puppet needs. Windows only.
+	ElevatedUser     string `mapstructure:"elevated_user"`
+	ElevatedPassword string `mapstructure:"elevated_password"`
+
+	// Facts given to Puppet, by name. A value is either the value of the
+	// fact or an object such as {"type": "command", "command": "git
+	// rev-parse HEAD"}, whose command is run on the machine running
+	// Packer before the Puppet run and whose output is the value.
+	Facter map[string]interface{} `mapstructure:"facter"`
+
+	// Facts whose values may be nested arrays and objects, which FACTER_
+	// environment variables can't carry. They are written as JSON into
+	// facts_directory, which defaults to the directory of the external
+	// facts of Facter on the guest, and removed again during cleanup.
+	StructuredFacts map[string]interface{} `mapstructure:"structured_facts"`
+	FactsDir        string                 `mapstructure:"facts_directory"`
+
+	// Names of facts of facter or structured_facts whose values, or the
+	// outputs of their commands, are masked like sensitive_values.
+	SensitiveFacts []string `mapstructure:"sensitive_facts"`
+
+	// Local path of a script installed as the trusted_external_command
+	// of puppet.conf, so that trusted.external data is available to the
+	// manifests. It's installed as an executable at
+	// remote_trusted_external_command, which defaults to
+	// /etc/puppetlabs/puppet/trusted-external-command. Unix only.
+	TrustedExternalCommand       string `mapstructure:"trusted_external_command"`
+	RemoteTrustedExternalCommand string `mapstructure:"remote_trusted_external_command"`
+
+	// Report processors set in puppet.conf, such as "http" or "foreman",
+	// so that the runs of the build publish their reports to existing
+	// dashboards. puppetdb is added along when puppetdb_conf_path is
+	// set. report_url is the URL the http processor posts to, and
+	// report_server and report_port the server agents send their reports
+	// to, which default to puppet_server.
+	Reports      []string `mapstructure:"reports"`
+	ReportURL    string   `mapstructure:"report_url"`
+	ReportServer string   `mapstructure:"report_server"`
+	ReportPort   int      `mapstructure:"report_port"`
+
+	// URL of a Foreman server the build machine is registered with before
+	// the run, under node_name_value or its certname, and deleted from
+	// after it, so that Foreman can classify it as an ENC. The API is
+	// authenticated with foreman_username and foreman_password, and
+	// trusted with the CA certificate of foreman_ca_cert_path, if set,
+	// or else the CA certificates of the build machine.
+	// foreman_host_attributes are attributes of the host, such as
+	// "hostgroup_id" or "organization_id".
+	ForemanURL            string                 `mapstructure:"foreman_url"`
+	ForemanUsername       string                 `mapstructure:"foreman_username"`
+	ForemanPassword       string                 `mapstructure:"foreman_password"`
+	ForemanCACertPath     string                 `mapstructure:"foreman_ca_cert_path"`
+	ForemanHostAttributes map[string]interface{} `mapstructure:"foreman_host_attributes"`
+
+	// Template of the command used to run Puppet. Defaults to a
+	// "puppet apply" of the manifest file suited to the guest. Values
+	// can be quoted for the guest with {{quote .Manifest}}. The facts of
+	// the build, such as packer_builder_type, are set in the environment
+	// of the command by prefixing it with {{.FacterVars}}.
+	ExecuteCommand string `mapstructure:"execute_command"`
+
+	// Maps exit codes of the execute command to "success", "changed" or
+	// "failure", for wrappers that don't follow Puppet's conventions.
+	// Unmapped non-zero codes are failures. Defaults to {"0": "success"}.
+	ExitCodeMap map[string]string `mapstructure:"exit_code_map"`
+
+	exitCodes map[int]string
+
+	// If true, skips installing Puppet. Defaults to false.
+	SkipInstall bool `mapstructure:"skip_install"`
+
+	// Version of Puppet to install, such as "3.3.1". Defaults to the
+	// latest version available to the install method. When set, the
+	// version on the remote machine is verified before running Puppet,
+	// even with skip_install.
+	Version string `mapstructure:"version"`
+
+	// Oldest version of Puppet the manifests work with, such as "3.2".
+	// The version on the remote machine is checked against it before
+	// anything is uploaded.
+	MinimumVersion string `mapstructure:"minimum_version"`
+
+	// Version of Facter that the "gem" install method installs before
+	// Puppet, such as "2.4.6". When set, the version of Facter on the
+	// remote machine is verified before running Puppet.
+	FacterVersion string `mapstructure:"facter_version"`
+
+	// Oldest version of Facter the manifests work with, such as "2.0".
+	// The version on the remote machine is checked against it before
+	// anything is uploaded.
+	MinimumFacterVersion string `mapstructure:"minimum_facter_version"`
+
+	// Puppet collection whose repositories the "apt", "yum" and
+	// "zypper" install methods set up, and whose packages the "pkg" and
+	// "dmg" methods install: "puppet7", "puppet8" or "nightly". Defaults
+	// to the latest release. When set, the install methods default to
+	// the all-in-one ones, and with skip_install puppet_bin_dir defaults
+	// to the all-in-one packages location.
+	PuppetCollection string `mapstructure:"puppet_collection"`
+
+	// If true, uninstalls Puppet after a successful run, if it was
+	// installed by this provisioner. Defaults to false.
+	RemovePuppet bool `mapstructure:"remove_puppet"`
+
+	// If true, stops and disables the Puppet agent service after the
+	// install step, so that the image doesn't contact a Puppet master on
+	// boot. Defaults to false.
+	DisableAgentService bool `mapstructure:"disable_agent_service"`
+
+	// Ordered list of methods to try when installing Puppet. The first
+	// one that succeeds wins. "native" stands for the methods installing
+	// the packages of the distribution, and "aio-repo" for those setting
+	// up the Puppet Labs repositories. Defaults to the methods suited to
+	// the operating system of the remote machine, or ["package", "gem"]
+	// if it isn't recognized. Windows guests install the puppet-agent
+	// MSI with "msi".
+	InstallMethod []string `mapstructure:"install_method"`
+
+	// If true, the install methods are chosen by probing the remote
+	// machine.
+	detectInstallMethod bool
+
+	// Number of times a failed install command is retried, for flaky
+	// mirrors, and the delay before the first retry, such as "10s". The
+	// delay doubles with each retry. They default to no retries and "10s".
+	InstallRetries       int    `mapstructure:"install_retries"`
+	RawInstallRetryDelay string `mapstructure:"install_retry_delay"`
+	installRetryDelay    time.Duration
+
+	// If true, tools the provisioner needs, such as ruby for the gem
+	// install methods, are installed with the package manager of the
+	// remote machine when missing.
+	InstallPrerequisites bool `mapstructure:"install_prerequisites"`
+
+	// If true, the package indexes of the remote machine are refreshed,
+	// with apt-get update or yum makecache for instance, before
+	// installing Puppet.
+	UpdatePackageCache bool `mapstructure:"update_package_cache"`
+
+	// Template of the command run after installing Puppet to check that
+	// it works. The provisioner fails with its output if it exits with a
+	// non-zero status. Defaults to "puppet --version", and can be set to
+	// "" to skip the check.
+	InstallVerifyCommand string `mapstructure:"install_verify_command"`
+
+	// Proxy settings exported to the commands installing Puppet. Proxy
+	// passwords are never shown in the output.
+	HTTPProxy  string `mapstructure:"http_proxy"`
+	HTTPSProxy string `mapstructure:"https_proxy"`
+	NoProxy    string `mapstructure:"no_proxy"`
+
+	// URL of the bootstrap script run by the "script" install method,
+	// such as Puppet's install.sh, the SHA256 checksum it must have, and
+	// the arguments it is given.
+	BootstrapScriptURL    string   `mapstructure:"bootstrap_script_url"`
+	BootstrapScriptSHA256 string   `mapstructure:"bootstrap_script_sha256"`
+	BootstrapScriptArgs   []string `mapstructure:"bootstrap_script_args"`
+
+	// Fingerprint of the GPG key the Puppet packages and repositories
+	// must be signed with. When set, the apt, yum and zypper install
+	// methods and .rpm packages are verified with it, and the install
+	// fails on a mismatch.
+	GPGKeyFingerprint string `mapstructure:"gpg_key_fingerprint"`
+
+	// Local path of a file holding the GPG key, uploaded to the remote
+	// machine. Without it, the key is fetched by its fingerprint from
+	// the keyserver, which defaults to "hkps://keyserver.ubuntu.com".
+	GPGKeyPath   string `mapstructure:"gpg_key_path"`
+	GPGKeyserver string `mapstructure:"gpg_keyserver"`
+
+	// Local path of a puppet-agent .deb, .rpm or .msi package, or of a
+	// puppet .gem, uploaded and installed instead of using the install
+	// methods.
+	LocalPackagePath string `mapstructure:"local_package_path"`
+
+	// Local directory of .gem files holding puppet and all of its
+	// dependencies, uploaded and installed without network access.
+	GemBundlePath string `mapstructure:"gem_bundle_path"`
+
+	// Path of the gem executable used by the gem install methods.
+	// Defaults to "gem".
+	GemBinary string `mapstructure:"gem_binary"`
+
+	// Extra flags given to gem install.
+	GemFlags []string `mapstructure:"gem_flags"`
+
+	// If true, gem install is given --no-document instead of the
+	// --no-ri and --no-rdoc flags that RubyGems 2 removed.
+	GemNoDocument bool `mapstructure:"gem_no_document"`
+
+	// If true, gem commands run through a bash login shell, so that
+	// rubies managed by rvm or rbenv are found.
+	GemLoginShell bool `mapstructure:"gem_login_shell"`
+
+	// Local path of a gem signing certificate added to the trusted
+	// certificates before installing with the "gem" install method.
+	GemCertPath string `mapstructure:"gem_cert_path"`
+
+	// Trust policy given to gem install, such as "HighSecurity".
+	// Defaults to gem's own default, which doesn't check signatures.
+	GemTrustPolicy string `mapstructure:"gem_trust_policy"`
+
+	// If true, make sure the prerequisites of the DSC-wrapping modules
+	// (puppetlabs-dsc, dsc_lite) are satisfied on Windows guests before
+	// running Puppet.
+	DscPrerequisites bool `mapstructure:"dsc_prerequisites"`
+
+	// Minimum Windows Management Framework version required by the
+	// DSC modules, such as "5.1". Defaults to "5.0".
+	DscWmfVersion string `mapstructure:"dsc_wmf_version"`
+
+	// PowerShell execution policy of the machine to set, with elevated
+	// privileges, before the run: one of dscExecutionPolicies. Defaults
+	// to "RemoteSigned".
+	DscExecutionPolicy string `mapstructure:"dsc_execution_policy"`
+
+	// Maximum duration of the Puppet run, such as "2h". DSC-backed
+	// catalogs can take a long time to apply. The build then fails, but
+	// the run isn't stopped on the remote machine, which keeps applying
+	// the catalog until the machine is torn down. Defaults to no timeout.
+	RawDscApplyTimeout string `mapstructure:"dsc_apply_timeout"`
+
+	// How long to keep the machine alive after a failed Puppet run, for
+	// debugging, such as "30m". "until-enter" waits for enter to be
+	// pressed instead. Defaults to not pausing.
+	RawPauseOnFailure string `mapstructure:"pause_on_failure"`
+
+	// Remote path of a file to which every command executed by the
+	// provisioner is appended, with a timestamp. Empty disables it. Only
+	// supported on unix guests.
+	AuditLog string `mapstructure:"audit_log"`
+
+	// Local path of a JSON file describing the Puppet invocation: the
+	// final command line and the remote paths it uses. Empty disables it.
+	InvocationFile string `mapstructure:"invocation_file"`
+
+	// Configuration version recorded in the invocation file and shown
+	// after the run. Defaults to the output of the config_version command
+	// of the directory environment, if it defines one.
+	ConfigVersion string `mapstructure:"config_version"`
+
+	// Maximum length of a line of command output. Longer lines are split
+	// into several lines with a continuation marker. Defaults to 8192.
+	MaxLineLength int `mapstructure:"max_line_length"`
+
+	// Where the output of the commands installing Puppet and of the
+	// Puppet run goes: "show" streams it to the console, "quiet" only
+	// writes it to the Packer log. Both default to "show".
+	InstallOutput string `mapstructure:"install_output"`
+	RunOutput     string `mapstructure:"run_output"`
+
+	// Values that must never be shown in logs or written to the image.
+	secrets []string
+
+	// Random identifier of the build, given to Puppet as a fact.
+	buildUUID string
+
+	// The facts of facter given as is, and the commands of those that
+	// are the output of a command.
+	facts        map[string]string
+	factCommands map[string]string
+
+	dscApplyTimeout time.Duration
+	certWaitTimeout time.Duration
+	pauseOnFailure  time.Duration
+	guest           *guestOS
+}
+
+// masterlessConfig holds the settings of puppet apply, which only the
+// puppet provisioner accepts.
+type masterlessConfig struct {
+	// Local path of modules to upload. Deprecated in favor of
+	// modules_paths, it is used as the first of the modules paths.
+	ModulePath string `mapstructure:"module_path"`
+
+	// An array of local paths of modules to upload. Each one is uploaded
+	// into its own remote directory and they are all given to Puppet, in
+	// order, as the module path. Paths matching the patterns of a
+	// .packerignore or .pupignore file at the root of a modules path,
+	// with the syntax of .gitignore, aren't uploaded. An entry of the
+	// form "name=path" is instead the directory of a single module,
+	// uploaded as the module of the given name. Defaults to ["modules"].
+	ModulesPaths []string `mapstructure:"modules_paths"`
+
+	// Local directory of Hiera data, uploaded along with a hiera.yaml
+	// generated from hiera_hierarchy that Puppet is run with. Each level
+	// of the hierarchy has a name and a path, or paths, relative to the
+	// Hiera data. The hierarchy defaults to a single "common.yaml".
+	HieraDataPath  string       `mapstructure:"hiera_data_path"`
+	HieraHierarchy []HieraLevel `mapstructure:"hiera_hierarchy"`
+
+	// An array of local directories of Hiera data, after hiera_data_path
+	// if set. Each one is uploaded into its own remote directory and is
+	// looked up with the whole hierarchy, in order, so that data of an
+	// earlier directory takes precedence over data of a later one.
+	HieraDataPaths []string `mapstructure:"hiera_data_paths"`
+
+	// Hiera data set from the template, such as versions or feature flags
+	// of the build. It's uploaded as packer_overrides.yaml, the first and
+	// so highest priority level of the hierarchy, and may be used with or
+	// without hiera_data_path.
+	HieraOverrides map[string]interface{} `mapstructure:"hiera_overrides"`
+
+	// Hiera keys that must resolve. Each one is looked up with puppet
+	// lookup, as Puppet is run, before the run so that a missing key fails
+	// the build with the keys at fault rather than in the middle of the
+	// catalog compilation.
+	RequiredHieraKeys []string `mapstructure:"required_hiera_keys"`
+
+	// Local paths of the PKCS7 keys of hiera-eyaml, to decrypt encrypted
+	// Hiera data. They are uploaded with 0600 permissions into
+	// eyaml_keys_directory, which defaults to a directory of the staging
+	// directory, and the Hiera data is then read with the eyaml backend.
+	// Unix only.
+	EyamlPrivateKeyPath string `mapstructure:"eyaml_private_key_path"`
+	EyamlPublicKeyPath  string `mapstructure:"eyaml_public_key_path"`
+	EyamlKeysDir        string `mapstructure:"eyaml_keys_directory"`
+
+	// URL of a tarball of modules, such as a bundle published by CI, and
+	// the SHA256 checksum it must have. It is downloaded, uploaded and
+	// extracted on the remote machine, and added to the module path
+	// after modules_paths. Besides http and https, s3://bucket/key and
+	// gs://bucket/object URLs are downloaded with the AWS or Google
+	// credentials of the environment, if any. Unix only.
+	ModulesURL    string `mapstructure:"modules_url"`
+	ModulesSHA256 string `mapstructure:"modules_sha256"`
+
+	// Remote directory where the filesystem of the image is mounted, for
+	// provisioning it without booting it. Files are staged beneath it and
+	// the install and Puppet commands are run chrooted into it, so any
+	// required pseudo-filesystems must already be mounted. Unix only.
+	ApplyRoot string `mapstructure:"apply_root"`
+
+	// Remote directory the modules are installed into, such as
+	// "/etc/puppetlabs/code/environments/production/modules". The contents
+	// of all modules paths are merged into it, in order. Defaults to a
+	// directory per modules path within the staging directory.
+	RemoteModulePath string `mapstructure:"remote_module_path"`
+
+	// Local path of a directory environment to upload, containing its own
+	// environment.conf, manifests and modules. Puppet is then run within
+	// that environment, honoring its environment.conf, instead of with the
+	// modules paths and manifest path.
+	EnvironmentPath string `mapstructure:"environment_path"`
+
+	// Settings overriding those of the environment.conf of the directory
+	// environment, such as "modulepath" or "config_version".
+	EnvironmentConf map[string]string `mapstructure:"environment_conf"`
+
+	// Path to the manifests
+	ManifestPath string `mapstructure:"manifest_path"`
+
+	// Manifest file
+	ManifestFile string `mapstructure:"manifest_file"`
+
+	// Local path of an External Node Classifier script, installed as an
+	// executable at remote_enc_path, which defaults to
+	// /etc/puppetlabs/puppet/enc, and set as the external_nodes of an exec
+	// node_terminus in puppet.conf, so that classification is exercised
+	// by puppet apply. Unix only.
+	ENCPath       string `mapstructure:"enc_path"`
+	RemoteENCPath string `mapstructure:"remote_enc_path"`
+
+	// Local paths of the puppetdb.conf, installed into the confdir of
+	// Puppet, and of the routes.yaml, installed at its route_file, with
+	// which puppet apply stores its exported resources and reports in
+	// PuppetDB. The PuppetDB termini are installed along, unless
+	// skip_puppetdb_termini_install is set. Unix only.
+	PuppetDBConfPath           string `mapstructure:"puppetdb_conf_path"`
+	PuppetDBRoutesPath         string `mapstructure:"puppetdb_routes_path"`
+	SkipPuppetDBTerminiInstall bool   `mapstructure:"skip_puppetdb_termini_install"`
+}
+
+// agentConfig holds the settings of puppet agent, which only the
+// puppet-server provisioner accepts.
+type agentConfig struct {
+	// Puppet server to provision against, which is required: instead of
+	// applying uploaded manifests, the agent is pointed at the server in
+	// puppet.conf and runs puppet agent once, so that the image is
+	// built from the catalog the server compiles. puppet_server_port
+	// defaults to the port of the Puppet configuration.
+	PuppetServer     string `mapstructure:"puppet_server"`
+	PuppetServerPort int    `mapstructure:"puppet_server_port"`
+
+	// Seconds between the checks of the agent for its certificate to be
+	// signed by the CA of puppet_server. When set, the agent gets its
+	// certificate with puppet ssl bootstrap before the run, and the build
+	// fails if it isn't signed within cert_wait_timeout, which defaults
+	// to 10 minutes. Before Puppet 7, puppet ssl bootstrap can't be told
+	// to give up, and keeps running on the remote machine after that.
+	WaitForCert        int    `mapstructure:"waitforcert"`
+	RawCertWaitTimeout string `mapstructure:"cert_wait_timeout"`
+
+	// Challenge password written into the csr_attributes.yaml of the
+	// agent, for policy-based autosigning of its certificate request.
+	// Unix only.
+	ChallengePassword string `mapstructure:"challenge_password"`
+
+	// If true, removes the ssldir of the agent after a successful run, so
+	// that the certificate and private key of the build aren't left in
+	// the image, along with the csr_attributes.yaml of
+	// challenge_password. Defaults to true.
+	CleanSSLDir bool `mapstructure:"clean_ssl_dir"`
+
+	// If true, revokes and removes the certificate of the agent with the
+	// CA API of puppet_server after a successful run, so that build
+	// machines don't pile up in the CA. The API is reached at ca_api_url,
+	// which defaults to https://puppet_server:puppet_server_port, and is
+	// authenticated with the RBAC token of ca_api_token or the client
+	// certificate of ca_api_cert_path and ca_api_key_path. The server is
+	// trusted with ca_cert_path, if set.
+	CleanNodeCertificate bool   `mapstructure:"clean_node_certificate"`
+	CAAPIURL             string `mapstructure:"ca_api_url"`
+	CAAPIToken           string `mapstructure:"ca_api_token"`
+	CAAPICertPath        string `mapstructure:"ca_api_cert_path"`
+	CAAPIKeyPath         string `mapstructure:"ca_api_key_path"`
+
+	// Local paths of a pre-issued certificate and private key of the
+	// agent, installed into its ssldir under its certname so that no
+	// certificate has to be signed during the build. Unix only.
+	ClientCertPath       string `mapstructure:"client_cert_path"`
+	ClientPrivateKeyPath string `mapstructure:"client_private_key_path"`
+
+	// Local path of the CA certificate of puppet_server, installed into
+	// the ssldir so that the agent trusts the server without downloading
+	// it. Unix only.
+	CACertPath string `mapstructure:"ca_cert_path"`
+
+	// Remote ssldir of the agent, set in puppet.conf and prepared before
+	// the run. Defaults to the ssldir of the Puppet configuration.
+	SSLDir string `mapstructure:"ssl_directory"`
+}
+
+// RemoteDirectory is a directory created on the remote machine before
+// the run. Mode and Owner are optional.
+type RemoteDirectory struct {
+	Path  string
+	Mode  string
+	Owner string
+}
+
+// Provisioner runs Puppet on a remote machine. Besides implementing
+// packer.Provisioner, it exposes each step of the provisioning (Install,
+// Stage, Run and Cleanup) so that it can be embedded in other tools.
+type Provisioner struct {
+	config config
+
+	// Ui of the step being run, to which command output is streamed.
+	ui packer.Ui
+
+	// If true, command output is only logged instead of being streamed
+	// to the Ui.
+	quiet bool
+
+	// Commands executed during the current run, kept for the audit log.
+	auditEntries []string
+
+	// Version of the Puppet on the remote machine, once checked for the
+	// settings of the agent.
+	agentVersion []int
+
+	// Install method that installed Puppet during the current run.
+	installedMethod string
+
+	// Remote paths of the files uploaded while staging, by the checksum
+	// of their contents, when deduplicating uploads.
+	uploadedFiles map[string]string
+
+	// Whether the remote machine has the tools to extract archives, and
+	// the compression they are uploaded with, once checked during the
+	// current run.
+	archiveChecked     bool
+	archiveSupported   bool
+	archiveCompression string
+}
+
+type DscPrerequisitesTemplate struct {
+	WmfVersion      string
+	ExecutionPolicy string
+}
+
+type ElevatedCommandTemplate struct {
+	Command       string
+	QuotedCommand string
+	User          string
+}
+
+type InstallVerifyTemplate struct {
+	PuppetBinDir string
+}
+
+type ExecuteManifestTemplate struct {
+	PuppetBinDir      string
+	Modulepath        string
+	Manifest          string
+	EnvironmentPath   string
+	Environment       string
+	HieraConfigPath   string
+	FacterVars        string
+	PuppetServer      string
+	PuppetServerPort  int
+	ServerPortSetting string
+	Certname          string
+	NodeNameValue     string
+	WaitForCert       int
+}
+
+// New returns a provisioner prepared with the given configurations, for
+// use outside of Packer.
+func New(raws ...interface{}) (*Provisioner, error) {
+	p := new(Provisioner)
+	if err := p.Prepare(raws...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// masterlessSettings and agentSettings are the keys of the settings that
+// only the puppet and puppet-server provisioners accept.
+var (
+	masterlessSettings = settingKeys(masterlessConfig{})
+	agentSettings      = settingKeys(agentConfig{})
 )
 
-var Ui packer.Ui
+// settingKeys returns the keys of the settings of a config struct.
+func settingKeys(v interface{}) map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0]
+		if key != "" {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// Prepare prepares the provisioner to apply uploaded manifests with
+// puppet apply.
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	return p.prepare(false, raws...)
+}
+
+// PrepareAgent prepares the provisioner to run the agent against
+// puppet_server, with the settings of the puppet-server provisioner
+// rather than those of puppet apply.
+func (p *Provisioner) PrepareAgent(raws ...interface{}) error {
+	return p.prepare(true, raws...)
+}
+
+func (p *Provisioner) prepare(agent bool, raws ...interface{}) error {
+	rejected, provisioner := agentSettings, "puppet-server"
+	if agent {
+		rejected, provisioner = masterlessSettings, "puppet"
+	}
+
+	defaults, err := readDefaults()
+	if err != nil {
+		return err
+	}
+
+	if defaults != nil {
+		// The defaults are shared by both provisioners, so the settings
+		// of the other one are ignored rather than rejected.
+		for key := range rejected {
+			delete(defaults, key)
+		}
+
+		raws = append([]interface{}{defaults}, raws...)
+	}
+
+	md, err := common.DecodeConfig(&p.config, raws...)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	decoded := make(map[string]bool)
+	for _, key := range md.Keys {
+		decoded[key] = true
+	}
+
+	keys := make([]string, 0)
+	for key := range decoded {
+		if rejected[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("%s is only supported by the %s provisioner", key, provisioner))
+	}
+
+	if agent && p.config.PuppetServer == "" {
+		errs = append(errs, fmt.Errorf("puppet_server must be specified"))
+	}
+
+	if !decoded["install_sudo"] {
+		p.config.InstallSudo = !p.config.PreventSudo
+	}
+
+	if !decoded["run_sudo"] {
+		p.config.RunSudo = !p.config.PreventSudo
+	}
+
+	if !decoded["clean_staging_directory"] {
+		p.config.CleanStagingDir = true
+	}
+
+	if p.config.GuestOSType == "" {
+		p.config.GuestOSType = GuestOSTypeUnix
+	}
+
+	var ok bool
+	p.config.guest, ok = guestOSTypes[strings.ToLower(p.config.GuestOSType)]
+	if !ok {
+		errs = append(errs, fmt.Errorf("Unknown guest_os_type: %s", p.config.GuestOSType))
+		p.config.guest = guestOSTypes[GuestOSTypeUnix]
+	}
+
+	if p.config.StagingDir == "" {
+		p.config.StagingDir = p.config.guest.StagingDir
+	}
+
+	if p.config.PuppetBinDir == "" {
+		p.config.PuppetBinDir = p.config.guest.PuppetBinDir
+		if p.config.PuppetCollection != "" && p.config.SkipInstall &&
+			p.config.guest == guestOSTypes[GuestOSTypeUnix] {
+			p.config.PuppetBinDir = AIOBinDir
+		}
+	}
+
+	if p.config.ModulePath != "" {
+		p.config.ModulesPaths = append([]string{p.config.ModulePath}, p.config.ModulesPaths...)
+	}
+
+	if p.config.Environment == "" && p.config.PuppetServer == "" {
+		p.config.Environment = DefaultEnvironment
+	}
+
+	if p.config.ClientCertPath != "" || p.config.ClientPrivateKeyPath != "" {
+		if p.config.ClientCertPath == "" || p.config.ClientPrivateKeyPath == "" {
+			errs = append(errs, fmt.Errorf("client_cert_path and client_private_key_path must be set together"))
+		}
+
+		for _, path := range []string{p.config.ClientCertPath, p.config.ClientPrivateKeyPath} {
+			if _, err := os.Stat(path); path != "" && err != nil {
+				errs = append(errs, fmt.Errorf("Bad client credentials path '%s': %s", path, err))
+			}
+		}
+
+	}
+
+	if p.config.CACertPath != "" {
+		if _, err := os.Stat(p.config.CACertPath); err != nil {
+			errs = append(errs, fmt.Errorf("Bad ca_cert_path '%s': %s", p.config.CACertPath, err))
+		}
+	}
+
+	for key, value := range map[string]string{
+		"client_cert_path": p.config.ClientCertPath,
+		"ca_cert_path":     p.config.CACertPath,
+		"ssl_directory":    p.config.SSLDir,
+	} {
+		if value != "" && p.config.guest.Chown == "" {
+			errs = append(errs, fmt.Errorf("%s isn't supported on %s guests", key, p.config.GuestOSType))
+		}
+	}
+
+	if p.config.PuppetServerPort < 0 || p.config.PuppetServerPort > 65535 {
+		errs = append(errs, fmt.Errorf("Bad puppet_server_port: %d", p.config.PuppetServerPort))
+	}
+
+	if p.config.EnvironmentPath != "" {
+		if len(p.config.ModulesPaths) > 0 || p.config.ManifestPath != "" {
+			errs = append(errs, fmt.Errorf(
+				"environment_path can't be used with modules_paths or manifest_path"))
+		}
+
+		p.config.environmentConf, err = readEnvironmentConf(p.config.EnvironmentPath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error reading %s: %s", EnvironmentConfFile, err))
+		}
+	} else if p.config.PuppetServer == "" {
+		if len(p.config.ModulesPaths) == 0 {
+			p.config.ModulesPaths = []string{DefaultModulePath}
+		}
+
+		if p.config.ManifestPath == "" {
+			p.config.ManifestPath = DefaultManifestPath
+		}
+
+		if p.config.ManifestFile == "" {
+			p.config.ManifestFile = DefaultManifestFile
+		}
+
+		if len(p.config.EnvironmentConf) > 0 {
+			errs = append(errs, fmt.Errorf("environment_conf requires environment_path"))
+		}
+	}
+
+	for k, v := range p.config.EnvironmentConf {
+		if !environmentConfSettings[k] {
+			errs = append(errs, fmt.Errorf("Unknown environment_conf setting: %s", k))
+		}
+
+		if p.config.environmentConf != nil {
+			p.config.environmentConf[k] = v
+		}
+	}
+
+	if p.config.MaxLineLength == 0 {
+		p.config.MaxLineLength = DefaultMaxLineLength
+	}
+
+	if p.config.MaxLineLength < 16 {
+		errs = append(errs, fmt.Errorf("max_line_length must be at least 16"))
+	}
+
+	if p.config.InstallOutput == "" {
+		p.config.InstallOutput = OutputShow
+	}
+
+	if p.config.RunOutput == "" {
+		p.config.RunOutput = OutputShow
+	}
+
+	for key, value := range map[string]string{
+		"install_output": p.config.InstallOutput,
+		"run_output":     p.config.RunOutput,
+	} {
+		if value != OutputShow && value != OutputQuiet {
+			errs = append(errs, fmt.Errorf("%s must be \"%s\" or \"%s\"", key, OutputShow, OutputQuiet))
+		}
+	}
+
+	if p.config.ElevatedCommand == "" {
+		p.config.ElevatedCommand = p.config.guest.ElevatedCommand
+		if p.config.SudoPassword != "" {
+			p.config.ElevatedCommand = p.config.guest.PasswordElevatedCommand
+		}
+
+		p.config.suFallback = p.config.SudoPassword == "" && p.config.guest.SuElevatedCommand != ""
+	}
+
+	if p.config.RunAsUser != "" && !p.config.RunSudo {
+		errs = append(errs, fmt.Errorf("run_as_user requires run_sudo"))
+	}
+
+	if p.config.SudoPassword != "" {
+		p.config.secrets = append(p.config.secrets, p.config.SudoPassword)
+
+		// Only sudo -S is known to consume the password, which would
+		// otherwise be given to the elevated command itself.
+		if decoded["elevated_command"] {
+			errs = append(errs, fmt.Errorf("sudo_password can't be used with a custom elevated_command"))
+		}
+
+		if p.config.guest.PasswordElevatedCommand != DefaultPasswordElevatedCommand {
+			errs = append(errs, fmt.Errorf("sudo_password isn't supported on %s guests", p.config.GuestOSType))
+		}
+	}
+
+	if p.config.ElevatedUser != "" || p.config.ElevatedPassword != "" {
+		if p.config.ElevatedUser == "" || p.config.ElevatedPassword == "" {
+			errs = append(errs, fmt.Errorf("elevated_user and elevated_password must be set together"))
+		}
+
+		if p.config.guest != guestOSTypes[GuestOSTypeWindows] {
+			errs = append(errs, fmt.Errorf("elevated_user requires a windows guest_os_type"))
+		}
+
+		if p.config.ElevatedPassword != "" {
+			p.config.secrets = append(p.config.secrets, p.config.ElevatedPassword)
+		}
+	}
+
+	p.config.secrets = append(p.config.secrets, p.config.SensitiveValues...)
+
+	for key, proxy := range map[string]string{
+		"http_proxy":  p.config.HTTPProxy,
+		"https_proxy": p.config.HTTPSProxy,
+	} {
+		if proxy == "" {
+			continue
+		}
+
+		u, err := url.Parse(proxy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Bad %s: %s", key, err))
+			continue
+		}
+
+		if u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				p.config.secrets = append(p.config.secrets, password)
+			}
+		}
+	}
+
+	if _, err := template.New("elevated-command").Parse(p.config.ElevatedCommand); err != nil {
+		errs = append(errs, fmt.Errorf("Error parsing elevated_command: %s", err))
+	}
+
+	if p.config.ExecuteCommand == "" {
+		p.config.ExecuteCommand = p.config.guest.ExecuteCommand
+		if p.config.EnvironmentPath != "" {
+			p.config.ExecuteCommand = p.config.guest.EnvironmentExecuteCommand
+		}
+		if p.config.PuppetServer != "" {
+			p.config.ExecuteCommand = p.config.guest.AgentExecuteCommand
+		}
+	}
+
+	if _, err := p.executeTemplate("puppet-run").Parse(p.config.ExecuteCommand); err != nil {
+		errs = append(errs, fmt.Errorf("Error parsing execute_command: %s", err))
+	}
+
+	if p.config.FactsDir == "" {
+		p.config.FactsDir = p.config.guest.FactsDir
+	}
+
+	if p.config.TrustedExternalCommand != "" {
+		if _, err := os.Stat(p.config.TrustedExternalCommand); err != nil {
+			errs = append(errs, fmt.Errorf("Bad trusted_external_command '%s': %s", p.config.TrustedExternalCommand, err))
+		}
+
+		if p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+			errs = append(errs, fmt.Errorf("trusted_external_command isn't supported on %s guests", p.config.GuestOSType))
+		}
+
+		if p.config.RemoteTrustedExternalCommand == "" {
+			p.config.RemoteTrustedExternalCommand = DefaultTrustedExternalCommandPath
+		}
+	}
+
+	if p.config.ENCPath != "" {
+		if _, err := os.Stat(p.config.ENCPath); err != nil {
+			errs = append(errs, fmt.Errorf("Bad enc_path '%s': %s", p.config.ENCPath, err))
+		}
+
+		if p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+			errs = append(errs, fmt.Errorf("enc_path isn't supported on %s guests", p.config.GuestOSType))
+		}
+
+		if p.config.RemoteENCPath == "" {
+			p.config.RemoteENCPath = DefaultENCPath
+		}
+	}
+
+	if p.config.ForemanURL != "" {
+		if u, err := url.Parse(p.config.ForemanURL); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("Bad foreman_url '%s'", p.config.ForemanURL))
+		}
+
+		if p.config.ForemanUsername == "" || p.config.ForemanPassword == "" {
+			errs = append(errs, fmt.Errorf("foreman_url requires foreman_username and foreman_password"))
+		}
+	} else if p.config.ForemanUsername != "" || p.config.ForemanPassword != "" ||
+		p.config.ForemanCACertPath != "" || len(p.config.ForemanHostAttributes) > 0 {
+		errs = append(errs, fmt.Errorf("foreman_username, foreman_password, foreman_ca_cert_path and foreman_host_attributes require foreman_url"))
+	}
+
+	if p.config.ForemanCACertPath != "" {
+		if _, err := os.Stat(p.config.ForemanCACertPath); err != nil {
+			errs = append(errs, fmt.Errorf("Bad foreman_ca_cert_path '%s': %s", p.config.ForemanCACertPath, err))
+		}
+	}
+
+	if p.config.ForemanPassword != "" {
+		p.config.secrets = append(p.config.secrets, p.config.ForemanPassword)
+	}
+
+	for _, processor := range p.config.Reports {
+		if !reportProcessorRegexp.MatchString(processor) {
+			errs = append(errs, fmt.Errorf("reports: bad report processor '%s'", processor))
+		}
+	}
+
+	if p.config.ReportURL != "" {
+		if _, err := url.Parse(p.config.ReportURL); err != nil {
+			errs = append(errs, fmt.Errorf("Bad report_url '%s': %s", p.config.ReportURL, err))
+		}
+	}
+
+	if p.config.ReportPort < 0 || p.config.ReportPort > 65535 {
+		errs = append(errs, fmt.Errorf("report_port must be between 0 and 65535"))
+	} else if p.config.ReportPort != 0 && p.config.ReportServer == "" {
+		errs = append(errs, fmt.Errorf("report_port requires report_server"))
+	}
+
+	if p.config.PuppetDBConfPath != "" {
+		if p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+			errs = append(errs, fmt.Errorf("puppetdb_conf_path isn't supported on %s guests", p.config.GuestOSType))
+		}
+	} else if p.config.PuppetDBRoutesPath != "" {
+		errs = append(errs, fmt.Errorf("puppetdb_routes_path requires puppetdb_conf_path"))
+	}
+
+	for _, path := range []string{p.config.PuppetDBConfPath, p.config.PuppetDBRoutesPath} {
+		if _, err := os.Stat(path); path != "" && err != nil {
+			errs = append(errs, fmt.Errorf("Bad PuppetDB configuration path '%s': %s", path, err))
+		}
+	}
+
+	for name := range p.config.StructuredFacts {
+		if !factNameRegexp.MatchString(name) {
+			errs = append(errs, fmt.Errorf("structured_facts: bad fact name '%s'", name))
+		}
+	}
+
+	facts, factCommands, factErrs := parseFacts(p.config.Facter)
+	p.config.facts = facts
+	p.config.factCommands = factCommands
+	errs = append(errs, factErrs...)
+
+	for _, name := range p.config.SensitiveFacts {
+		if value, ok := facts[name]; ok {
+			p.config.secrets = append(p.config.secrets, value)
+		} else if value, ok := p.config.StructuredFacts[name]; ok {
+			p.config.secrets = append(p.config.secrets, factStrings(value)...)
+		} else if _, ok := factCommands[name]; !ok {
+			errs = append(errs, fmt.Errorf("sensitive_facts: unknown fact '%s'", name))
+		}
+	}
+
+	if uuid, err := newUUID(); err != nil {
+		errs = append(errs, fmt.Errorf("Error generating the build UUID: %s", err))
+	} else {
+		p.config.buildUUID = uuid
+	}
+
+	if !decoded["install_verify_command"] {
+		p.config.InstallVerifyCommand = p.config.guest.InstallVerifyCommand
+	}
+
+	if _, err := p.commandTemplate("install-verify").Parse(p.config.InstallVerifyCommand); err != nil {
+		errs = append(errs, fmt.Errorf("Error parsing install_verify_command: %s", err))
+	}
+
+	if p.config.ExitCodeMap == nil {
+		p.config.ExitCodeMap = map[string]string{"0": ExitCodeSuccess}
+		if p.config.PuppetServer != "" {
+			// The agent runs with --detailed-exitcodes
+			p.config.ExitCodeMap["2"] = ExitCodeChanged
+		}
+	}
+
+	p.config.exitCodes = make(map[int]string)
+	for code, result := range p.config.ExitCodeMap {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Bad exit code in exit_code_map: %s", code))
+			continue
+		}
+
+		switch result {
+		case ExitCodeSuccess, ExitCodeChanged, ExitCodeFailure:
+			p.config.exitCodes[n] = result
+		default:
+			errs = append(errs, fmt.Errorf(
+				"Bad result for exit code %d in exit_code_map: %s", n, result))
+		}
+	}
+
+	p.config.InstallMethod = expandInstallMethods(p.config.InstallMethod)
+	if len(p.config.InstallMethod) == 0 {
+		p.config.detectInstallMethod = p.config.LocalPackagePath == "" && p.config.GemBundlePath == "" &&
+			p.config.guest == guestOSTypes[GuestOSTypeUnix]
+		p.config.InstallMethod = DefaultInstallMethods
+		if p.config.PuppetCollection != "" {
+			p.config.InstallMethod = AIOInstallMethods
+		}
+		if p.config.guest == guestOSTypes[GuestOSTypeWindows] {
+			p.config.InstallMethod = WindowsInstallMethods
+		}
+	}
+
+	if p.config.PuppetCollection == "" {
+		p.config.PuppetCollection = DefaultPuppetCollection
+	}
+
+	if _, ok := puppetCollections[p.config.PuppetCollection]; !ok {
+		errs = append(errs, fmt.Errorf("Unknown puppet_collection: %s", p.config.PuppetCollection))
+	}
+
+	for _, method := range p.config.InstallMethod {
+		if _, ok := installMethods[method]; !ok {
+			errs = append(errs, fmt.Errorf("Unknown install method: %s", method))
+		}
+	}
+
+	if !p.config.SkipInstall {
+		errs = append(errs, p.installSettingsErrors(decoded)...)
+	}
+
+	if p.config.MinimumVersion != "" {
+		if _, err := parseVersion(p.config.MinimumVersion); err != nil {
+			errs = append(errs, fmt.Errorf("Bad minimum_version: %s", err))
+		}
+	}
+
+	if p.config.MinimumFacterVersion != "" {
+		if _, err := parseVersion(p.config.MinimumFacterVersion); err != nil {
+			errs = append(errs, fmt.Errorf("Bad minimum_facter_version: %s", err))
+		}
+	}
+
+	if p.config.LocalPackagePath != "" {
+		if _, err := os.Stat(p.config.LocalPackagePath); err != nil {
+			errs = append(errs, fmt.Errorf("Bad local_package_path '%s': %s", p.config.LocalPackagePath, err))
+		} else if _, ok := localPackageMethods[filepath.Ext(p.config.LocalPackagePath)]; !ok {
+			errs = append(errs, fmt.Errorf(
+				"local_package_path must be a .deb, .rpm, .gem or .msi file: %s", p.config.LocalPackagePath))
+		}
+	}
+
+	for _, method := range p.config.InstallMethod {
+		if method != "script" {
+			continue
+		}
+
+		u, err := url.Parse(p.config.BootstrapScriptURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf(
+				"The script install method requires an http or https bootstrap_script_url"))
+		}
+
+		if sum, err := hex.DecodeString(p.config.BootstrapScriptSHA256); err != nil || len(sum) != sha256.Size {
+			errs = append(errs, fmt.Errorf(
+				"The script install method requires a SHA256 bootstrap_script_sha256"))
+		}
+	}
+
+	if p.config.ModulesURL != "" {
+		u, err := url.Parse(p.config.ModulesURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "s3" && u.Scheme != "gs") {
+			errs = append(errs, fmt.Errorf("modules_url must be an http, https, s3 or gs URL"))
+		} else if (u.Scheme == "s3" || u.Scheme == "gs") && (u.Host == "" || len(u.Path) < 2) {
+			errs = append(errs, fmt.Errorf("modules_url must name a bucket and an object: %s", p.config.ModulesURL))
+		}
+
+		if sum, err := hex.DecodeString(p.config.ModulesSHA256); err != nil || len(sum) != sha256.Size {
+			errs = append(errs, fmt.Errorf("modules_url requires a SHA256 modules_sha256"))
+		}
+
+		if p.config.guest.Extract == "" {
+			errs = append(errs, fmt.Errorf("modules_url isn't supported on %s guests", p.config.GuestOSType))
+		}
+
+		if p.config.EnvironmentPath != "" {
+			errs = append(errs, fmt.Errorf("modules_url can't be set along with environment_path"))
+		}
+	}
+
+	if p.config.GemBinary == "" {
+		p.config.GemBinary = "gem"
+	}
+
+	if p.config.GPGKeyFingerprint != "" {
+		var ok bool
+		p.config.GPGKeyFingerprint, ok = normalizeFingerprint(p.config.GPGKeyFingerprint)
+		if !ok {
+			errs = append(errs, fmt.Errorf("Bad gpg_key_fingerprint: %s", p.config.GPGKeyFingerprint))
+		}
+	} else if p.config.GPGKeyPath != "" || p.config.GPGKeyserver != "" {
+		errs = append(errs, fmt.Errorf("gpg_key_path and gpg_keyserver require gpg_key_fingerprint"))
+	}
+
+	if p.config.GPGKeyPath != "" {
+		if _, err := os.Stat(p.config.GPGKeyPath); err != nil {
+			errs = append(errs, fmt.Errorf("Bad gpg_key_path '%s': %s", p.config.GPGKeyPath, err))
+		}
+	}
+
+	if p.config.GPGKeyserver == "" {
+		p.config.GPGKeyserver = DefaultGPGKeyserver
+	}
+
+	if p.config.GemBundlePath != "" {
+		gems, err := filepath.Glob(filepath.Join(p.config.GemBundlePath, "puppet-*.gem"))
+		if err != nil || len(gems) == 0 {
+			errs = append(errs, fmt.Errorf(
+				"gem_bundle_path must be a directory holding a puppet gem: %s", p.config.GemBundlePath))
+		}
+
+		if p.config.LocalPackagePath != "" {
+			errs = append(errs, fmt.Errorf("Only one of local_package_path and gem_bundle_path can be set"))
+		}
+	}
+
+	if p.config.GemCertPath != "" {
+		if _, err := os.Stat(p.config.GemCertPath); err != nil {
+			errs = append(errs, fmt.Errorf("Bad gem_cert_path '%s': %s", p.config.GemCertPath, err))
+		}
+	}
+
+	if p.config.GemTrustPolicy != "" && !gemTrustPolicies[p.config.GemTrustPolicy] {
+		errs = append(errs, fmt.Errorf("Unknown gem_trust_policy: %s", p.config.GemTrustPolicy))
+	}
+
+	switch p.config.SymlinkMode {
+	case "":
+		p.config.SymlinkMode = SymlinkModeFollow
+	case SymlinkModeFollow, SymlinkModeSkip:
+	case SymlinkModeRecreate:
+		if p.config.guest.Symlink == "" && !p.config.UploadArchive {
+			errs = append(errs, fmt.Errorf(
+				"symlink_mode %s isn't supported on %s guests", SymlinkModeRecreate, p.config.GuestOSType))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Unknown symlink_mode: %s", p.config.SymlinkMode))
+	}
+
+	if p.config.IncrementalUpload && p.config.UploadArchive {
+		errs = append(errs, fmt.Errorf("Only one of incremental_upload and upload_archive can be set"))
+	}
+
+	if p.config.DeduplicateUploads && (p.config.IncrementalUpload || p.config.UploadArchive) {
+		errs = append(errs, fmt.Errorf(
+			"deduplicate_uploads can't be set along with incremental_upload or upload_archive"))
+	}
+
+	if p.config.RemoteCacheDir != "" {
+		if p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+			errs = append(errs, fmt.Errorf("remote_cache_directory isn't supported on %s guests", p.config.GuestOSType))
+		}
+
+		if p.config.IncrementalUpload || p.config.UploadArchive || p.config.DeduplicateUploads {
+			errs = append(errs, fmt.Errorf("remote_cache_directory can't be set along with "+
+				"incremental_upload, upload_archive or deduplicate_uploads"))
+		}
+	}
+
+	if p.config.VerifyUploads && p.config.guest.VerifyChecksums == "" {
+		errs = append(errs, fmt.Errorf("verify_uploads isn't supported on %s guests", p.config.GuestOSType))
+	}
+
+	if p.config.UploadArchive && p.config.guest.Extract == "" {
+		errs = append(errs, fmt.Errorf("upload_archive isn't supported on %s guests", p.config.GuestOSType))
+	}
+
+	if p.config.LocalTempDir != "" {
+		if info, err := os.Stat(p.config.LocalTempDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("Bad local_temp_dir '%s': %s", p.config.LocalTempDir, err))
+		}
+	}
+
+	if p.config.StreamArchive && !p.config.UploadArchive {
+		errs = append(errs, fmt.Errorf("stream_archive requires upload_archive"))
+	} else if p.config.StreamArchive && p.config.guest.StreamExtract == "" {
+		errs = append(errs, fmt.Errorf("stream_archive isn't supported on %s guests", p.config.GuestOSType))
+	}
+
+	if p.config.Compression == "" {
+		p.config.Compression = CompressionGzip
+	}
+
+	if _, ok := archiveCompressions[p.config.Compression]; !ok {
+		errs = append(errs, fmt.Errorf("Unknown compression: %s", p.config.Compression))
+	} else if p.config.UploadArchive && p.config.Compression == CompressionZstd {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			errs = append(errs, fmt.Errorf("compression %s requires the zstd command: %s", CompressionZstd, err))
+		}
+	}
+
+	if p.config.UpdatePackageCache && p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+		errs = append(errs, fmt.Errorf("update_package_cache isn't supported on %s guests", p.config.GuestOSType))
+	}
+
+	if p.config.AuditLog != "" && p.config.guest != guestOSTypes[GuestOSTypeUnix] {
+		errs = append(errs, fmt.Errorf("audit_log isn't supported on %s guests", p.config.GuestOSType))
+	}
+
+	if p.config.DscPrerequisites && p.config.guest != guestOSTypes[GuestOSTypeWindows] {
+		errs = append(errs, fmt.Errorf("dsc_prerequisites requires a windows guest_os_type"))
+	}
+
+	if p.config.DscWmfVersion == "" {
+		p.config.DscWmfVersion = DefaultDscWmfVersion
+	}
+
+	if !wmfVersionRegexp.MatchString(p.config.DscWmfVersion) {
+		errs = append(errs, fmt.Errorf("Bad dsc_wmf_version '%s'", p.config.DscWmfVersion))
+	}
+
+	if p.config.DscExecutionPolicy == "" {
+		p.config.DscExecutionPolicy = DefaultDscExecutionPolicy
+	}
+
+	if !dscExecutionPolicies[p.config.DscExecutionPolicy] {
+		errs = append(errs, fmt.Errorf("Bad dsc_execution_policy '%s'", p.config.DscExecutionPolicy))
+	}
+
+	if !decoded["clean_ssl_dir"] {
+		p.config.CleanSSLDir = p.config.PuppetServer != ""
+	}
+
+	if p.config.CleanNodeCertificate && p.config.CAAPIToken == "" && p.config.CAAPICertPath == "" {
+		errs = append(errs, fmt.Errorf("clean_node_certificate requires ca_api_token or ca_api_cert_path"))
+	}
+
+	if (p.config.CAAPICertPath == "") != (p.config.CAAPIKeyPath == "") {
+		errs = append(errs, fmt.Errorf("ca_api_cert_path and ca_api_key_path must be set together"))
+	}
+
+	for _, path := range []string{p.config.CAAPICertPath, p.config.CAAPIKeyPath} {
+		if _, err := os.Stat(path); path != "" && err != nil {
+			errs = append(errs, fmt.Errorf("Bad CA API credentials path '%s': %s", path, err))
+		}
+	}
+
+	if p.config.CAAPIToken != "" {
+		p.config.secrets = append(p.config.secrets, p.config.CAAPIToken)
+	}
+
+	if p.config.WaitForCert < 0 {
+		errs = append(errs, fmt.Errorf("waitforcert must not be negative"))
+	}
+
+	if p.config.RawCertWaitTimeout == "" {
+		p.config.RawCertWaitTimeout = DefaultCertWaitTimeout
+	}
+
+	p.config.certWaitTimeout, err = time.ParseDuration(p.config.RawCertWaitTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing cert_wait_timeout: %s", err))
+	}
+
+	if p.config.ChallengePassword != "" {
+		p.config.secrets = append(p.config.secrets, p.config.ChallengePassword)
+		if p.config.guest.Chown == "" {
+			errs = append(errs, fmt.Errorf("challenge_password isn't supported on %s guests", p.config.GuestOSType))
+		}
+	}
+
+	if p.config.RawDscApplyTimeout != "" {
+		p.config.dscApplyTimeout, err = time.ParseDuration(p.config.RawDscApplyTimeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed parsing dsc_apply_timeout: %s", err))
+		}
+	}
+
+	if !decoded["upload_concurrency"] {
+		p.config.UploadConcurrency = 1
+	}
+
+	if p.config.UploadConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("upload_concurrency must be at least 1"))
+	}
+
+	if p.config.UploadBandwidthLimit < 0 {
+		errs = append(errs, fmt.Errorf("upload_bandwidth_limit can't be negative"))
+	} else if p.config.UploadBandwidthLimit > 0 {
+		p.config.uploadLimiter = newRateLimiter(p.config.UploadBandwidthLimit)
+	}
+
+	if p.config.MaxUploadSize < 0 {
+		errs = append(errs, fmt.Errorf("max_upload_size can't be negative"))
+	}
+
+	if p.config.UploadRetries < 0 {
+		errs = append(errs, fmt.Errorf("upload_retries can't be negative"))
+	}
+
+	if p.config.RawUploadRetryDelay == "" {
+		p.config.RawUploadRetryDelay = DefaultUploadRetryDelay
+	}
+
+	p.config.uploadRetryDelay, err = time.ParseDuration(p.config.RawUploadRetryDelay)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing upload_retry_delay: %s", err))
+	}
+
+	if p.config.InstallRetries < 0 {
+		errs = append(errs, fmt.Errorf("install_retries can't be negative"))
+	}
+
+	if p.config.RawInstallRetryDelay == "" {
+		p.config.RawInstallRetryDelay = DefaultInstallRetryDelay
+	}
+
+	p.config.installRetryDelay, err = time.ParseDuration(p.config.RawInstallRetryDelay)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing install_retry_delay: %s", err))
+	}
+
+	if p.config.RawPauseOnFailure != "" && p.config.RawPauseOnFailure != PauseUntilEnter {
+		p.config.pauseOnFailure, err = time.ParseDuration(p.config.RawPauseOnFailure)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed parsing pause_on_failure: %s", err))
+		}
+	}
+
+	for _, entry := range p.config.ModulesPaths {
+		_, path := splitModulesPath(entry)
+		pFileInfo, err := os.Stat(path)
+
+		if err != nil || !pFileInfo.IsDir() {
+			errs = append(errs, fmt.Errorf("Bad module path '%s': %s", path, err))
+		}
+	}
+
+	if p.config.HieraDataPath != "" {
+		p.config.HieraDataPaths = append([]string{p.config.HieraDataPath}, p.config.HieraDataPaths...)
+	}
+
+	if len(p.config.HieraDataPaths) > 0 {
+		for _, path := range p.config.HieraDataPaths {
+			if info, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf("Bad Hiera data path '%s': %s", path, err))
+			} else if !info.IsDir() {
+				errs = append(errs, fmt.Errorf("Hiera data path '%s' must be a directory", path))
+			}
+		}
+
+		if len(p.config.HieraHierarchy) == 0 {
+			p.config.HieraHierarchy = DefaultHieraHierarchy
+		}
+	} else if len(p.config.HieraHierarchy) > 0 {
+		errs = append(errs, fmt.Errorf("hiera_hierarchy requires hiera_data_path or hiera_data_paths"))
+	}
+
+	if p.config.EyamlPrivateKeyPath != "" || p.config.EyamlPublicKeyPath != "" {
+		if p.config.EyamlPrivateKeyPath == "" || p.config.EyamlPublicKeyPath == "" {
+			errs = append(errs, fmt.Errorf("eyaml_private_key_path and eyaml_public_key_path must be set together"))
+		}
+
+		for _, path := range []string{p.config.EyamlPrivateKeyPath, p.config.EyamlPublicKeyPath} {
+			if _, err := os.Stat(path); path != "" && err != nil {
+				errs = append(errs, fmt.Errorf("Bad eyaml key path '%s': %s", path, err))
+			}
+		}
+
+		if len(p.config.HieraDataPaths) == 0 {
+			errs = append(errs, fmt.Errorf("eyaml keys require hiera_data_path or hiera_data_paths"))
+		}
+
+		if p.config.guest.Chmod == "" {
+			errs = append(errs, fmt.Errorf("eyaml keys aren't supported on %s guests", p.config.GuestOSType))
+		}
+
+		if p.config.EyamlKeysDir == "" {
+			p.config.EyamlKeysDir = p.config.guest.Join(p.config.StagingDir, DefaultEyamlKeysDir)
+		}
+	}
+
+	for i, level := range p.config.HieraHierarchy {
+		if level.Name == "" {
+			errs = append(errs, fmt.Errorf("hiera_hierarchy[%d]: name must be specified", i))
+		}
+
+		if (level.Path == "") == (len(level.Paths) == 0) {
+			errs = append(errs, fmt.Errorf("hiera_hierarchy[%d]: one of path or paths must be specified", i))
+		}
+	}
+
+	if p.config.ApplyRoot != "" && p.config.guest.Chroot == "" {
+		errs = append(errs, fmt.Errorf("apply_root isn't supported on %s guests", p.config.GuestOSType))
+	}
+
+	for i, dir := range p.config.RemoteDirectories {
+		if dir.Path == "" {
+			errs = append(errs, fmt.Errorf("remote_directories[%d]: path must be specified", i))
+		}
+
+		if dir.Mode != "" {
+			if _, err := strconv.ParseUint(dir.Mode, 8, 32); err != nil {
+				errs = append(errs, fmt.Errorf("remote_directories[%d]: bad mode '%s'", i, dir.Mode))
+			}
+
+			if p.config.guest.Chmod == "" {
+				errs = append(errs, fmt.Errorf(
+					"remote_directories[%d]: mode isn't supported on %s guests", i, p.config.GuestOSType))
+			}
+		}
+
+		if dir.Owner != "" && p.config.guest.Chown == "" {
+			errs = append(errs, fmt.Errorf(
+				"remote_directories[%d]: owner isn't supported on %s guests", i, p.config.GuestOSType))
+		}
+	}
+
+	if p.config.ManifestPath != "" {
+		pFileInfo, err := os.Stat(p.config.ManifestPath)
+
+		if err != nil || !pFileInfo.IsDir() {
+			errs = append(errs, fmt.Errorf("Bad manifest path '%s': %s", p.config.ManifestPath, err))
+		}
+	}
+
+	if p.config.EnvironmentPath != "" {
+		pFileInfo, err := os.Stat(p.config.EnvironmentPath)
+
+		if err != nil || !pFileInfo.IsDir() {
+			errs = append(errs, fmt.Errorf("Bad environment path '%s': %s", p.config.EnvironmentPath, err))
+		}
+	}
+
+	if p.config.ManifestPath != "" && p.config.ManifestFile != "" {
+		path := filepath.Join(p.config.ManifestPath, p.config.ManifestFile)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("No manifest file '%s': %s", path, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &packer.MultiError{errs}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) (err error) {
+	p.auditEntries = nil
+	p.installedMethod = ""
+
+	if p.config.AuditLog != "" {
+		defer func() {
+			if auditErr := p.writeAuditLog(comm); auditErr != nil && err == nil {
+				err = fmt.Errorf("Error writing audit log: %s", auditErr)
+			}
+		}()
+	}
+
+	if p.config.suFallback && (p.config.InstallSudo || p.config.RunSudo) {
+		if err = p.checkSudo(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	if !p.config.SkipInstall && p.config.detectInstallMethod {
+		if err = p.detectInstallMethods(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	if !p.config.SkipInstall {
+		ui.Say("Installing Puppet")
+		if err = p.Install(ui, comm); err != nil {
+			return fmt.Errorf("Error installing Puppet: %s", err)
+		}
+
+		if p.config.InstallVerifyCommand != "" {
+			ui.Say("Verifying the Puppet install")
+			if err = p.verifyInstall(ui, comm); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.config.Version != "" || p.config.MinimumVersion != "" {
+		ui.Say("Verifying the Puppet version")
+		if err = p.verifyVersion(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	if p.config.FacterVersion != "" || p.config.MinimumFacterVersion != "" {
+		ui.Say("Verifying the Facter version")
+		if err = p.verifyFacterVersion(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	if p.config.DisableAgentService {
+		ui.Say("Disabling the Puppet agent service")
+		if err = p.disableAgentService(comm); err != nil {
+			return fmt.Errorf("Error disabling the Puppet agent service: %s", err)
+		}
+	}
+
+	stage, err := p.Stage(ui, comm)
+	if err != nil {
+		return err
+	}
+
+	if p.config.ForemanURL != "" {
+		var host string
+		if host, err = p.foremanHostName(comm); err != nil {
+			return fmt.Errorf("Error registering the host with Foreman: %s", err)
+		}
+
+		ui.Say(fmt.Sprintf("Registering the host with Foreman: %s", host))
+		if err = p.registerForemanHost(host); err != nil {
+			return fmt.Errorf("Error registering the host with Foreman: %s", err)
+		}
+
+		defer func() {
+			ui.Say(fmt.Sprintf("Deleting the host from Foreman: %s", host))
+			if foremanErr := p.deleteForemanHost(host); foremanErr != nil && err == nil {
+				err = fmt.Errorf("Error deleting the host from Foreman: %s", foremanErr)
+			}
+		}()
+	}
+
+	if err = p.Run(ui, comm, stage); err != nil {
+		if p.config.RawPauseOnFailure != "" {
+			p.pause(ui, stage, err)
+		}
+
+		return err
+	}
+
+	return p.Cleanup(ui, comm)
+}
+
+// Stage describes the files staged on the remote machine for a Puppet
+// run, as seen by Puppet.
+type Stage struct {
+	// ModulePath is the value given to Puppet as its module path. It is
+	// empty when running in a directory environment.
+	ModulePath string
+
+	// Manifest is the path of the manifest to apply.
+	Manifest string
+
+	// EnvironmentPath is the directory containing the uploaded directory
+	// environment, if any.
+	EnvironmentPath string
+
+	// ConfigVersion is the output of the config_version command of the
+	// uploaded directory environment, if it defines one.
+	ConfigVersion string
+
+	// HieraConfigPath is the path of the generated Hiera configuration,
+	// if any.
+	HieraConfigPath string
+}
+
+// Stage creates the remote directories and uploads the modules and the
+// manifests to the remote machine.
+func (p *Provisioner) Stage(ui packer.Ui, comm packer.Communicator) (*Stage, error) {
+	p.ui = ui
+	p.uploadedFiles = make(map[string]string)
+	p.archiveChecked = false
+
+	if err := p.checkUploadSize(ui); err != nil {
+		return nil, err
+	}
+
+	for _, dir := range p.config.RemoteDirectories {
+		ui.Say(fmt.Sprintf("Creating remote directory: %s", dir.Path))
+		if err := p.createConfiguredDirectory(dir, comm); err != nil {
+			return nil, fmt.Errorf("Error creating remote directory %s: %s", dir.Path, err)
+		}
+	}
+
+	err := p.createRemoteDirectory(p.hostPath(p.config.StagingDir), comm)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating remote staging directory: %s", err)
+	}
+
+	hieraConfigPath, err := p.stageHiera(ui, comm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.config.StructuredFacts) > 0 {
+		ui.Say("Writing structured facts")
+		if err := p.stageStructuredFacts(comm); err != nil {
+			return nil, fmt.Errorf("Error writing structured facts: %s", err)
+		}
+	}
+
+	if p.config.TrustedExternalCommand != "" {
+		ui.Say(fmt.Sprintf("Installing trusted external command: %s", p.config.TrustedExternalCommand))
+		if err := p.installTrustedExternalCommand(comm); err != nil {
+			return nil, fmt.Errorf("Error installing trusted external command: %s", err)
+		}
+	}
+
+	if p.config.ENCPath != "" {
+		ui.Say(fmt.Sprintf("Installing External Node Classifier: %s", p.config.ENCPath))
+		if err := p.installENC(comm); err != nil {
+			return nil, fmt.Errorf("Error installing External Node Classifier: %s", err)
+		}
+	}
+
+	if p.config.PuppetDBConfPath != "" {
+		ui.Say("Configuring PuppetDB")
+		if err := p.configurePuppetDB(ui, comm); err != nil {
+			return nil, fmt.Errorf("Error configuring PuppetDB: %s", err)
+		}
+	}
+
+	if len(p.config.Reports) > 0 || p.config.ReportURL != "" || p.config.ReportServer != "" ||
+		p.config.PuppetDBConfPath != "" {
+		ui.Say("Configuring reports")
+		if err := p.configureReports(comm); err != nil {
+			return nil, fmt.Errorf("Error configuring reports: %s", err)
+		}
+	}
+
+	if p.config.PuppetServer != "" {
+		ui.Say(fmt.Sprintf("Configuring the agent for Puppet server: %s", p.config.PuppetServer))
+		if err := p.configureAgent(comm); err != nil {
+			return nil, fmt.Errorf("Error configuring the agent: %s", err)
+		}
+
+		if p.config.ChallengePassword != "" {
+			ui.Say("Writing the CSR attributes of the agent")
+			if err := p.writeCSRAttributes(comm); err != nil {
+				return nil, fmt.Errorf("Error writing the CSR attributes: %s", err)
+			}
+		}
+
+		if p.config.SSLDir != "" || p.config.CACertPath != "" || p.config.ClientCertPath != "" {
+			ui.Say("Preparing the SSL directory of the agent")
+			if err := p.prepareSSLDir(comm); err != nil {
+				return nil, fmt.Errorf("Error preparing the SSL directory: %s", err)
+			}
+		}
+
+		return &Stage{HieraConfigPath: hieraConfigPath}, nil
+	}
+
+	if p.config.EnvironmentPath != "" {
+		stage, err := p.stageEnvironment(ui, comm)
+		if stage != nil {
+			stage.HieraConfigPath = hieraConfigPath
+		}
+
+		return stage, err
+	}
+
+	// Upload all modules, each path into its own directory
+	modulePaths := make([]string, 0, len(p.config.ModulesPaths))
+	for i, entry := range p.config.ModulesPaths {
+		name, path := splitModulesPath(entry)
+		warnings, err := checkSources(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking module path %s: %s", path, err)
+		}
+
+		for _, warning := range warnings {
+			ui.Error(fmt.Sprintf("Warning: %s", warning))
+		}
+
+		if len(warnings) > 0 && p.config.StrictSources {
+			return nil, fmt.Errorf(
+				"Module path %s looks incomplete, did you run 'git submodule update'?", path)
+		}
+
+		targetPath := p.config.guest.Join(p.config.StagingDir, fmt.Sprintf("modules-%d", i))
+		uploadPath := targetPath
+		if name != "" {
+			ui.Say(fmt.Sprintf("Copying module %s: %s", name, path))
+			if err := p.createRemoteDirectory(p.hostPath(targetPath), comm); err != nil {
+				return nil, fmt.Errorf("Error uploading modules: %s", err)
+			}
+
+			uploadPath = p.config.guest.Join(targetPath, name)
+		} else {
+			ui.Say(fmt.Sprintf("Copying module path: %s", path))
+		}
+
+		err = p.uploadLocalDirectory(path, p.hostPath(uploadPath), comm)
+		if err != nil {
+			return nil, fmt.Errorf("Error uploading modules: %s", err)
+		}
+
+		modulePaths = append(modulePaths, targetPath)
+	}
+
+	if p.config.ModulesURL != "" {
+		ui.Say(fmt.Sprintf("Fetching modules: %s", p.config.ModulesURL))
+		targetPath := p.config.guest.Join(p.config.StagingDir, ModulesBundleDir)
+		if err := p.stageModulesBundle(ui, targetPath, comm); err != nil {
+			return nil, fmt.Errorf("Error fetching modules: %s", err)
+		}
+
+		modulePaths = append(modulePaths, targetPath)
+	}
+
+	if p.config.RemoteModulePath != "" {
+		ui.Say(fmt.Sprintf("Installing modules into: %s", p.config.RemoteModulePath))
+		if err = p.installModules(modulePaths, comm); err != nil {
+			return nil, fmt.Errorf("Error installing modules: %s", err)
+		}
+
+		modulePaths = []string{p.config.RemoteModulePath}
+	}
+
+	// Upload manifests. Like the modules, they are staged under a fixed
+	// name, as the local path may be absolute or outside of the current
+	// directory.
+	ui.Say(fmt.Sprintf("Copying manifests: %s", p.config.ManifestPath))
+	remoteManifests := p.config.guest.Join(p.config.StagingDir, "manifests")
+	err = p.uploadLocalDirectory(p.config.ManifestPath, p.hostPath(remoteManifests), comm)
+	if err != nil {
+		return nil, fmt.Errorf("Error uploading manifests: %s", err)
+	}
+
+	return &Stage{
+		ModulePath:      strings.Join(modulePaths, p.config.guest.PathListSeparator),
+		Manifest:        p.config.guest.Join(remoteManifests, p.config.ManifestFile),
+		HieraConfigPath: hieraConfigPath,
+	}, nil
+}
+
+// stageEnvironment uploads the directory environment, along with an
+// environment.conf reflecting the configured overrides.
+func (p *Provisioner) stageEnvironment(ui packer.Ui, comm packer.Communicator) (*Stage, error) {
+	environmentPath := p.config.guest.Join(p.config.StagingDir, "environments")
+	remoteEnv := p.config.guest.Join(environmentPath, p.config.Environment)
+
+	ui.Say(fmt.Sprintf("Copying environment: %s", p.config.EnvironmentPath))
+	err := p.uploadLocalDirectory(p.config.EnvironmentPath, p.hostPath(remoteEnv), comm)
+	if err != nil {
+		return nil, fmt.Errorf("Error uploading environment: %s", err)
+	}
+
+	if len(p.config.EnvironmentConf) > 0 {
+		ui.Message(fmt.Sprintf("Overriding %s settings", EnvironmentConfFile))
+		conf := renderEnvironmentConf(p.config.environmentConf)
+		err = p.upload(p.hostPath(p.config.guest.Join(remoteEnv, EnvironmentConfFile)),
+			strings.NewReader(conf), comm)
+		if err != nil {
+			return nil, fmt.Errorf("Error uploading %s: %s", EnvironmentConfFile, err)
+		}
+	}
+
+	manifest := p.config.environmentConf["manifest"]
+	if manifest == "" {
+		manifest = DefaultManifestPath
+	}
+
+	if !strings.HasPrefix(manifest, "/") && !strings.HasPrefix(manifest, "$") &&
+		!strings.Contains(manifest, ":") {
+		manifest = p.config.guest.Join(remoteEnv, manifest)
+	}
+
+	var configVersion string
+	if command := p.config.environmentConf["config_version"]; command != "" && p.config.ConfigVersion == "" {
+		ui.Say("Capturing the configuration version")
+		configVersion, err = p.captureConfigVersion(remoteEnv, command, comm)
+		if err != nil {
+			return nil, fmt.Errorf("Error running config_version: %s", err)
+		}
+	}
+
+	return &Stage{
+		Manifest:        manifest,
+		EnvironmentPath: environmentPath,
+		ConfigVersion:   configVersion,
+	}, nil
+}
+
+// captureConfigVersion runs the config_version command of the staged
+// environment from within its directory, as Puppet does, and returns
+// its output.
+func (p *Provisioner) captureConfigVersion(remoteEnv string, command string, comm packer.Communicator) (string, error) {
+	command, err := p.elevateWith(p.config.RunSudo, p.config.RunAsUser,
+		p.inRoot(p.config.guest.ChdirCommand(remoteEnv, command)))
+	if err != nil {
+		return "", err
+	}
+
+	output, status, err := p.remoteCommandOutput(command, comm)
+	if err != nil {
+		return "", err
+	}
+
+	if status != 0 {
+		return "", fmt.Errorf("Command exited with non-zero exit status: %d", status)
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// Run runs Puppet on the remote machine against previously staged files.
+func (p *Provisioner) Run(ui packer.Ui, comm packer.Communicator, stage *Stage) error {
+	p.ui = ui
+	p.quiet = p.config.RunOutput == OutputQuiet
+	defer func() { p.quiet = false }()
+
+	if p.config.DscPrerequisites {
+		ui.Say("Checking DSC prerequisites")
+		err := p.ensureDscPrerequisites(comm)
+		if err != nil {
+			return fmt.Errorf("Error checking DSC prerequisites: %s", err)
+		}
+	}
+
+	if len(p.config.RequiredHieraKeys) > 0 {
+		if err := p.checkHieraKeys(ui, comm, stage); err != nil {
+			return err
+		}
+	}
+
+	if p.config.WaitForCert > 0 {
+		ui.Say("Waiting for the certificate of the agent to be signed")
+		if err := p.waitForCert(comm); err != nil {
+			return err
+		}
+
+		if p.config.ChallengePassword != "" {
+			if err := p.removeCSRAttributes(comm); err != nil {
+				return fmt.Errorf("Error removing the CSR attributes: %s", err)
+			}
+		}
+	}
+
+	// Execute Puppet
+	ui.Say("Beginning Puppet run")
+
+	facts, err := p.facts()
+	if err != nil {
+		return err
+	}
+
+	var serverPortSetting string
+	if p.config.PuppetServerPort != 0 {
+		serverPortSetting, err = p.serverPortSetting(comm)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Compile the command
+	var command bytes.Buffer
+	t := template.Must(p.executeTemplate("puppet-run").Parse(p.config.ExecuteCommand))
+	t.Execute(&command, &ExecuteManifestTemplate{
+		PuppetBinDir:      p.config.PuppetBinDir,
+		Modulepath:        stage.ModulePath,
+		Manifest:          stage.Manifest,
+		EnvironmentPath:   stage.EnvironmentPath,
+		Environment:       p.config.Environment,
+		HieraConfigPath:   stage.HieraConfigPath,
+		FacterVars:        p.facterVars(facts),
+		PuppetServer:      p.config.PuppetServer,
+		PuppetServerPort:  p.config.PuppetServerPort,
+		ServerPortSetting: serverPortSetting,
+		Certname:          p.config.Certname,
+		NodeNameValue:     p.config.NodeNameValue,
+		WaitForCert:       p.config.WaitForCert,
+	})
+
+	var elevated string
+	if p.config.ElevatedUser != "" {
+		elevated, err = p.elevatedTaskCommand(command.String(), comm)
+		defer p.removeElevatedTask(comm)
+	} else {
+		elevated, err = p.elevateWith(p.config.RunSudo, p.config.RunAsUser, p.inRoot(command.String()))
+	}
+	if err != nil {
+		return err
+	}
+
+	configVersion := p.config.ConfigVersion
+	if configVersion == "" {
+		configVersion = stage.ConfigVersion
+	}
+
+	if configVersion != "" {
+		ui.Message(fmt.Sprintf("Configuration version: %s", configVersion))
+	}
+
+	if p.config.InvocationFile != "" {
+		err = p.writeInvocation(&Invocation{
+			BuildName:        p.config.PackerBuildName,
+			Command:          elevated,
+			StagingDirectory: p.config.StagingDir,
+			ModulePath:       stage.ModulePath,
+			Manifest:         stage.Manifest,
+			Environment:      p.config.Environment,
+			EnvironmentPath:  stage.EnvironmentPath,
+			ConfigVersion:    configVersion,
+		})
+		if err != nil {
+			return fmt.Errorf("Error writing invocation file: %s", err)
+		}
+	}
+
+	var timeout time.Duration
+	if p.config.DscPrerequisites {
+		timeout = p.config.dscApplyTimeout
+	}
+
+	exitStatus, err := p.runCommand(elevated, comm, timeout)
+	if err != nil {
+		return fmt.Errorf("Error running Puppet: %s", err)
+	}
+
+	// Without waitforcert, the certificate is signed during the run.
+	if p.config.ChallengePassword != "" && p.config.WaitForCert == 0 {
+		if err := p.removeCSRAttributes(comm); err != nil {
+			return fmt.Errorf("Error removing the CSR attributes: %s", err)
+		}
+	}
+
+	switch p.config.exitCodes[exitStatus] {
+	case ExitCodeSuccess:
+	case ExitCodeChanged:
+		ui.Message("Puppet applied changes")
+	default:
+		if reason, ok := agentExitStatusReasons[exitStatus]; ok && p.config.PuppetServer != "" {
+			return fmt.Errorf("Puppet exited with a failure exit status: %d (%s)", exitStatus, reason)
+		}
+
+		return fmt.Errorf("Puppet exited with a failure exit status: %d", exitStatus)
+	}
+
+	return nil
+}
+
+// Cleanup removes what the provisioner shouldn't leave behind in the
+// image after a successful run.
+func (p *Provisioner) Cleanup(ui packer.Ui, comm packer.Communicator) error {
+	p.ui = ui
 
-type config struct {
-	// An array of local paths of modules to upload.
-	ModulePath string `mapstructure:"module_path"`
+	if p.config.CleanNodeCertificate {
+		ui.Say("Cleaning up the certificate of the agent on the Puppet server")
+		if err := p.cleanNodeCertificate(comm); err != nil {
+			return fmt.Errorf("Error cleaning the certificate of the agent: %s", err)
+		}
+	}
 
-	// Path to the manifests
-	ManifestPath string `mapstructure:"manifest_path"`
+	if p.config.CleanSSLDir {
+		ui.Say("Cleaning up the SSL directory of the agent")
+		if err := p.cleanSSLDir(comm); err != nil {
+			return fmt.Errorf("Error removing the SSL directory: %s", err)
+		}
+	}
 
-	// Manifest file
-	ManifestFile string `mapstructure:"manifest_file"`
+	if p.config.ClientPrivateKeyPath != "" || p.config.ChallengePassword != "" {
+		ui.Say("Removing the staged private files")
+		if err := p.removeRemoteDirectory(p.hostPath(p.config.guest.Join(p.config.StagingDir, PrivateStagingDir)), comm); err != nil {
+			return fmt.Errorf("Error removing the staged private files: %s", err)
+		}
+	}
 
-	// Option to avoid sudo use when executing commands. Defaults to false.
-	PreventSudo bool `mapstructure:"prevent_sudo"`
+	if p.config.EyamlPrivateKeyPath != "" {
+		ui.Say("Removing the eyaml keys")
+		if err := p.removeRemoteDirectory(p.hostPath(p.config.EyamlKeysDir), comm); err != nil {
+			return fmt.Errorf("Error removing the eyaml keys: %s", err)
+		}
+	}
+
+	if p.config.CleanStagingDir {
+		ui.Say("Cleaning up the staging directory")
+		if err := p.removeRemoteDirectory(p.hostPath(p.config.StagingDir), comm); err != nil {
+			return fmt.Errorf("Error removing staging directory: %s", err)
+		}
+	}
+
+	if len(p.config.StructuredFacts) > 0 {
+		ui.Say("Removing structured facts")
+		if err := p.removeStructuredFacts(comm); err != nil {
+			return fmt.Errorf("Error removing structured facts: %s", err)
+		}
+	}
+
+	if p.config.RemovePuppet {
+		ui.Say("Removing Puppet")
+		if err := p.removePuppet(ui, comm); err != nil {
+			return fmt.Errorf("Error removing Puppet: %s", err)
+		}
+	}
+
+	return nil
 }
 
-type Provisioner struct {
-	config config
+// pause keeps the machine alive after a failed run so that it can be
+// inspected, for as long as pause_on_failure says.
+func (p *Provisioner) pause(ui packer.Ui, stage *Stage, runErr error) {
+	ui.Error(fmt.Sprintf("Puppet run failed: %s", runErr))
+	ui.Error(fmt.Sprintf("The staged files are still on the machine in: %s", p.hostPath(p.config.StagingDir)))
+	if stage.EnvironmentPath != "" {
+		ui.Error(fmt.Sprintf("Environment path: %s", stage.EnvironmentPath))
+	} else {
+		ui.Error(fmt.Sprintf("Module path: %s", stage.ModulePath))
+	}
+	ui.Error(fmt.Sprintf("Manifest: %s", stage.Manifest))
+
+	if p.config.RawPauseOnFailure == PauseUntilEnter {
+		ui.Ask("Press enter to continue and tear down the machine")
+		return
+	}
+
+	ui.Error(fmt.Sprintf("Pausing for %s before tearing down the machine", p.config.pauseOnFailure))
+	time.Sleep(p.config.pauseOnFailure)
 }
 
-type ExecuteManifestTemplate struct {
-	Sudo       bool
-	Modulepath string
-	Manifest   string
+func (p *Provisioner) Cancel() {
+	// Just hard quit. It isn't a big deal if what we're doing keeps
+	// running on the other side.
+	os.Exit(0)
 }
 
-func (p *Provisioner) Prepare(raws ...interface{}) error {
-	errs := make([]error, 0)
-	for _, raw := range raws {
-		if err := mapstructure.Decode(raw, &p.config); err != nil {
-			return err
-		}
+// hostPath translates a path as seen by Puppet into the path on the
+// remote machine, which differs when applying against an alternate root.
+func (p *Provisioner) hostPath(path string) string {
+	if p.config.ApplyRoot == "" {
+		return path
+	}
+
+	return p.config.guest.Join(p.config.ApplyRoot, path)
+}
+
+// inRoot wraps a command so that it runs within the alternate root, if
+// one is configured.
+func (p *Provisioner) inRoot(command string) string {
+	if p.config.ApplyRoot == "" {
+		return command
 	}
 
-	if p.config.ModulePath == "" {
-		p.config.ModulePath = DefaultModulePath
+	return p.config.guest.ChrootCommand(p.config.ApplyRoot, command)
+}
+
+// checkInRoot is like inRoot for checks such as "command -v gem", which
+// may rely on shell builtins that chroot can't execute, so they are run
+// by a shell within apply_root.
+func (p *Provisioner) checkInRoot(check string) string {
+	if p.config.ApplyRoot == "" {
+		return check
 	}
 
-	if p.config.ManifestPath == "" {
-		p.config.ManifestPath = DefaultManifestPath
+	return p.inRoot("sh -c " + shellQuote(check))
+}
+
+// elevateWith wraps a command in the configured elevated command so that
+// it runs as the given user, or as root if user is empty. The command is
+// returned as is if enabled is false.
+func (p *Provisioner) elevateWith(enabled bool, user string, command string) (string, error) {
+	if !enabled {
+		return command, nil
 	}
 
-	if p.config.ManifestFile == "" {
-		p.config.ManifestFile = DefaultManifestFile
+	t, err := template.New("elevated-command").Parse(p.config.ElevatedCommand)
+	if err != nil {
+		return "", err
 	}
 
-	if p.config.ModulePath != "" {
-		pFileInfo, err := os.Stat(p.config.ModulePath)
+	var elevated bytes.Buffer
+	err = t.Execute(&elevated, &ElevatedCommandTemplate{
+		Command:       command,
+		QuotedCommand: shellQuote(command),
+		User:          user,
+	})
+	if err != nil {
+		return "", err
+	}
 
-		if err != nil || !pFileInfo.IsDir() {
-			errs = append(errs, fmt.Errorf("Bad module path '%s': %s", p.config.ModulePath, err))
+	return elevated.String(), nil
+}
+
+// checkSudo switches the elevated command to su when the remote machine
+// doesn't have sudo, as is common on the BSDs.
+func (p *Provisioner) checkSudo(ui packer.Ui, comm packer.Communicator) error {
+	status, err := p.remoteCommandStatus("command -v sudo", comm)
+	if err != nil {
+		return fmt.Errorf("Error checking for sudo: %s", err)
+	}
+
+	if status != 0 {
+		ui.Message("sudo isn't available, using su instead")
+		p.config.ElevatedCommand = p.config.guest.SuElevatedCommand
+	}
+
+	return nil
+}
+
+// commandTemplate returns a new template for a remote command, in which
+// the quote function quotes a value as a single word for the guest.
+func (p *Provisioner) commandTemplate(name string) *template.Template {
+	return template.New(name).Funcs(template.FuncMap{
+		"quote": p.config.guest.Quote,
+	})
+}
+
+// executeTemplate returns a new template for execute_command, in which
+// the quote function quotes a value as a single argument for the command
+// interpreter of the guest.
+func (p *Provisioner) executeTemplate(name string) *template.Template {
+	return template.New(name).Funcs(template.FuncMap{
+		"quote": p.config.guest.ArgQuote,
+	})
+}
+
+// shellQuote quotes s as a single word for a POSIX shell. Words made
+// only of characters the shell doesn't interpret are left as is.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// shellSafeChars are the characters that need no quoting in a word for a
+// POSIX shell.
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%_+=:,./-"
+
+// powershellQuote quotes s as a single PowerShell string, within which
+// nothing is interpreted.
+func powershellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// cmdQuote quotes s as a single argument of a program run by cmd: it is
+// quoted as programs parse their command line, then escaped with
+// cmdEscape so that cmd interprets none of it, quotes included.
+func cmdQuote(s string) string {
+	var quoted bytes.Buffer
+	quoted.WriteByte('"')
+	backslashes := 0
+	for _, c := range s {
+		switch c {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			// Backslashes before a quote escape each other and the quote.
+			backslashes = 2*backslashes + 1
 		}
+
+		quoted.WriteString(strings.Repeat("\\", backslashes))
+		quoted.WriteRune(c)
+		backslashes = 0
 	}
 
-	if p.config.ManifestPath != "" {
-		pFileInfo, err := os.Stat(p.config.ManifestPath)
+	// Backslashes before the closing quote escape each other.
+	quoted.WriteString(strings.Repeat("\\", 2*backslashes))
+	quoted.WriteByte('"')
+	return cmdEscape(quoted.String())
+}
 
-		if err != nil || !pFileInfo.IsDir() {
-			errs = append(errs, fmt.Errorf("Bad manifest path '%s': %s", p.config.ManifestPath, err))
+// cmdEscape escapes the characters cmd interprets in s with carets, so
+// that cmd passes s on as is. Within a batch file, ^% has to be written
+// %% instead.
+func cmdEscape(s string) string {
+	var escaped bytes.Buffer
+	for _, c := range s {
+		if strings.ContainsRune(cmdSpecialChars, c) {
+			escaped.WriteByte('^')
 		}
+		escaped.WriteRune(c)
 	}
 
-	if p.config.ManifestFile != "" {
-		path := filepath.Join(p.config.ManifestPath, p.config.ManifestFile)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			errs = append(errs, fmt.Errorf("No manifest file '%s': %s", path, err))
+	return escaped.String()
+}
+
+// cmdSpecialChars are the characters that cmd interprets on a command
+// line outside of quotes.
+const cmdSpecialChars = "^&|<>()%!\""
+
+// elevatedStdin returns the standard input to give to a remote command
+// so that sudo can read its password, or nil if no password is configured
+// or the command isn't run by sudo -S. sudo_password always goes with
+// DefaultPasswordElevatedCommand, so commands it elevated start with
+// passwordElevatedPrefix.
+func (p *Provisioner) elevatedStdin(command string) io.Reader {
+	if p.config.SudoPassword == "" || !strings.HasPrefix(command, passwordElevatedPrefix) {
+		return nil
+	}
+
+	return strings.NewReader(p.config.SudoPassword + "\n")
+}
+
+// ensureDscPrerequisites verifies that the guest runs a recent enough
+// Windows Management Framework and sets the PowerShell execution policy
+// of the machine, elevated as the Puppet run is, so that the DSC resources
+// wrapped by the Puppet modules can load.
+func (p *Provisioner) ensureDscPrerequisites(comm packer.Communicator) error {
+	data := &DscPrerequisitesTemplate{
+		WmfVersion:      p.config.DscWmfVersion,
+		ExecutionPolicy: p.config.DscExecutionPolicy,
+	}
+
+	var check, policy bytes.Buffer
+	template.Must(template.New("dsc-check").Parse(DscPrerequisitesCommand)).Execute(&check, data)
+	template.Must(template.New("dsc-execution-policy").Parse(DscExecutionPolicyCommand)).Execute(&policy, data)
+
+	if err := p.executeCommand(check.String(), comm, 0); err != nil {
+		return err
+	}
+
+	var elevated string
+	var err error
+	if p.config.ElevatedUser != "" {
+		elevated, err = p.elevatedTaskCommand(policy.String(), comm)
+		defer p.removeElevatedTask(comm)
+	} else {
+		elevated, err = p.elevateWith(p.config.RunSudo, "", policy.String())
+	}
+	if err != nil {
+		return err
+	}
+
+	return p.executeCommand(elevated, comm, 0)
+}
+
+// uploadLocalDirectory uploads the contents of localDir into remoteDir,
+// as an archive if upload_archive is set and the remote machine can
+// extract it. Otherwise the files are uploaded, and their modes restored
+// afterwards. The uploaded files are then verified if verify_uploads is
+// set.
+func (p *Provisioner) uploadLocalDirectory(localDir string, remoteDir string, comm packer.Communicator) error {
+	useArchive := p.config.UploadArchive
+	if useArchive {
+		var err error
+		if useArchive, err = p.canExtractArchives(comm); err != nil {
+			return err
 		}
 	}
 
-	if len(errs) > 0 {
-		return &packer.MultiError{errs}
+	if useArchive {
+		if err := p.uploadArchive(localDir, remoteDir, comm); err != nil {
+			return err
+		}
+	} else {
+		if err := p.uploadContents(localDir, remoteDir, comm); err != nil {
+			return err
+		}
+
+		if err := p.restoreModes(localDir, remoteDir, comm); err != nil {
+			return fmt.Errorf("Error restoring file modes: %s", err)
+		}
+	}
+
+	if p.config.VerifyUploads {
+		return p.verifyUpload(localDir, remoteDir, comm)
 	}
 
 	return nil
 }
 
-func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
-	var err error
-	Ui = ui
+// uploadContents uploads the files of localDir into remoteDir, only the
+// ones that changed if incremental_upload is set. Otherwise the
+// directory upload of the communicator is used, falling back to
+// uploading file by file if it fails.
+func (p *Provisioner) uploadContents(localDir string, remoteDir string, comm packer.Communicator) error {
+	if p.config.IncrementalUpload {
+		return p.uploadIncremental(localDir, remoteDir, comm)
+	}
 
-	err = CreateRemoteDirectory(RemoteStagingPath, comm)
-	if err != nil {
-		return fmt.Errorf("Error creating remote staging directory: %s", err)
+	if p.config.RemoteCacheDir != "" {
+		return p.uploadCached(localDir, remoteDir, comm)
 	}
 
-	// Upload all modules
-	ui.Say(fmt.Sprintf("Copying module path: %s", p.config.ModulePath))
-	err = UploadLocalDirectory(p.config.ModulePath, comm)
+	// The directory upload of the communicator can't ignore paths, skip
+	// duplicates or be throttled, and mishandles symbolic links
+	rules, err := readIgnoreRules(localDir)
 	if err != nil {
-		return fmt.Errorf("Error uploading modules: %s", err)
+		return fmt.Errorf("Error reading the ignore files of %s: %s", localDir, err)
 	}
 
-	// Upload manifests
-	ui.Say(fmt.Sprintf("Copying manifests: %s", p.config.ManifestPath))
-	err = UploadLocalDirectory(p.config.ManifestPath, comm)
+	links, err := containsSymlinks(localDir)
 	if err != nil {
-		return fmt.Errorf("Error uploading manifests: %s", err)
+		return err
 	}
 
-	// Execute Puppet
-	ui.Say("Beginning Puppet run")
+	if rules != nil || links || p.config.uploadLimiter != nil || p.config.DeduplicateUploads {
+		return p.uploadFiles(localDir, remoteDir, comm)
+	}
 
-	// Compile the command
-	var command bytes.Buffer
-	mpath := filepath.Join(RemoteStagingPath, p.config.ManifestPath)
-	manifest := filepath.Join(mpath, p.config.ManifestFile)
-	modulepath := filepath.Join(RemoteStagingPath, p.config.ModulePath)
-	t := template.Must(template.New("puppet-run").Parse("{{if .Sudo}}sudo {{end}}puppet apply --verbose --modulepath={{.Modulepath}} {{.Manifest}}"))
-	t.Execute(&command, &ExecuteManifestTemplate{!p.config.PreventSudo, modulepath, manifest})
+	if err := p.createRemoteDirectory(remoteDir, comm); err != nil {
+		return err
+	}
 
-	err = executeCommand(command.String(), comm)
-	if err != nil {
-		return fmt.Errorf("Error running Puppet: %s", err)
+	// Make sure there is a trailing "/" so that the directory isn't
+	// created on the other side.
+	src := localDir
+	if src[len(src)-1] != '/' {
+		src = src + "/"
 	}
 
-	return nil
+	log.Printf("Uploading directory %s", localDir)
+	err = comm.UploadDir(remoteDir, src, nil)
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("Directory upload of %s failed, uploading file by file: %s", localDir, err)
+	return p.uploadFiles(localDir, remoteDir, comm)
 }
 
-func (p *Provisioner) Cancel() {
-	// Just hard quit. It isn't a big deal if what we're doing keeps
-	// running on the other side.
-	os.Exit(0)
+// fileUpload is a local file to upload and its remote path.
+type fileUpload struct {
+	localPath  string
+	remotePath string
+}
+
+// remoteCopy is a remote file copied to another remote path, instead of
+// uploading the same contents again.
+type remoteCopy struct {
+	src string
+	dst string
 }
 
-func UploadLocalDirectory(localDir string, comm packer.Communicator) (err error) {
-	visitPath := func(path string, f os.FileInfo, err error) (err2 error) {
-		var remotePath = RemoteStagingPath + "/" + path
+// uploadFiles uploads the contents of localDir into remoteDir one file
+// at a time, with upload_concurrency uploads running at once. The remote
+// directories are created beforehand. With deduplicate_uploads, files
+// whose contents were already uploaded are copied remotely instead.
+func (p *Provisioner) uploadFiles(localDir string, remoteDir string, comm packer.Communicator) (err error) {
+	uploads := make([]fileUpload, 0)
+	links := make([]fileUpload, 0)
+	copies := make([]remoteCopy, 0)
+	if p.uploadedFiles == nil {
+		p.uploadedFiles = make(map[string]string)
+	}
+
+	visitPath := func(path string, relPath string, f os.FileInfo) (err error) {
+		var remotePath = p.config.guest.Join(remoteDir, relPath)
 		if f.IsDir() {
 			// Make remote directory
-			err = CreateRemoteDirectory(remotePath, comm)
+			err = p.createRemoteDirectory(remotePath, comm)
 			if err != nil {
 				return err
 			}
-		} else {
-			// Upload file to existing directory
-			file, err := os.Open(path)
+		} else if f.Mode()&os.ModeSymlink != 0 {
+			links = append(links, fileUpload{path, remotePath})
+		} else if p.config.DeduplicateUploads {
+			sum, err := checksumFile(path)
 			if err != nil {
-				return fmt.Errorf("Error opening file: %s", err)
+				return err
 			}
 
-			err = comm.Upload(remotePath, file)
-			if err != nil {
-				return fmt.Errorf("Error uploading file: %s", err)
+			if uploaded, ok := p.uploadedFiles[sum]; ok {
+				copies = append(copies, remoteCopy{uploaded, remotePath})
+			} else {
+				p.uploadedFiles[sum] = remotePath
+				uploads = append(uploads, fileUpload{path, remotePath})
 			}
+		} else {
+			uploads = append(uploads, fileUpload{path, remotePath})
 		}
 		return
 	}
 
 	log.Printf("Uploading directory %s", localDir)
-	err = filepath.Walk(localDir, visitPath)
+	err = p.walkLocalDirectory(localDir, visitPath)
+	if err == nil {
+		err = p.uploadConcurrently(uploads, comm)
+	}
+
+	for _, link := range links {
+		if err != nil {
+			break
+		}
+
+		err = p.recreateSymlink(link, comm)
+	}
+
+	if len(copies) > 0 && err == nil {
+		log.Printf("Copying %d duplicate files remotely instead of uploading them", len(copies))
+	}
+
+	for _, c := range copies {
+		if err != nil {
+			break
+		}
+
+		err = p.executeCommand(p.config.guest.CopyCommand(c.src, c.dst), comm, 0)
+	}
+
 	if err != nil {
 		return fmt.Errorf("Error uploading modules %s: %s", localDir, err)
 	}
@@ -180,13 +2601,173 @@ func UploadLocalDirectory(localDir string, comm packer.Communicator) (err error)
 	return nil
 }
 
-func CreateRemoteDirectory(path string, comm packer.Communicator) (err error) {
-	log.Printf("Creating remote directory: %s ", path)
+// uploadConcurrently uploads files with upload_concurrency uploads
+// running at once, and returns the first error, if any.
+func (p *Provisioner) uploadConcurrently(uploads []fileUpload, comm packer.Communicator) error {
+	work := make(chan fileUpload)
+	errs := make(chan error, len(uploads))
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.config.UploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for upload := range work {
+				if err := p.uploadFile(upload, comm); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for _, upload := range uploads {
+		work <- upload
+	}
+	close(work)
+
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// uploadFile uploads a single file to its remote path, whose directory
+// must already exist.
+func (p *Provisioner) uploadFile(upload fileUpload, comm packer.Communicator) error {
+	file, err := os.Open(upload.localPath)
+	if err != nil {
+		return fmt.Errorf("Error opening file: %s", err)
+	}
+	defer file.Close()
+
+	if err := p.upload(upload.remotePath, file, comm); err != nil {
+		return fmt.Errorf("Error uploading file: %s", err)
+	}
+
+	return nil
+}
+
+// upload uploads the contents of r to the remote path, retrying with an
+// increasing delay as configured when it fails. r is rewound before each
+// attempt.
+func (p *Provisioner) upload(path string, r io.ReadSeeker, comm packer.Communicator) error {
+	delay := p.config.uploadRetryDelay
+	for retry := 0; ; retry++ {
+		if _, err := r.Seek(0, 0); err != nil {
+			return err
+		}
+
+		var err error
+		if p.config.uploadLimiter != nil {
+			err = comm.Upload(path, &throttledReader{r, p.config.uploadLimiter})
+		} else {
+			err = comm.Upload(path, r)
+		}
+
+		if err == nil || retry >= p.config.UploadRetries {
+			return err
+		}
+
+		log.Printf("Upload of %s failed, retrying in %s: %s", path, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// moduleNameRegexp matches the valid names of Puppet modules.
+var moduleNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// splitModulesPath splits an entry of modules_paths into the name of the
+// single module it is the directory of, if it has the form name=path, and
+// its local path. Entries whose part before "=" isn't a valid module name
+// are paths.
+func splitModulesPath(entry string) (string, string) {
+	if i := strings.Index(entry, "="); i > 0 && moduleNameRegexp.MatchString(entry[:i]) {
+		return entry[:i], entry[i+1:]
+	}
+
+	return "", entry
+}
+
+// installModules copies the contents of the staged module directories
+// into the remote module path, with elevated privileges since it usually
+// lives outside of the reach of the connecting user.
+func (p *Provisioner) installModules(stagedPaths []string, comm packer.Communicator) error {
+	remoteModulePath := p.hostPath(p.config.RemoteModulePath)
+	commands := []string{p.config.guest.MkdirCommand(remoteModulePath)}
+	for _, path := range stagedPaths {
+		commands = append(commands,
+			p.config.guest.CopyContentsCommand(p.hostPath(path), remoteModulePath))
+	}
 
-	var copyCommand = []string{"mkdir -p", path}
+	for _, command := range commands {
+		command, err := p.elevateWith(p.config.RunSudo, "", command)
+		if err != nil {
+			return err
+		}
+
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createConfiguredDirectory creates one of the remote_directories with
+// elevated privileges, then applies its mode and owner.
+func (p *Provisioner) createConfiguredDirectory(dir RemoteDirectory, comm packer.Communicator) error {
+	commands := []string{p.config.guest.MkdirCommand(p.hostPath(dir.Path))}
+	if dir.Mode != "" {
+		commands = append(commands, p.config.guest.ChmodCommand(dir.Mode, p.hostPath(dir.Path)))
+	}
+
+	if dir.Owner != "" {
+		// Owners are resolved within the image, not the build machine.
+		commands = append(commands, p.inRoot(p.config.guest.ChownCommand(dir.Owner, dir.Path)))
+	}
+
+	for _, command := range commands {
+		command, err := p.elevateWith(p.config.RunSudo, "", command)
+		if err != nil {
+			return err
+		}
+
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disableAgentService stops the Puppet agent service and prevents it from
+// starting when the image boots.
+func (p *Provisioner) disableAgentService(comm packer.Communicator) error {
+	command := p.config.guest.DisableServiceCommand(AgentServiceName)
+	command, err := p.elevateWith(p.config.InstallSudo, "", p.inRoot(command))
+	if err != nil {
+		return err
+	}
+
+	return p.executeCommand(command, comm, 0)
+}
+
+// removeRemoteDirectory removes a remote directory and its contents.
+func (p *Provisioner) removeRemoteDirectory(path string, comm packer.Communicator) error {
+	command, err := p.elevateWith(p.config.RunSudo, "", p.config.guest.RemoveDirCommand(path))
+	if err != nil {
+		return err
+	}
+
+	return p.executeCommand(command, comm, 0)
+}
+
+func (p *Provisioner) createRemoteDirectory(path string, comm packer.Communicator) (err error) {
+	log.Printf("Creating remote directory: %s ", path)
 
 	var cmd packer.RemoteCmd
-	cmd.Command = strings.Join(copyCommand, " ")
+	cmd.Command = p.config.guest.MkdirCommand(path)
+	p.audit(cmd.Command)
 
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
@@ -202,25 +2783,73 @@ func CreateRemoteDirectory(path string, comm packer.Communicator) (err error) {
 	return
 }
 
-func executeCommand(command string, comm packer.Communicator) (err error) {
+// output shows a line of command output, or only logs it when quiet.
+// Secrets are masked before the line is shown or logged.
+func (p *Provisioner) output(line string) {
+	line = p.redact(line)
+	if p.quiet {
+		log.Printf("Output: %s", line)
+		return
+	}
+
+	p.ui.Message(line)
+}
+
+// executeCommand runs a command on the remote machine, streaming its
+// output to the Ui, and fails if it exits with a non-zero status.
+func (p *Provisioner) executeCommand(command string, comm packer.Communicator, timeout time.Duration) error {
+	exitStatus, err := p.runCommand(command, comm, timeout)
+	if err != nil {
+		return err
+	}
+
+	if exitStatus != 0 {
+		return fmt.Errorf("Command exited with non-zero exit status: %d", exitStatus)
+	}
+
+	return nil
+}
+
+// runCommand runs a command on the remote machine, streaming its output
+// to the Ui, and returns its exit status.
+func (p *Provisioner) runCommand(command string, comm packer.Communicator, timeout time.Duration) (int, error) {
+	return p.runCommandWithInput(command, p.elevatedStdin(command), comm, timeout)
+}
+
+// commandTimeoutError is the error of a command that didn't exit within
+// its timeout.
+type commandTimeoutError time.Duration
+
+func (e commandTimeoutError) Error() string {
+	return fmt.Sprintf("Command timed out after %s", time.Duration(e))
+}
+
+// runCommandWithInput runs a command like runCommand, giving it stdin as
+// its standard input. If the command doesn't exit within timeout, it
+// stops reading its output and fails with a commandTimeoutError, but the communicator has no way to
+// stop the command, which keeps running on the remote machine until it
+// exits or the machine is torn down.
+func (p *Provisioner) runCommandWithInput(command string, stdin io.Reader, comm packer.Communicator, timeout time.Duration) (int, error) {
 	// Setup the remote command
 	stdout_r, stdout_w := io.Pipe()
 	stderr_r, stderr_w := io.Pipe()
 
 	var cmd packer.RemoteCmd
 	cmd.Command = command
+	cmd.Stdin = stdin
 	cmd.Stdout = stdout_w
 	cmd.Stderr = stderr_w
 
-	log.Printf("Executing command: %s", cmd.Command)
-	err = comm.Start(&cmd)
+	log.Printf("Executing command: %s", p.redact(cmd.Command))
+	p.audit(cmd.Command)
+	err := comm.Start(&cmd)
 	if err != nil {
-		return fmt.Errorf("Failed executing command: %s", err)
+		return 0, fmt.Errorf("Failed executing command: %s", err)
 	}
 
 	exitChan := make(chan int, 1)
-	stdoutChan := iochan.DelimReader(stdout_r, '\n')
-	stderrChan := iochan.DelimReader(stderr_r, '\n')
+	stdoutChan := LineReader(stdout_r, p.config.MaxLineLength)
+	stderrChan := LineReader(stderr_r, p.config.MaxLineLength)
 
 	go func() {
 		defer stdout_w.Close()
@@ -230,33 +2859,62 @@ func executeCommand(command string, comm packer.Communicator) (err error) {
 		exitChan <- cmd.ExitStatus
 	}()
 
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = time.After(timeout)
+	}
+
+	var exitStatus int
 OutputLoop:
 	for {
 		select {
 		case output := <-stderrChan:
-			Ui.Message(strings.TrimSpace(output))
+			p.output(strings.TrimSpace(output))
 		case output := <-stdoutChan:
-			Ui.Message(strings.TrimSpace(output))
-		case exitStatus := <-exitChan:
+			p.output(strings.TrimSpace(output))
+		case exitStatus = <-exitChan:
 			log.Printf("Puppet provisioner exited with status %d", exitStatus)
-
-			if exitStatus != 0 {
-				return fmt.Errorf("Command exited with non-zero exit status: %d", exitStatus)
-			}
-
 			break OutputLoop
+		case <-timeoutChan:
+			// Unblock the line readers, and the communicator writing to
+			// them, rather than leave them waiting on the command.
+			stdout_r.Close()
+			stderr_r.Close()
+			return 0, commandTimeoutError(timeout)
 		}
 	}
 
 	// Make sure we finish off stdout/stderr because we may have gotten
 	// a message from the exit channel first.
 	for output := range stdoutChan {
-		Ui.Message(output)
+		p.output(output)
 	}
 
 	for output := range stderrChan {
-		Ui.Message(output)
+		p.output(output)
 	}
 
-	return nil
+	return exitStatus, nil
+}
+
+// DscPrerequisitesCommand checks the version of the Windows Management
+// Framework, and DscExecutionPolicyCommand sets the execution policy of
+// the machine, which requires elevated privileges.
+var DscPrerequisitesCommand = `powershell -NoProfile -NonInteractive -Command "` +
+	`if ($PSVersionTable.PSVersion -lt [version]'{{.WmfVersion}}') { ` +
+	`Write-Error ('WMF {{.WmfVersion}} or later is required, found ' + $PSVersionTable.PSVersion); exit 1 }"`
+
+var DscExecutionPolicyCommand = `powershell -NoProfile -NonInteractive -Command "` +
+	`Set-ExecutionPolicy -ExecutionPolicy {{.ExecutionPolicy}} -Scope LocalMachine -Force"`
+
+// wmfVersionRegexp matches the versions dsc_wmf_version may be.
+var wmfVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,3}$`)
+
+// dscExecutionPolicies are the values dsc_execution_policy may be.
+var dscExecutionPolicies = map[string]bool{
+	"AllSigned":    true,
+	"Bypass":       true,
+	"RemoteSigned": true,
+	"Restricted":   true,
+	"Unrestricted": true,
 }
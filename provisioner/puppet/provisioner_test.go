@@ -1,16 +1,55 @@
 package puppet
 
 import (
+	"bytes"
+	"errors"
 	"github.com/mitchellh/packer/packer"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func testConfig() map[string]interface{} {
+func testConfig(t *testing.T) map[string]interface{} {
+	modules, err := ioutil.TempDir("", "packer-puppet-modules")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	manifests, err := ioutil.TempDir("", "packer-puppet-manifests")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(manifests, DefaultManifestFile), []byte(""), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
 	return map[string]interface{}{
-	// "inline": []interface{}{"foo", "bar"},
+		"module_path":   modules,
+		"manifest_path": manifests,
 	}
 }
 
+func testUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	}
+}
+
+func cleanupConfig(config map[string]interface{}) {
+	os.RemoveAll(config["module_path"].(string))
+	os.RemoveAll(config["manifest_path"].(string))
+}
+
 func TestProvisioner_Impl(t *testing.T) {
 	var raw interface{}
 	raw = &Provisioner{}
@@ -18,3 +57,1023 @@ func TestProvisioner_Impl(t *testing.T) {
 		t.Fatalf("must be a Provisioner")
 	}
 }
+
+func TestProvisionerPrepare_dscDefaults(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.DscWmfVersion != DefaultDscWmfVersion {
+		t.Fatalf("bad: %s", p.config.DscWmfVersion)
+	}
+
+	if p.config.DscExecutionPolicy != DefaultDscExecutionPolicy {
+		t.Fatalf("bad: %s", p.config.DscExecutionPolicy)
+	}
+
+	if p.config.dscApplyTimeout != 0 {
+		t.Fatalf("bad: %s", p.config.dscApplyTimeout)
+	}
+}
+
+func TestProvisionerPrepare_dscApplyTimeout(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["guest_os_type"] = "windows"
+	config["skip_install"] = true
+	config["dsc_prerequisites"] = true
+
+	config["dsc_apply_timeout"] = "i am bad"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["dsc_apply_timeout"] = "2h"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.dscApplyTimeout != 2*time.Hour {
+		t.Fatalf("bad: %s", p.config.dscApplyTimeout)
+	}
+}
+
+func TestProvisionerPrepare_dscSettings(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["guest_os_type"] = "windows"
+	config["skip_install"] = true
+	config["dsc_prerequisites"] = true
+
+	config["dsc_wmf_version"] = "5.1'; Remove-Item C:\\ -Recurse; '"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["dsc_wmf_version"] = "5.1"
+	config["dsc_execution_policy"] = "Bypass; calc"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["dsc_execution_policy"] = "Unrestricted"
+	config["elevated_user"] = "Administrator"
+	config["elevated_password"] = "s3cret"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	p.ui = testUi()
+	if err := p.ensureDscPrerequisites(comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the version check runs as the connecting user, and the
+	// execution policy is set by the elevated task.
+	if len(comm.commands) != 3 || strings.Contains(comm.commands[0], "Set-ExecutionPolicy") ||
+		!strings.Contains(comm.commands[1], "packer-puppet-elevated.ps1") {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+
+	for path, data := range comm.uploadData {
+		if strings.HasSuffix(path, ".cmd") && !strings.Contains(data, "Set-ExecutionPolicy -ExecutionPolicy Unrestricted -Scope LocalMachine") {
+			t.Fatalf("bad: %s", data)
+		}
+	}
+}
+
+func TestProvisionerPrepare_pauseOnFailure(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["pause_on_failure"] = "i am bad"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["pause_on_failure"] = "30m"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.pauseOnFailure != 30*time.Minute {
+		t.Fatalf("bad: %s", p.config.pauseOnFailure)
+	}
+
+	config["pause_on_failure"] = "until-enter"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerPrepare_installMethod(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(p.config.InstallMethod) != 2 || p.config.InstallMethod[0] != "package" {
+		t.Fatalf("bad: %#v", p.config.InstallMethod)
+	}
+
+	config["install_method"] = []interface{}{"gem", "package"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(p.config.InstallMethod) != 2 || p.config.InstallMethod[0] != "gem" {
+		t.Fatalf("bad: %#v", p.config.InstallMethod)
+	}
+
+	config["install_method"] = []interface{}{"gem", "magic"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_installMethodGroups(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["install_method"] = []interface{}{"aio-repo", "apt", "gem"}
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{"apt", "yum", "zypper", "dmg", "gem"}
+	if !reflect.DeepEqual(p.config.InstallMethod, expected) {
+		t.Fatalf("bad: %#v", p.config.InstallMethod)
+	}
+}
+
+func TestProvisionerPrepare_installMethodSettings(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["install_method"] = []interface{}{"native"}
+	config["gem_flags"] = []string{"--verbose"}
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	delete(config, "gem_flags")
+	config["install_method"] = []interface{}{"package", "gem"}
+	config["puppet_collection"] = "puppet8"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["install_method"] = []interface{}{"native"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Settings of methods that aren't used are fine when not installing
+	config["install_method"] = []interface{}{"gem"}
+	config["skip_install"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerElevate(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	command, err := p.elevateWith(p.config.RunSudo, "", "puppet apply")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if command != "sudo -E puppet apply" {
+		t.Fatalf("bad: %s", command)
+	}
+
+	command, err = p.elevateWith(true, "puppet", "puppet apply")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if command != "sudo -u puppet -E puppet apply" {
+		t.Fatalf("bad: %s", command)
+	}
+
+	config["elevated_command"] = "doas {{.Command}}"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	command, err = p.elevateWith(p.config.RunSudo, "", "puppet apply")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if command != "doas puppet apply" {
+		t.Fatalf("bad: %s", command)
+	}
+
+	config["prevent_sudo"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	command, err = p.elevateWith(p.config.RunSudo, "", "puppet apply")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if command != "puppet apply" {
+		t.Fatalf("bad: %s", command)
+	}
+}
+
+func TestProvisionerPrepare_elevatedCommand(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["elevated_command"] = "su -c '{{.Command}'"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_sudoPassword(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["sudo_password"] = "hunter2"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.ElevatedCommand != DefaultPasswordElevatedCommand {
+		t.Fatalf("bad: %s", p.config.ElevatedCommand)
+	}
+
+	if p.redact("echo hunter2") != "echo <sensitive>" {
+		t.Fatalf("password should be redacted")
+	}
+
+	elevated, err := p.elevateWith(p.config.RunSudo, "", "puppet --version")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.elevatedStdin(elevated) == nil {
+		t.Fatal("should feed the password to stdin")
+	}
+
+	if p.elevatedStdin("puppet --version") != nil {
+		t.Fatal("should not feed the password to unelevated commands")
+	}
+
+	// A custom elevated command may not consume the password.
+	config["elevated_command"] = "doas {{.Command}}"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerRun_sudoPasswordUnelevated(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["sudo_password"] = "hunter2"
+	config["run_sudo"] = false
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.Run(testUi(), comm, &Stage{ModulePath: "/tmp/modules", Manifest: "/tmp/site.pp"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Stdin != nil || comm.StartStdin != "" {
+		t.Fatalf("bad: %q", comm.StartStdin)
+	}
+
+	elevated, err := p.elevateWith(p.config.InstallSudo, "", "true")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.executeCommand(elevated, comm, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Stdin == nil {
+		t.Fatal("should feed the password to elevated commands")
+	}
+}
+
+func TestProvisionerPrepare_maxLineLength(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.MaxLineLength != DefaultMaxLineLength {
+		t.Fatalf("bad: %d", p.config.MaxLineLength)
+	}
+
+	config["max_line_length"] = 4
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_runAsUser(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["run_as_user"] = "puppet"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["prevent_sudo"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_executeCommand(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.ExecuteCommand != DefaultExecuteCommand {
+		t.Fatalf("bad: %s", p.config.ExecuteCommand)
+	}
+
+	config["execute_command"] = "{{.Manifest"
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_exitCodeMap(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(p.config.exitCodes) != 1 || p.config.exitCodes[0] != ExitCodeSuccess {
+		t.Fatalf("bad: %#v", p.config.exitCodes)
+	}
+
+	config["exit_code_map"] = map[string]interface{}{
+		"0":  "success",
+		"2":  "changed",
+		"10": "failure",
+	}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.exitCodes[2] != ExitCodeChanged || p.config.exitCodes[10] != ExitCodeFailure {
+		t.Fatalf("bad: %#v", p.config.exitCodes)
+	}
+
+	config["exit_code_map"] = map[string]interface{}{"two": "changed"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["exit_code_map"] = map[string]interface{}{"2": "maybe"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_guestOSType(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.StagingDir != RemoteStagingPath {
+		t.Fatalf("bad: %s", p.config.StagingDir)
+	}
+
+	config["guest_os_type"] = "windows"
+	config["skip_install"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.StagingDir != guestOSTypes[GuestOSTypeWindows].StagingDir {
+		t.Fatalf("bad: %s", p.config.StagingDir)
+	}
+
+	if p.config.ElevatedCommand != "{{.Command}}" {
+		t.Fatalf("bad: %s", p.config.ElevatedCommand)
+	}
+
+	config["guest_os_type"] = "plan9"
+	config["max_line_length"] = 4
+	p = Provisioner{}
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	if errs := err.(*packer.MultiError).Errors; len(errs) < 2 {
+		t.Fatalf("should report the other errors too: %s", err)
+	}
+}
+
+func TestProvisionerPrepare_modulesPaths(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	path, err := ioutil.TempDir("", "packer-puppet-vendor")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	config["modules_paths"] = []interface{}{path}
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{config["module_path"].(string), path}
+	if len(p.config.ModulesPaths) != 2 ||
+		p.config.ModulesPaths[0] != expected[0] ||
+		p.config.ModulesPaths[1] != expected[1] {
+		t.Fatalf("bad: %#v", p.config.ModulesPaths)
+	}
+
+	config["modules_paths"] = []interface{}{path + "-nope"}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerStage_namedModule(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	path, err := ioutil.TempDir("", "packer-puppet-role")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	config["modules_paths"] = []interface{}{"role=" + path}
+	config["staging_directory"] = "/tmp/staging"
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if stage.ModulePath != "/tmp/staging/modules-0:/tmp/staging/modules-1" {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	expected := []string{"/tmp/staging/modules-0", "/tmp/staging/modules-1/role", "/tmp/staging/manifests"}
+	if !reflect.DeepEqual(comm.uploadDirs, expected) {
+		t.Fatalf("bad: %#v", comm.uploadDirs)
+	}
+
+	config["modules_paths"] = []interface{}{"role=" + path + "-nope"}
+	p = new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestSplitModulesPath(t *testing.T) {
+	cases := []struct {
+		entry string
+		name  string
+		path  string
+	}{
+		{"modules", "", "modules"},
+		{"role=./my-role-code", "role", "./my-role-code"},
+		{"./a=b", "", "./a=b"},
+		{"=modules", "", "=modules"},
+	}
+
+	for _, tc := range cases {
+		name, path := splitModulesPath(tc.entry)
+		if name != tc.name || path != tc.path {
+			t.Fatalf("%s: %s %s", tc.entry, name, path)
+		}
+	}
+}
+
+func TestProvisionerPrepare_remoteDirectories(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["remote_directories"] = []map[string]interface{}{
+		{"path": "/etc/puppetlabs/facter/facts.d", "mode": "0755", "owner": "root"},
+		{"path": "/etc/puppetlabs/custom"},
+	}
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(p.config.RemoteDirectories) != 2 {
+		t.Fatalf("bad: %#v", p.config.RemoteDirectories)
+	}
+
+	dir := p.config.RemoteDirectories[0]
+	if dir.Path != "/etc/puppetlabs/facter/facts.d" || dir.Mode != "0755" || dir.Owner != "root" {
+		t.Fatalf("bad: %#v", dir)
+	}
+
+	config["remote_directories"] = []map[string]interface{}{
+		{"path": "/etc/puppetlabs/custom", "mode": "rwx"},
+	}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["remote_directories"] = []map[string]interface{}{
+		{"mode": "0700"},
+	}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_sudo(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !p.config.InstallSudo || !p.config.RunSudo {
+		t.Fatalf("bad: %#v", p.config)
+	}
+
+	config["prevent_sudo"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.InstallSudo || p.config.RunSudo {
+		t.Fatalf("bad: %#v", p.config)
+	}
+
+	config["prevent_sudo"] = false
+	config["run_sudo"] = false
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !p.config.InstallSudo || p.config.RunSudo {
+		t.Fatalf("bad: %#v", p.config)
+	}
+
+	// Everything but the install follows run_sudo, cleaning up included.
+	comm := new(recordingCommunicator)
+	if err := p.Cleanup(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, command := range comm.commands {
+		if strings.HasPrefix(command, "sudo ") {
+			t.Fatalf("should not elevate: %s", command)
+		}
+	}
+}
+
+func TestProvisionerInstallModules(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["remote_module_path"] = "/etc/puppetlabs/code/environments/production/modules"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	p.ui = testUi()
+	comm := new(packer.MockCommunicator)
+	if err := p.installModules([]string{"/tmp/modules-0"}, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "sudo -E cp -R /tmp/modules-0/. /etc/puppetlabs/code/environments/production/modules"
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerApplyRoot(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.hostPath("/tmp/staging") != "/tmp/staging" {
+		t.Fatalf("bad: %s", p.hostPath("/tmp/staging"))
+	}
+
+	if p.inRoot("puppet apply") != "puppet apply" {
+		t.Fatalf("bad: %s", p.inRoot("puppet apply"))
+	}
+
+	config["apply_root"] = "/mnt/image"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.hostPath("/tmp/staging") != "/mnt/image/tmp/staging" {
+		t.Fatalf("bad: %s", p.hostPath("/tmp/staging"))
+	}
+
+	if p.inRoot("puppet apply") != "chroot /mnt/image puppet apply" {
+		t.Fatalf("bad: %s", p.inRoot("puppet apply"))
+	}
+
+	if check := p.checkInRoot("command -v apt-get"); check != "chroot /mnt/image sh -c 'command -v apt-get'" {
+		t.Fatalf("bad: %s", check)
+	}
+
+	config["guest_os_type"] = "windows"
+	config["skip_install"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_cleanStagingDir(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !p.config.CleanStagingDir {
+		t.Fatal("should clean the staging directory by default")
+	}
+
+	config["clean_staging_directory"] = false
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.CleanStagingDir {
+		t.Fatal("should not clean the staging directory")
+	}
+}
+
+func TestProvisionerStageAndRun(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["staging_directory"] = "/tmp/staging"
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	stage, err := p.Stage(testUi(), comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if stage.ModulePath != "/tmp/staging/modules-0" {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	expected := "/tmp/staging/manifests/" + DefaultManifestFile
+	if stage.Manifest != expected {
+		t.Fatalf("bad: %#v", stage)
+	}
+
+	if comm.UploadDirSrc != config["manifest_path"].(string)+"/" {
+		t.Fatalf("should upload the manifest: %s", comm.UploadDirSrc)
+	}
+
+	if comm.UploadDirDst != "/tmp/staging/manifests" {
+		t.Fatalf("bad: %s", comm.UploadDirDst)
+	}
+
+	if err := p.Run(testUi(), comm, stage); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected = "sudo -E env FACTER_packer_build_uuid=" + p.config.buildUUID +
+		" puppet apply --verbose --modulepath=/tmp/staging/modules-0 " + stage.Manifest
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	comm.StartExitStatus = 1
+	if err := p.Run(testUi(), comm, stage); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerDisableAgentService(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["disable_agent_service"] = true
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	p.ui = testUi()
+	comm := new(packer.MockCommunicator)
+	if err := p.disableAgentService(comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.Contains(comm.StartCmd.Command, "systemctl disable puppet") {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerCheckSudo(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !p.config.suFallback {
+		t.Fatal("should fall back to su")
+	}
+
+	comm := new(packer.MockCommunicator)
+	if err := p.checkSudo(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.ElevatedCommand != DefaultElevatedCommand {
+		t.Fatalf("bad: %s", p.config.ElevatedCommand)
+	}
+
+	comm.StartExitStatus = 1
+	if err := p.checkSudo(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	command, err := p.elevateWith(true, "", "sh -c 'echo hi'")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `su -m root -c 'sh -c '"'"'echo hi'"'"''`
+	if command != expected {
+		t.Fatalf("bad: %s", command)
+	}
+
+	config["elevated_command"] = "doas {{.Command}}"
+	p, err = New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.suFallback {
+		t.Fatal("should not fall back with a configured elevated_command")
+	}
+}
+
+// failingUploadDirCommunicator is a MockCommunicator whose directory
+// uploads fail.
+type failingUploadDirCommunicator struct {
+	packer.MockCommunicator
+}
+
+func (c *failingUploadDirCommunicator) UploadDir(dst string, src string, excl []string) error {
+	return errors.New("not supported")
+}
+
+func TestProvisionerUploadLocalDirectory_fallback(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(failingUploadDirCommunicator)
+	if err := p.uploadLocalDirectory(config["manifest_path"].(string), "/tmp/staging/manifests", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.UploadPath != "/tmp/staging/manifests/"+DefaultManifestFile {
+		t.Fatalf("bad: %s", comm.UploadPath)
+	}
+}
+
+// recordingCommunicator is a MockCommunicator that records the paths and
+// contents of all uploads, which may run concurrently, and all commands.
+type recordingCommunicator struct {
+	packer.MockCommunicator
+	sync.Mutex
+	uploads    []string
+	uploadData map[string]string
+	uploadDirs []string
+	commands   []string
+}
+
+func (c *recordingCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.Lock()
+	c.commands = append(c.commands, rc.Command)
+	c.Unlock()
+	return c.MockCommunicator.Start(rc)
+}
+
+func (c *recordingCommunicator) Upload(path string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.uploads = append(c.uploads, path)
+	if c.uploadData == nil {
+		c.uploadData = make(map[string]string)
+	}
+	c.uploadData[path] = string(data)
+	return nil
+}
+
+func (c *recordingCommunicator) UploadDir(dst string, src string, excl []string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.uploadDirs = append(c.uploadDirs, dst)
+	return nil
+}
+
+func TestProvisionerUploadFiles_concurrency(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_concurrency"] = 0
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	expected := make([]string, 0)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		path := filepath.Join(config["module_path"].(string), name+".pp")
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		expected = append(expected, "/tmp/staging/modules/"+name+".pp")
+	}
+
+	config["upload_concurrency"] = 3
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if err := p.uploadFiles(config["module_path"].(string), "/tmp/staging/modules", comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sort.Strings(comm.uploads)
+	if !reflect.DeepEqual(comm.uploads, expected) {
+		t.Fatalf("bad: %#v", comm.uploads)
+	}
+}
+
+// flakyCommunicator is a MockCommunicator whose first uploads fail.
+type flakyCommunicator struct {
+	packer.MockCommunicator
+	failures int
+}
+
+func (c *flakyCommunicator) Upload(path string, r io.Reader) error {
+	if c.failures > 0 {
+		c.failures--
+		ioutil.ReadAll(r)
+		return errors.New("connection reset")
+	}
+
+	return c.MockCommunicator.Upload(path, r)
+}
+
+func TestProvisionerUpload_retries(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_retry_delay"] = "i am bad"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["upload_retries"] = 2
+	config["upload_retry_delay"] = "1ms"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &flakyCommunicator{failures: 2}
+	if err := p.upload("/tmp/site.pp", strings.NewReader("node default {}"), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.UploadData != "node default {}" {
+		t.Fatalf("bad: %s", comm.UploadData)
+	}
+
+	comm = &flakyCommunicator{failures: 3}
+	if err := p.upload("/tmp/site.pp", strings.NewReader("node default {}"), comm); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,96 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"path"
+)
+
+// puppetDBTermini is the package of the PuppetDB termini, from the
+// repositories of Puppet.
+var puppetDBTermini = &prerequisite{
+	Packages: map[string]string{
+		"apt-get": "puppetdb-termini",
+		"dnf":     "puppetdb-termini",
+		"yum":     "puppetdb-termini",
+		"zypper":  "puppetdb-termini",
+	},
+}
+
+// installPuppetDBTermini installs the PuppetDB termini, which puppet apply
+// needs to talk to PuppetDB.
+func (p *Provisioner) installPuppetDBTermini(ui packer.Ui, comm packer.Communicator) error {
+	command, err := p.elevateWith(p.config.InstallSudo, "",
+		p.inRoot(p.withProxy(prerequisiteInstallCommand(puppetDBTermini))))
+	if err != nil {
+		return err
+	}
+
+	ui.Message("Installing the PuppetDB termini")
+	return p.executeInstallCommand(ui, command, comm)
+}
+
+// configurePuppetDB installs the puppetdb.conf of puppetdb_conf_path into
+// the confdir of Puppet, and the routes.yaml of puppetdb_routes_path at
+// its route_file, owned by root. It then makes PuppetDB the storeconfigs
+// backend, so that puppet apply stores its exported resources in
+// PuppetDB. PuppetDB is made a report processor by configureReports.
+func (p *Provisioner) configurePuppetDB(ui packer.Ui, comm packer.Communicator) error {
+	if !p.config.SkipPuppetDBTerminiInstall {
+		if err := p.installPuppetDBTermini(ui, comm); err != nil {
+			return err
+		}
+	}
+
+	confdir, err := p.puppetSetting("main", "confdir", comm)
+	if err != nil {
+		return err
+	}
+
+	files := [][2]string{
+		{p.config.PuppetDBConfPath, p.config.guest.Join(confdir, "puppetdb.conf")},
+	}
+
+	if p.config.PuppetDBRoutesPath != "" {
+		routeFile, err := p.puppetSetting("main", "route_file", comm)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, [2]string{p.config.PuppetDBRoutesPath, routeFile})
+	}
+
+	for _, f := range files {
+		staged := p.config.guest.Join(p.config.StagingDir, path.Base(f[1]))
+		if err := p.uploadLocalFile(f[0], p.hostPath(staged), comm); err != nil {
+			return err
+		}
+
+		remote := p.hostPath(f[1])
+		for _, command := range []string{
+			p.config.guest.CopyCommand(p.hostPath(staged), remote),
+			p.config.guest.ChownCommand("0:0", remote),
+			p.config.guest.ChmodCommand("644", remote),
+		} {
+			command, err := p.elevateWith(p.config.RunSudo, "", command)
+			if err != nil {
+				return err
+			}
+
+			if err := p.executeCommand(command, comm, 0); err != nil {
+				return fmt.Errorf("Error installing %s: %s", f[0], err)
+			}
+		}
+	}
+
+	for _, setting := range [][2]string{
+		{"storeconfigs", "true"},
+		{"storeconfigs_backend", "puppetdb"},
+	} {
+		if err := p.setPuppetSetting("main", setting[0], setting[1], comm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
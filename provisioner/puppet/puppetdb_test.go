@@ -0,0 +1,77 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerStage_puppetDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer-puppet-puppetdb")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "puppetdb.conf")
+	routes := filepath.Join(dir, "routes.yaml")
+	ioutil.WriteFile(conf, []byte("[main]\nserver_urls = https://puppetdb.example.com:8081\n"), 0644)
+	ioutil.WriteFile(routes, []byte("---\napply:\n  catalog:\n    terminus: compiler\n    cache: puppetdb\n"), 0644)
+
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["puppetdb_routes_path"] = routes
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["puppetdb_conf_path"] = conf
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(agentCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.Contains(comm.uploadData["/tmp/staging/puppetdb.conf"], "puppetdb.example.com") {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	if _, ok := comm.uploadData["/tmp/staging/routes.yaml"]; !ok {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	expected := []string{
+		"sudo -E cp -p /tmp/staging/puppetdb.conf /etc/puppetlabs/puppet/puppetdb.conf",
+		"sudo -E cp -p /tmp/staging/routes.yaml /etc/puppetlabs/puppet/routes.yaml",
+		"sudo -E puppet config set storeconfigs_backend puppetdb --section main",
+		"sudo -E puppet config set reports store,puppetdb --section main",
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+
+	found := false
+	for _, c := range comm.commands {
+		found = found || strings.Contains(c, "install -y puppetdb-termini")
+	}
+
+	if !found {
+		t.Fatalf("should install the termini: %#v", comm.commands)
+	}
+}
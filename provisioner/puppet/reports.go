@@ -0,0 +1,62 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// reportProcessorRegexp matches the valid names of report processors.
+var reportProcessorRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// reportProcessors returns the report processors of the run: those of
+// reports, along with puppetdb when PuppetDB is configured.
+func (p *Provisioner) reportProcessors() []string {
+	processors := p.config.Reports
+	if p.config.PuppetDBConfPath == "" {
+		return processors
+	}
+
+	if len(processors) == 0 {
+		return []string{"store", "puppetdb"}
+	}
+
+	for _, processor := range processors {
+		if processor == "puppetdb" {
+			return processors
+		}
+	}
+
+	return append(processors, "puppetdb")
+}
+
+// configureReports sets the report processors and the report server of
+// puppet.conf, so that the runs of the build publish their reports to
+// the existing dashboards.
+func (p *Provisioner) configureReports(comm packer.Communicator) error {
+	settings := [][2]string{{"report", "true"}}
+	if processors := p.reportProcessors(); len(processors) > 0 {
+		settings = append(settings, [2]string{"reports", strings.Join(processors, ",")})
+	}
+
+	if p.config.ReportURL != "" {
+		settings = append(settings, [2]string{"reporturl", p.config.ReportURL})
+	}
+
+	if p.config.ReportServer != "" {
+		settings = append(settings, [2]string{"report_server", p.config.ReportServer})
+	}
+
+	if p.config.ReportPort != 0 {
+		settings = append(settings, [2]string{"report_port", strconv.Itoa(p.config.ReportPort)})
+	}
+
+	for _, setting := range settings {
+		if err := p.setPuppetSetting("main", setting[0], setting[1], comm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package puppet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProvisionerPrepare_reports(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["reports"] = []string{"http", "Bad Processor"}
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["reports"] = []string{"http"}
+	config["report_port"] = 8140
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["report_server"] = "reports.example.com"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerReportProcessors(t *testing.T) {
+	var p Provisioner
+	if processors := p.reportProcessors(); len(processors) > 0 {
+		t.Fatalf("bad: %#v", processors)
+	}
+
+	p.config.PuppetDBConfPath = "puppetdb.conf"
+	if processors := p.reportProcessors(); !reflect.DeepEqual(processors, []string{"store", "puppetdb"}) {
+		t.Fatalf("bad: %#v", processors)
+	}
+
+	p.config.Reports = []string{"foreman"}
+	if processors := p.reportProcessors(); !reflect.DeepEqual(processors, []string{"foreman", "puppetdb"}) {
+		t.Fatalf("bad: %#v", processors)
+	}
+}
+
+func TestProvisionerStage_reports(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["reports"] = []string{"http", "foreman"}
+	config["report_url"] = "https://dashboard.example.com/reports/upload"
+	config["report_server"] = "reports.example.com"
+	config["report_port"] = 8141
+	config["staging_directory"] = "/tmp/staging"
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		"sudo -E puppet config set reports http,foreman --section main",
+		"sudo -E puppet config set reporturl https://dashboard.example.com/reports/upload --section main",
+		"sudo -E puppet config set report_server reports.example.com --section main",
+		"sudo -E puppet config set report_port 8141 --section main",
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+}
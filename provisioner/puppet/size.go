@@ -0,0 +1,90 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"os"
+)
+
+// localUploadDirs returns the local directories uploaded by Stage.
+func (p *Provisioner) localUploadDirs() []string {
+	dirs := make([]string, 0, len(p.config.ModulesPaths)+2)
+	dirs = append(dirs, p.config.HieraDataPaths...)
+
+	if p.config.EnvironmentPath != "" {
+		return append(dirs, p.config.EnvironmentPath)
+	}
+
+	for _, entry := range p.config.ModulesPaths {
+		_, path := splitModulesPath(entry)
+		dirs = append(dirs, path)
+	}
+
+	if p.config.ManifestPath == "" {
+		return dirs
+	}
+
+	return append(dirs, p.config.ManifestPath)
+}
+
+// measureDirectory returns the number of files in localDir that are
+// uploaded, and their total size.
+func (p *Provisioner) measureDirectory(localDir string) (int, int64, error) {
+	var files int
+	var size int64
+	err := p.walkLocalDirectory(localDir, func(path string, relPath string, f os.FileInfo) error {
+		if f.Mode().IsRegular() {
+			files++
+			size += f.Size()
+		}
+
+		return nil
+	})
+
+	return files, size, err
+}
+
+// checkUploadSize shows the number of files and the total size of the
+// directories to upload, failing if they exceed max_upload_size.
+func (p *Provisioner) checkUploadSize(ui packer.Ui) error {
+	var files int
+	var size int64
+	for _, dir := range p.localUploadDirs() {
+		n, s, err := p.measureDirectory(dir)
+		if err != nil {
+			return fmt.Errorf("Error measuring %s: %s", dir, err)
+		}
+
+		files += n
+		size += s
+	}
+
+	ui.Message(fmt.Sprintf("Uploading %d files (%s)", files, formatSize(size)))
+	if p.config.MaxUploadSize > 0 && size > p.config.MaxUploadSize {
+		return fmt.Errorf(
+			"The files to upload total %s, more than max_upload_size (%s). Check that "+
+				"modules_paths, manifest_path and environment_path point to the intended "+
+				"directories, or list large files in a .packerignore file.",
+			formatSize(size), formatSize(p.config.MaxUploadSize))
+	}
+
+	return nil
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / unit
+	for _, suffix := range []string{"KB", "MB", "GB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+		value /= unit
+	}
+
+	return fmt.Sprintf("%.1f TB", value)
+}
@@ -0,0 +1,65 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestProvisionerStage_maxUploadSize(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	path := filepath.Join(config["module_path"].(string), "big.pp")
+	if err := ioutil.WriteFile(path, make([]byte, 2048), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["max_upload_size"] = -1
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["max_upload_size"] = 1024
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	if _, err := p.Stage(testUi(), comm); err == nil {
+		t.Fatal("should have error")
+	}
+
+	if comm.StartCmd != nil {
+		t.Fatalf("should not run commands: %s", comm.StartCmd.Command)
+	}
+
+	config["max_upload_size"] = 4096
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	cases := map[int64]string{
+		12:                 "12 B",
+		2048:               "2.0 KB",
+		5 * 1024 * 1024:    "5.0 MB",
+		3 << 30:            "3.0 GB",
+		1536 * 1024 * 1024: "1.5 GB",
+	}
+
+	for size, expected := range cases {
+		if actual := formatSize(size); actual != expected {
+			t.Fatalf("%d: %s", size, actual)
+		}
+	}
+}
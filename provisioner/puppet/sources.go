@@ -0,0 +1,66 @@
+package puppet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// vcsDirs are the names of the metadata directories of version control
+// checkouts.
+var vcsDirs = []string{".git", ".hg", ".svn"}
+
+// checkSources walks a local modules path looking for the signs of an
+// incomplete checkout: nested version control checkouts and empty
+// directories, which usually are git submodules that were never
+// initialized. It returns a warning for each of them.
+func checkSources(root string) ([]string, error) {
+	warnings := make([]string, 0)
+
+	root = filepath.Clean(root)
+	visit := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		for _, name := range vcsDirs {
+			if info.Name() == name {
+				return filepath.SkipDir
+			}
+		}
+
+		if path != root {
+			// Submodules have a .git file rather than a directory, so
+			// don't look at the type of the metadata.
+			for _, name := range vcsDirs {
+				if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+					warnings = append(warnings, fmt.Sprintf(
+						"%s is a nested %s checkout or submodule", path, name))
+				}
+			}
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s is empty, it may be a git submodule that wasn't initialized", path))
+		}
+
+		return nil
+	}
+
+	if err := filepath.Walk(root, visit); err != nil {
+		return nil, err
+	}
+
+	return warnings, nil
+}
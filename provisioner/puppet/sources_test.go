@@ -0,0 +1,72 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSources(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer-puppet-sources")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	dirs := []string{
+		".git",
+		"apache/manifests",
+		"stub",
+		"vendored/.git",
+		"vendored/manifests",
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	files := []string{
+		".git/HEAD",
+		"apache/manifests/init.pp",
+		"vendored/.git/HEAD",
+		"vendored/manifests/init.pp",
+	}
+	for _, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte(""), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	warnings, err := checkSources(root)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(warnings) != 2 {
+		t.Fatalf("bad: %#v", warnings)
+	}
+}
+
+func TestCheckSources_clean(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer-puppet-sources")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	err = ioutil.WriteFile(filepath.Join(root, "init.pp"), []byte(""), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	warnings, err := checkSources(root)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(warnings) != 0 {
+		t.Fatalf("bad: %#v", warnings)
+	}
+}
@@ -0,0 +1,174 @@
+package puppet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variables overriding the endpoints of the object stores,
+// as recognized by their own tools.
+const (
+	S3EndpointEnvVar  = "AWS_ENDPOINT_URL"
+	GCSEndpointEnvVar = "STORAGE_EMULATOR_HOST"
+)
+
+// objectRequest returns the request downloading the object at rawURL.
+// Besides http and https URLs, s3://bucket/key and gs://bucket/object
+// URLs are downloaded from S3 and Google Cloud Storage, authenticated
+// with the credentials found in the environment, if any.
+func objectRequest(rawURL string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return s3Request(u.Host, strings.TrimPrefix(u.Path, "/"), time.Now())
+	case "gs":
+		return gcsRequest(u.Host, strings.TrimPrefix(u.Path, "/"))
+	default:
+		return http.NewRequest("GET", rawURL, nil)
+	}
+}
+
+// s3Request returns the request getting an object from S3. It is signed
+// with the credentials of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables, if set, for the region
+// of AWS_REGION or AWS_DEFAULT_REGION.
+func s3Request(bucket string, key string, now time.Time) (*http.Request, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	path := "/" + uriEncode(key)
+	rawURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, region, path)
+	if endpoint := os.Getenv(S3EndpointEnvVar); endpoint != "" {
+		path = "/" + uriEncode(bucket) + path
+		rawURL = strings.TrimRight(endpoint, "/") + path
+	}
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return req, nil
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	signV4(req, path, accessKey, secretKey, region, now)
+	return req, nil
+}
+
+// signV4 signs a request to S3 with AWS Signature Version 4, given its
+// encoded path. All the headers of the request are signed along with
+// the host.
+func signV4(req *http.Request, path string, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payload := headers["x-amz-content-sha256"]
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders, signedHeaders, payload,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes a path as AWS expects in signed requests: every
+// byte but the unreserved characters and slashes is percent-encoded.
+func uriEncode(path string) string {
+	var encoded string
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			strings.IndexByte("-._~/", c) >= 0 {
+			encoded += string(c)
+		} else {
+			encoded += fmt.Sprintf("%%%02X", c)
+		}
+	}
+
+	return encoded
+}
+
+// gcsRequest returns the request getting an object from Google Cloud
+// Storage, authenticated with the OAuth access token of the
+// GOOGLE_OAUTH_ACCESS_TOKEN environment variable, if set.
+func gcsRequest(bucket string, object string) (*http.Request, error) {
+	endpoint := "https://storage.googleapis.com"
+	if host := os.Getenv(GCSEndpointEnvVar); host != "" {
+		endpoint = strings.TrimRight(host, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+
+	req, err := http.NewRequest("GET", endpoint+"/"+url.QueryEscape(bucket)+"/"+uriEncode(object), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req, nil
+}
@@ -0,0 +1,57 @@
+package puppet
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces the transfers sharing it to a number of bytes per
+// second.
+type rateLimiter struct {
+	sync.Mutex
+	bytesPerSecond int
+
+	// Time at which the bytes transferred so far are paid for.
+	next time.Time
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait blocks until the transfer of n more bytes fits within the rate.
+func (l *rateLimiter) wait(n int) {
+	cost := time.Duration(n) * time.Second / time.Duration(l.bytesPerSecond)
+
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(cost)
+	until := l.next
+	l.Unlock()
+
+	time.Sleep(until.Sub(now))
+}
+
+// throttledReader is a reader whose reads are paced by a rateLimiter.
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read at most a second's worth at once, so that the pace is even
+	if len(p) > t.limiter.bytesPerSecond {
+		p = p[:t.limiter.bytesPerSecond]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.limiter.wait(n)
+	}
+
+	return n, err
+}
@@ -0,0 +1,48 @@
+package puppet
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestThrottledReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 300)
+	limiter := newRateLimiter(1000)
+
+	start := time.Now()
+	read, err := ioutil.ReadAll(&throttledReader{bytes.NewReader(data), limiter})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(read, data) {
+		t.Fatalf("bad: %d bytes", len(read))
+	}
+
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("too fast: %s", elapsed)
+	}
+}
+
+func TestProvisionerPrepare_uploadBandwidthLimit(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["upload_bandwidth_limit"] = -1
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["upload_bandwidth_limit"] = 1048576
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.uploadLimiter == nil || p.config.uploadLimiter.bytesPerSecond != 1048576 {
+		t.Fatalf("bad: %#v", p.config.uploadLimiter)
+	}
+}
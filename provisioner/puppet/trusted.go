@@ -0,0 +1,60 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"os"
+	"path"
+)
+
+// DefaultTrustedExternalCommandPath is the remote path the script of
+// trusted_external_command is installed at. It outlives the staging
+// directory, since puppet.conf refers to it.
+const DefaultTrustedExternalCommandPath = "/etc/puppetlabs/puppet/trusted-external-command"
+
+// installScript uploads a local script into the staging directory under
+// the given name, then installs it as an executable at a remote path with
+// elevated privileges.
+func (p *Provisioner) installScript(localPath string, name string, remotePath string, comm packer.Communicator) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	staged := p.config.guest.Join(p.config.StagingDir, name)
+	if err := p.upload(p.hostPath(staged), f, comm); err != nil {
+		return err
+	}
+
+	remotePath = p.hostPath(remotePath)
+	for _, command := range []string{
+		p.config.guest.MkdirCommand(path.Dir(remotePath)),
+		p.config.guest.CopyCommand(p.hostPath(staged), remotePath),
+		p.config.guest.ChmodCommand("755", remotePath),
+	} {
+		command, err := p.elevateWith(p.config.RunSudo, "", command)
+		if err != nil {
+			return err
+		}
+
+		if err := p.executeCommand(command, comm, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installTrustedExternalCommand installs the script of
+// trusted_external_command at its remote path and sets the
+// trusted_external_command setting of puppet.conf to it, so that
+// trusted.external is available to the manifests.
+func (p *Provisioner) installTrustedExternalCommand(comm packer.Communicator) error {
+	err := p.installScript(p.config.TrustedExternalCommand, "trusted-external-command",
+		p.config.RemoteTrustedExternalCommand, comm)
+	if err != nil {
+		return err
+	}
+
+	return p.setPuppetSetting("main", "trusted_external_command", p.config.RemoteTrustedExternalCommand, comm)
+}
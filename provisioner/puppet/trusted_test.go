@@ -0,0 +1,59 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProvisionerStage_trustedExternalCommand(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["trusted_external_command"] = "/nonexistent"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	script, err := ioutil.TempFile("", "packer-puppet-trusted")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(script.Name())
+	script.WriteString("#!/bin/sh\necho '{}'\n")
+	script.Close()
+
+	config["trusted_external_command"] = script.Name()
+	config["staging_directory"] = "/tmp/staging"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(recordingCommunicator)
+	if _, err := p.Stage(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.uploadData["/tmp/staging/trusted-external-command"] != "#!/bin/sh\necho '{}'\n" {
+		t.Fatalf("bad: %#v", comm.uploadData)
+	}
+
+	expected := []string{
+		"sudo -E mkdir -p /etc/puppetlabs/puppet",
+		"sudo -E cp -p /tmp/staging/trusted-external-command " + DefaultTrustedExternalCommandPath,
+		"sudo -E chmod 755 " + DefaultTrustedExternalCommandPath,
+		"sudo -E puppet config set trusted_external_command " + DefaultTrustedExternalCommandPath + " --section main",
+	}
+	for _, command := range expected {
+		found := false
+		for _, c := range comm.commands {
+			found = found || c == command
+		}
+
+		if !found {
+			t.Fatalf("missing %s: %#v", command, comm.commands)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"strconv"
+	"strings"
+)
+
+// puppetVersion returns the version of Puppet on the remote machine, as
+// reported by puppet --version.
+func (p *Provisioner) puppetVersion(comm packer.Communicator) (string, error) {
+	return p.executableVersion("puppet", comm)
+}
+
+// executableVersion returns the version of an executable of the Puppet
+// install on the remote machine, such as puppet or facter, as reported by
+// its --version flag.
+func (p *Provisioner) executableVersion(name string, comm packer.Communicator) (string, error) {
+	command := p.config.guest.ExecutablePath(p.config.PuppetBinDir, name) + " --version"
+	command, err := p.elevateWith(p.config.RunSudo, p.config.RunAsUser, p.inRoot(command))
+	if err != nil {
+		return "", err
+	}
+
+	output, status, err := p.remoteCommandOutput(command, comm)
+	if err != nil {
+		return "", err
+	}
+
+	if status != 0 {
+		return "", fmt.Errorf("%s --version exited with non-zero exit status: %d", name, status)
+	}
+
+	// Puppet may print deprecation warnings before the version
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	version := strings.TrimSpace(lines[len(lines)-1])
+	if version == "" {
+		return "", fmt.Errorf("%s --version printed nothing", name)
+	}
+
+	return version, nil
+}
+
+// versionMatches returns whether version is the wanted version, or one
+// of its patch releases when wanted omits some components.
+func versionMatches(version string, wanted string) bool {
+	return version == wanted || strings.HasPrefix(version, wanted+".")
+}
+
+// parseVersion parses the numeric components of a version such as
+// "3.3.1". A pre-release or build suffix, such as "-rc1", is ignored.
+func parseVersion(version string) ([]int, error) {
+	if idx := strings.IndexAny(version, "-+ "); idx >= 0 {
+		version = version[:idx]
+	}
+
+	parts := strings.Split(version, ".")
+	result := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version: %s", version)
+		}
+
+		result[i] = n
+	}
+
+	return result, nil
+}
+
+// compareVersions returns -1, 0 or 1 if a is older than, the same as or
+// newer than b. Missing components count as zero.
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// verifyVersion makes sure the Puppet on the remote machine is the
+// configured version, and at least the minimum version.
+func (p *Provisioner) verifyVersion(ui packer.Ui, comm packer.Communicator) error {
+	version, err := p.puppetVersion(comm)
+	if err != nil {
+		return fmt.Errorf("Error checking the Puppet version: %s", err)
+	}
+
+	ui.Message(fmt.Sprintf("Puppet version: %s", version))
+	if p.config.Version != "" && !versionMatches(version, p.config.Version) {
+		return fmt.Errorf("Puppet %s is installed, but version %s is configured", version, p.config.Version)
+	}
+
+	if p.config.MinimumVersion != "" {
+		actual, err := parseVersion(version)
+		if err != nil {
+			return fmt.Errorf("Error checking the Puppet version: %s", err)
+		}
+
+		minimum, _ := parseVersion(p.config.MinimumVersion)
+		if compareVersions(actual, minimum) < 0 {
+			return fmt.Errorf("Puppet %s is installed, but at least version %s is required",
+				version, p.config.MinimumVersion)
+		}
+	}
+
+	return nil
+}
+
+// verifyFacterVersion makes sure the Facter on the remote machine is the
+// configured version, and at least the minimum version, as the Facter
+// of older distributions breaks modern modules.
+func (p *Provisioner) verifyFacterVersion(ui packer.Ui, comm packer.Communicator) error {
+	version, err := p.executableVersion("facter", comm)
+	if err != nil {
+		return fmt.Errorf("Error checking the Facter version: %s", err)
+	}
+
+	ui.Message(fmt.Sprintf("Facter version: %s", version))
+	if p.config.FacterVersion != "" && !versionMatches(version, p.config.FacterVersion) {
+		return fmt.Errorf("Facter %s is installed, but version %s is configured", version, p.config.FacterVersion)
+	}
+
+	if p.config.MinimumFacterVersion != "" {
+		actual, err := parseVersion(version)
+		if err != nil {
+			return fmt.Errorf("Error checking the Facter version: %s", err)
+		}
+
+		minimum, _ := parseVersion(p.config.MinimumFacterVersion)
+		if compareVersions(actual, minimum) < 0 {
+			return fmt.Errorf("Facter %s is installed, but at least version %s is required",
+				version, p.config.MinimumFacterVersion)
+		}
+	}
+
+	return nil
+}
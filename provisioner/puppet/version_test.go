@@ -0,0 +1,149 @@
+package puppet
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"testing"
+)
+
+func TestVersionMatches(t *testing.T) {
+	cases := []struct {
+		version  string
+		wanted   string
+		expected bool
+	}{
+		{"3.3.1", "3.3.1", true},
+		{"3.3.1", "3.3", true},
+		{"3.3.1", "3", true},
+		{"3.31.0", "3.3", false},
+		{"3.3.1", "3.3.2", false},
+	}
+
+	for _, tc := range cases {
+		if versionMatches(tc.version, tc.wanted) != tc.expected {
+			t.Fatalf("%s %s: expected %t", tc.version, tc.wanted, tc.expected)
+		}
+	}
+}
+
+func TestProvisionerVerifyVersion(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["skip_install"] = true
+	config["version"] = "3.3"
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "Warning: deprecated\n3.3.1\n"
+	if err := p.verifyVersion(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Command != "sudo -E puppet --version" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	comm.StartStdout = "2.7.19\n"
+	if err := p.verifyVersion(testUi(), comm); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"3.3.1", "3.3.1", 0},
+		{"3.3", "3.3.0", 0},
+		{"3.10.0", "3.9.2", 1},
+		{"2.7.19", "3.0", -1},
+		{"4.0.0-rc1", "4.0", 0},
+	}
+
+	for _, tc := range cases {
+		a, err := parseVersion(tc.a)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		b, err := parseVersion(tc.b)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if actual := compareVersions(a, b); actual != tc.expected {
+			t.Fatalf("%s %s: %d", tc.a, tc.b, actual)
+		}
+	}
+
+	if _, err := parseVersion("three"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerVerifyVersion_minimum(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["skip_install"] = true
+	config["minimum_version"] = "bad"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["minimum_version"] = "3.2"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "3.10.1\n"
+	if err := p.verifyVersion(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm.StartStdout = "2.7.19\n"
+	if err := p.verifyVersion(testUi(), comm); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerVerifyFacterVersion(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	config["skip_install"] = true
+	config["minimum_facter_version"] = "bad"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["minimum_facter_version"] = "2.0"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "3.11.0\n"
+	if err := p.verifyFacterVersion(testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.StartCmd.Command != "sudo -E facter --version" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	comm.StartStdout = "1.7.6\n"
+	if err := p.verifyFacterVersion(testUi(), comm); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,135 @@
+package puppet
+
+import (
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Supported values of symlink_mode.
+const (
+	SymlinkModeFollow   = "follow"
+	SymlinkModeSkip     = "skip"
+	SymlinkModeRecreate = "recreate"
+)
+
+// walkFunc is called for each path walked by walkLocalDirectory.
+type walkFunc func(path string, relPath string, f os.FileInfo) error
+
+// walkLocalDirectory walks localDir like filepath.Walk, giving fn the
+// path relative to localDir as well, and skipping the paths ignored by
+// the ignore files of localDir. The root itself is visited as ".".
+//
+// Symbolic links are handled according to symlink_mode: followed, in
+// which case fn is given the file or directory they point to, skipped,
+// or given to fn as they are to be recreated remotely.
+func (p *Provisioner) walkLocalDirectory(localDir string, fn walkFunc) error {
+	rules, err := readIgnoreRules(localDir)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(localDir)
+	if err != nil {
+		return err
+	}
+
+	return p.walkTree(root, ".", rules, map[string]bool{root: true}, fn)
+}
+
+// walkTree walks the local directory root, whose path relative to the
+// uploaded directory is relRoot. visited holds the real paths of the
+// directories walked through symbolic links so far, which along with
+// the ancestors of a link are where following it would loop.
+func (p *Provisioner) walkTree(root string, relRoot string, rules ignoreRules, visited map[string]bool, fn walkFunc) error {
+	return filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.Join(relRoot, relPath)
+
+		if relPath != "." && rules.Ignored(filepath.ToSlash(relPath), f.IsDir()) {
+			log.Printf("Ignoring %s", path)
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if f.Mode()&os.ModeSymlink == 0 {
+			return fn(path, relPath, f)
+		}
+
+		switch p.config.SymlinkMode {
+		case SymlinkModeSkip:
+			log.Printf("Skipping symbolic link %s", path)
+			return nil
+		case SymlinkModeRecreate:
+			return fn(path, relPath, f)
+		}
+
+		target, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("Broken symbolic link %s: %s", path, err)
+		}
+
+		if !target.IsDir() {
+			return fn(path, relPath, target)
+		}
+
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+
+		// Modules often link back to themselves, for test fixtures
+		sep := string(filepath.Separator)
+		if visited[real] || strings.HasPrefix(filepath.Dir(path)+sep, real+sep) {
+			log.Printf("Skipping symbolic link %s, it loops back to %s", path, real)
+			return nil
+		}
+
+		visited[real] = true
+		return p.walkTree(real, relPath, rules, visited, fn)
+	})
+}
+
+// recreateSymlink creates the remote counterpart of a local symbolic
+// link, pointing to the same target.
+func (p *Provisioner) recreateSymlink(link fileUpload, comm packer.Communicator) error {
+	target, err := os.Readlink(link.localPath)
+	if err != nil {
+		return err
+	}
+
+	command := p.config.guest.SymlinkCommand(target, link.remotePath)
+	if err := p.executeCommand(command, comm, 0); err != nil {
+		return fmt.Errorf("Error creating symbolic link %s: %s", link.remotePath, err)
+	}
+
+	return nil
+}
+
+// containsSymlinks returns whether there are symbolic links within
+// localDir.
+func containsSymlinks(localDir string) (bool, error) {
+	found := false
+	err := filepath.Walk(localDir, func(path string, f os.FileInfo, err error) error {
+		if err == nil && path != localDir && f.Mode()&os.ModeSymlink != 0 {
+			found = true
+		}
+
+		return err
+	})
+
+	return found, err
+}
@@ -0,0 +1,100 @@
+package puppet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testSymlinkTree creates a modules path holding a module, a vendored
+// module linked from elsewhere, a link to a file and a link looping
+// back to the module, as test fixtures do.
+func testSymlinkTree(t *testing.T, modules string, vendor string) {
+	for _, dir := range []string{filepath.Join(modules, "ntp", "spec", "fixtures"), filepath.Join(vendor, "stdlib")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for _, path := range []string{filepath.Join(modules, "ntp", "init.pp"), filepath.Join(vendor, "stdlib", "init.pp")} {
+		if err := ioutil.WriteFile(path, []byte("class {}"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(modules, "stdlib"):                         filepath.Join(vendor, "stdlib"),
+		filepath.Join(modules, "ntp", "site.pp"):                 "init.pp",
+		filepath.Join(modules, "ntp", "spec", "fixtures", "ntp"): "../..",
+	}
+	for path, target := range links {
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestProvisionerUploadLocalDirectory_symlinkMode(t *testing.T) {
+	config := testConfig(t)
+	defer cleanupConfig(config)
+
+	vendor, err := ioutil.TempDir("", "packer-puppet-vendor")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(vendor)
+
+	modules := config["module_path"].(string)
+	testSymlinkTree(t, modules, vendor)
+
+	cases := map[string]struct {
+		uploads []string
+		command string
+	}{
+		SymlinkModeFollow: {
+			[]string{"/r/ntp/init.pp", "/r/ntp/site.pp", "/r/stdlib/init.pp"},
+			"",
+		},
+		SymlinkModeSkip: {
+			[]string{"/r/ntp/init.pp"},
+			"",
+		},
+		SymlinkModeRecreate: {
+			[]string{"/r/ntp/init.pp"},
+			"ln -sfn init.pp /r/ntp/site.pp",
+		},
+	}
+
+	for mode, expected := range cases {
+		config["symlink_mode"] = mode
+		p, err := New(config)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		comm := new(recordingCommunicator)
+		if err := p.uploadLocalDirectory(modules, "/r", comm); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		sort.Strings(comm.uploads)
+		if !reflect.DeepEqual(comm.uploads, expected.uploads) {
+			t.Fatalf("bad: %s %#v", mode, comm.uploads)
+		}
+
+		commands := strings.Join(comm.commands, "\n")
+		if expected.command != "" && !strings.Contains(commands, expected.command) {
+			t.Fatalf("bad: %s %s", mode, commands)
+		}
+	}
+
+	config["symlink_mode"] = "copy"
+	var p Provisioner
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}